@@ -4,25 +4,46 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/dispatcher"
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/handlers"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/services"
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/config"
 	db "github.com/AbramovArseniy/Gofermart/internal/accrual/utils/database"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
 )
 
 func main() {
 	context := context.Background()
 	config := config.New()
-	database, err := db.New(context, config.DBAddress)
+	keeper, err := newKeeper(context, config.DBAddress)
 	if err != nil {
 		log.Fatal(err)
 	}
-	database.Migrate()
 
-	handler := handlers.New(database)
+	recovered, err := services.RecoverOrders(keeper)
+	if err != nil {
+		log.Println(err)
+	}
+	if recovered > 0 {
+		log.Printf("recovered %d half-registered orders", recovered)
+	}
+
+	var callbackHosts []string
+	if config.CallbackHosts != "" {
+		callbackHosts = strings.Split(config.CallbackHosts, ",")
+	}
+
+	go dispatcher.New(keeper, dispatcher.WithAllowedHosts(callbackHosts)).Run(context)
+
+	handler := handlers.New(keeper)
+	handler.AdminToken = config.AdminToken
+	handler.MerchantToken = config.MerchantToken
+	handler.CallbackHosts = callbackHosts
 
 	router := chi.NewRouter()
 	router.Mount("/", handler.Route())
@@ -35,3 +56,16 @@ func main() {
 
 	log.Fatal(server.ListenAndServe())
 }
+
+func newKeeper(ctx context.Context, dbAddress string) (storage.Keeper, error) {
+	if dbAddress == "" {
+		log.Println("DATABASE_URI is not set, using in-memory storage")
+		return storage.NewMemory(), nil
+	}
+	database, err := db.New(ctx, dbAddress)
+	if err != nil {
+		return nil, err
+	}
+	database.Migrate()
+	return database, nil
+}
@@ -4,38 +4,138 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/expiry"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/handlers"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/reconciler"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/reporting"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/config"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/database"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+const (
+	workerCommand          = "worker"
+	subscribeRetryInterval = 10 * time.Second
+)
+
 func main() {
+	worker := len(os.Args) > 1 && os.Args[1] == workerCommand
+	if worker {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	context := context.Background()
 	cfg := config.New()
-	database, err := database.NewDataBase(context, cfg.DBAddress)
+	store, err := newStorage(context, cfg)
 	if err != nil {
 		log.Fatalf("Error during open db %s", err)
 	}
+	defer store.Close()
 
-	database.Migrate()
+	breaker := accrualclient.NewBreaker(accrualclient.BreakerConfig{
+		FailureThreshold: cfg.AccrualFailureThreshold,
+		CoolDown:         cfg.AccrualCoolDown,
+	})
+	accrualSysClient, err := accrualclient.New(cfg.Accrual,
+		accrualclient.WithTimeout(cfg.AccrualTimeout),
+		accrualclient.WithBreaker(breaker),
+		accrualclient.WithToken(cfg.AccrualToken),
+	)
+	if err != nil {
+		log.Fatalf("Error during create accrual client %s", err)
+	}
+	if worker {
+		if cfg.DBAddress == "" {
+			log.Println("worker is running with in-memory storage, it won't see orders uploaded to the server")
+		}
+		log.Println("Worker started")
+		go expiry.New(store, cfg.ExpiryInterval).Run(context)
+		go reporting.New(store, cfg.ReportRefreshInterval).Run(context)
+		newReconciler(store, accrualSysClient, cfg).Run(context)
+		return
+	}
 
-	auth := handlers.NewAuth(context, database, cfg.JWTSecret)
-	g := handlers.NewGophermart(cfg.Accrual, cfg.JWTSecret, database, auth)
-	defer g.Storage.Close()
-	r := g.Router()
+	auth := handlers.NewAuth(context, store, cfg.JWTSecret)
+	g := handlers.NewGophermart(accrualSysClient, cfg.JWTSecret, store, auth)
+	g.WebhookSecret = cfg.WebhookSecret
+	g.AdminToken = cfg.AdminToken
+	g.MerchantToken = cfg.MerchantToken
+	g.ExpiringSoon = cfg.ExpiringSoon
+	g.TransferMin = cfg.TransferMinAmount
+	g.TransferDailyLimit = cfg.TransferDailyLimit
 	s := http.Server{
 		Addr:              cfg.Address,
-		Handler:           r,
+		Handler:           g.Router(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 	log.Println("Server started at", cfg.Address)
-	go g.Storage.CheckOrders(g.AccrualSysClient)
+	if cfg.EmbeddedWorker {
+		go newReconciler(g.Storage, accrualSysClient, cfg).Run(context)
+		go expiry.New(g.Storage, cfg.ExpiryInterval).Run(context)
+		go reporting.New(g.Storage, cfg.ReportRefreshInterval).Run(context)
+	}
+	if cfg.CallbackURL != "" && cfg.WebhookSecret != "" {
+		go subscribe(context, accrualSysClient, cfg.CallbackURL, cfg.WebhookSecret)
+	}
 	err = s.ListenAndServe()
 	if err != nil {
 		log.Fatal("error while starting server: ", err)
 	}
 }
+
+// subscribe keeps trying to register the callback until the accrual system
+// accepts it; until then orders are still picked up by polling.
+func subscribe(ctx context.Context, client *accrualclient.Client, callbackURL, secret string) {
+	for {
+		id, err := client.Subscribe(ctx, callbackURL, secret)
+		if err == nil {
+			log.Printf("subscribed to accrual system events, subscription %d", id)
+			return
+		}
+		log.Println("cannot subscribe to accrual system events:", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(subscribeRetryInterval):
+		}
+	}
+}
+
+func newReconciler(store types.Storage, client *accrualclient.Client, cfg *config.Config) *reconciler.Reconciler {
+	r := reconciler.New(store, client, newScheduler(cfg))
+	r.SetCancellationCheckInterval(cfg.CancellationCheckInterval)
+	return r
+}
+
+func newScheduler(cfg *config.Config) reconciler.Scheduler {
+	if cfg.Scheduler == "adaptive" {
+		return reconciler.NewAdaptive(cfg.ReconcileInterval, cfg.ReconcileMaxBackoff, reconciler.DefaultBatchSize)
+	}
+	return reconciler.FixedInterval(cfg.ReconcileInterval)
+}
+
+func newStorage(ctx context.Context, cfg *config.Config) (types.Storage, error) {
+	if cfg.DBAddress == "" {
+		log.Println("DATABASE_URI is not set, using in-memory storage")
+		memory := storage.NewMemory(ctx)
+		memory.SetPointsExpiry(cfg.PointsExpiryMonths)
+		memory.SetCancellationWindow(cfg.CancellationWindow)
+		return memory, nil
+	}
+	db, err := database.NewDataBase(ctx, cfg.DBAddress)
+	if err != nil {
+		return nil, err
+	}
+	db.SetPointsExpiry(cfg.PointsExpiryMonths)
+	db.SetCancellationWindow(cfg.CancellationWindow)
+	if err = db.Migrate(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
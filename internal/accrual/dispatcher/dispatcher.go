@@ -0,0 +1,220 @@
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/webhook"
+)
+
+const (
+	DefaultInterval    = time.Second
+	DefaultMaxAttempts = 8
+	DefaultRetryDelay  = time.Second
+	DefaultTimeout     = 5 * time.Second
+	maxRetryDelay      = 10 * time.Minute
+	batchSize          = 100
+
+	// lease outlasts a batch in which every delivery times out.
+	lease = 2 * batchSize * DefaultTimeout
+)
+
+var ErrPrivateAddress = errors.New("subscriber resolves to a loopback or private address")
+
+// Dispatcher delivers queued webhook events to subscribers. Failed deliveries
+// are retried with exponential back-off and moved to the dead-letter table
+// after maxAttempts.
+type Dispatcher struct {
+	keeper       storage.Keeper
+	client       *http.Client
+	allowedHosts []string
+	interval     time.Duration
+	maxAttempts  int
+	retryDelay   time.Duration
+}
+
+type Option func(*Dispatcher)
+
+func WithInterval(interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.interval = interval
+	}
+}
+
+func WithRetries(maxAttempts int, retryDelay time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = maxAttempts
+		d.retryDelay = retryDelay
+	}
+}
+
+// WithHTTPClient replaces the default client, and with it the guard against
+// loopback and private addresses.
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithAllowedHosts lets the default client deliver to hosts that resolve to
+// loopback or private addresses.
+func WithAllowedHosts(hosts []string) Option {
+	return func(d *Dispatcher) {
+		d.allowedHosts = hosts
+	}
+}
+
+func New(keeper storage.Keeper, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		keeper:      keeper,
+		interval:    DefaultInterval,
+		maxAttempts: DefaultMaxAttempts,
+		retryDelay:  DefaultRetryDelay,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.client == nil {
+		d.client = newClient(d.allowedHosts)
+	}
+	return d
+}
+
+// PrivateAddress reports whether ip must not receive events unless its host
+// is explicitly allowed.
+func PrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast()
+}
+
+// newClient checks the address it actually connects to rather than the one
+// the host resolved to at subscription, so neither DNS rebinding nor a
+// redirect can point a delivery at an internal service. Redirects are not
+// followed at all.
+func newClient(allowedHosts []string) *http.Client {
+	open := &net.Dialer{Timeout: DefaultTimeout}
+	guarded := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || PrivateAddress(ip) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, allowed := range allowedHosts {
+			if strings.EqualFold(host, allowed) {
+				return open.DialContext(ctx, network, address)
+			}
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{
+		Timeout:   DefaultTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.RunOnce(ctx)
+	}
+}
+
+// RunOnce sends one batch of due deliveries and returns how many of them
+// were accepted by subscribers.
+func (d *Dispatcher) RunOnce(ctx context.Context) int {
+	deliveries, err := d.keeper.ClaimDueDeliveries(batchSize, lease)
+	if err != nil {
+		log.Println("dispatcher:", err)
+		return 0
+	}
+
+	delivered := 0
+	for _, delivery := range deliveries {
+		err = d.deliver(ctx, delivery)
+		switch {
+		case err == nil:
+			delivered++
+			err = d.keeper.CompleteDelivery(delivery.ID)
+		case delivery.Attempts+1 >= d.maxAttempts:
+			log.Printf("dispatcher: giving up on event %s for %s: %s", delivery.EventID, delivery.Subscription.URL, err)
+			err = d.keeper.DeadLetterDelivery(delivery.ID, err.Error())
+		default:
+			err = d.keeper.RetryDelivery(delivery.ID, d.backoff(delivery.Attempts), err.Error())
+		}
+		if err != nil {
+			log.Println("dispatcher:", err)
+		}
+	}
+
+	return delivered
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery types.Delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return fmt.Errorf("cannot create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	webhook.SetHeaders(req.Header, delivery.Subscription.Secret, delivery.EventID, time.Now(), delivery.Payload)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot send event: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("subscriber returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.retryDelay
+	for i := 0; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,132 @@
+package dispatcher_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/dispatcher"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/webhook"
+)
+
+const secret = "dispatcher-test-secret"
+
+var loopback = dispatcher.WithAllowedHosts([]string{"127.0.0.1"})
+
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	received []string
+	errors   []error
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := webhook.Verify(secret, req.Header, body, webhook.DefaultTolerance); err != nil {
+		r.errors = append(r.errors, err)
+	}
+	r.received = append(r.received, req.Header.Get(webhook.HeaderEventID))
+	w.WriteHeader(r.status)
+}
+
+func setup(t *testing.T, status int) (*receiver, storage.Keeper) {
+	t.Helper()
+	r := &receiver{status: status}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, subscribe(t, server.URL)
+}
+
+func subscribe(t *testing.T, url string) storage.Keeper {
+	t.Helper()
+	keeper := storage.NewMemory()
+	if _, err := keeper.AddSubscription(types.Subscription{URL: url, Secret: secret}); err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+	if err := keeper.EnqueueEvent("12345678903-PROCESSED", []byte(`{"order":"12345678903"}`)); err != nil {
+		t.Fatalf("EnqueueEvent: %v", err)
+	}
+	return keeper
+}
+
+func TestDeliver(t *testing.T) {
+	r, keeper := setup(t, http.StatusNoContent)
+
+	if delivered := dispatcher.New(keeper, loopback).RunOnce(context.Background()); delivered != 1 {
+		t.Fatalf("RunOnce delivered %d events, want 1", delivered)
+	}
+	if len(r.received) != 1 || r.received[0] != "12345678903-PROCESSED" || len(r.errors) != 0 {
+		t.Fatalf("receiver got %v, signature errors %v", r.received, r.errors)
+	}
+	if due, _ := keeper.ClaimDueDeliveries(10, 0); len(due) != 0 {
+		t.Fatalf("delivered event still queued: %+v", due)
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	r, keeper := setup(t, http.StatusInternalServerError)
+	d := dispatcher.New(keeper, loopback, dispatcher.WithRetries(3, time.Nanosecond))
+
+	for i := 0; i < 3; i++ {
+		if delivered := d.RunOnce(context.Background()); delivered != 0 {
+			t.Fatalf("RunOnce #%d delivered %d events to a failing subscriber", i, delivered)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(r.received) != 3 {
+		t.Fatalf("receiver got %d attempts, want 3", len(r.received))
+	}
+	if due, _ := keeper.ClaimDueDeliveries(10, 0); len(due) != 0 {
+		t.Fatalf("event must leave the queue after max attempts: %+v", due)
+	}
+	letters, err := keeper.GetDeadLetters()
+	if err != nil || len(letters) != 1 || letters[0].Attempts != 3 || letters[0].LastError != "subscriber returned status 500" {
+		t.Fatalf("GetDeadLetters: %+v, %v", letters, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r, keeper := setup(t, http.StatusServiceUnavailable)
+	d := dispatcher.New(keeper, loopback, dispatcher.WithRetries(3, time.Hour))
+
+	d.RunOnce(context.Background())
+	d.RunOnce(context.Background())
+	if len(r.received) != 1 {
+		t.Fatalf("receiver got %d attempts, retry must wait for back-off", len(r.received))
+	}
+}
+
+func TestRefusePrivateAddress(t *testing.T) {
+	r, keeper := setup(t, http.StatusNoContent)
+
+	if delivered := dispatcher.New(keeper).RunOnce(context.Background()); delivered != 0 {
+		t.Fatalf("RunOnce delivered %d events to a loopback subscriber", delivered)
+	}
+	if len(r.received) != 0 {
+		t.Fatalf("loopback subscriber got %v", r.received)
+	}
+}
+
+func TestNoRedirect(t *testing.T) {
+	r := &receiver{status: http.StatusNoContent}
+	target := httptest.NewServer(r)
+	t.Cleanup(target.Close)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+	keeper := subscribe(t, redirect.URL)
+
+	if delivered := dispatcher.New(keeper, loopback).RunOnce(context.Background()); delivered != 0 {
+		t.Fatalf("RunOnce delivered %d events through a redirect", delivered)
+	}
+	if len(r.received) != 0 {
+		t.Fatalf("redirect was followed to %v", r.received)
+	}
+}
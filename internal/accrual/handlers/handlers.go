@@ -1,17 +1,26 @@
 package handlers
 
 import (
-	"fmt"
 	"net/http"
 
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/services"
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/bearer"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
+const idempotencyKeyHeader = "Idempotency-Key"
+
 type handler struct {
-	Keeper storage.Keeper
+	Keeper     storage.Keeper
+	AdminToken string
+	// MerchantToken guards order cancellation.
+	MerchantToken string
+	// CallbackHosts may receive events even though they resolve to loopback
+	// or private addresses.
+	CallbackHosts []string
 }
 
 func New(keeper storage.Keeper) handler {
@@ -22,6 +31,7 @@ func New(keeper storage.Keeper) handler {
 
 func (h handler) Route() *echo.Echo {
 	e := echo.New()
+	e.HTTPErrorHandler = errs.HTTPErrorHandler
 
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "time=${time_rfc3339}, method=${method}, uri=${uri}, status=${status}, error=${error}\n",
@@ -32,50 +42,100 @@ func (h handler) Route() *echo.Echo {
 	e.POST("/api/orders", h.ordersRegister)
 	e.POST("/api/goods", h.addNewGoods)
 
+	if h.MerchantToken != "" {
+		e.POST("/api/orders/:number/cancel", h.orderCancel, bearer.Require(h.MerchantToken))
+	}
+
+	if h.AdminToken != "" {
+		admin := e.Group("/api/admin", bearer.Require(h.AdminToken))
+		admin.GET("/reports/rules", h.topRules)
+
+		subscriptions := e.Group("/api/subscriptions", bearer.Require(h.AdminToken))
+		subscriptions.POST("", h.subscribe)
+		subscriptions.DELETE("/:id", h.unsubscribe)
+	}
+
 	return e
 }
 
 func (h handler) ordersChecker(c echo.Context) error {
 	orderinfo, status := services.OrderCheck(c.Param("number"))
 	if status != http.StatusOK {
-		c.Response().Writer.WriteHeader(status)
-		err := fmt.Errorf("httpstatus is not OK")
-		return err
+		return errs.New(errs.Internal, "cannot check order number")
 	}
 	if orderinfo != nil {
-		c.Response().Writer.WriteHeader(status)
-		c.Response().Writer.Write(orderinfo)
-		err := fmt.Errorf("order status invalid")
-		return err
+		return c.JSONBlob(http.StatusOK, orderinfo)
 	}
 
 	if !h.Keeper.FindOrder(c.Param("number")) {
-		c.Response().Writer.WriteHeader(http.StatusNoContent)
+		return c.NoContent(http.StatusNoContent)
 	}
 
 	orderinfo, err := services.OrdersNumber(c.Param("number"), h.Keeper)
 	if err != nil {
-		c.Response().Writer.WriteHeader(http.StatusNoContent)
-		return err
+		return errs.Wrap(errs.Internal, "cannot get order info", err)
 	}
-	c.Response().Writer.Write(orderinfo)
-	c.Response().Writer.WriteHeader(http.StatusOK)
 
-	return nil
+	return c.JSONBlob(http.StatusOK, orderinfo)
 }
 
 func (h handler) ordersRegister(c echo.Context) error {
-	httpStatus, err := services.OrderAdd(c.Request().Body, h.Keeper)
+	key := c.Request().Header.Get(idempotencyKeyHeader)
+	httpStatus, body, err := services.IdempotentOrderAdd(key, c.Request().Body, h.Keeper)
+	if err != nil {
+		return err
+	}
 
+	if body != nil {
+		c.Response().Header().Set(echo.HeaderContentType, errs.MIMEProblemJSON)
+	}
 	c.Response().Writer.WriteHeader(httpStatus)
+	c.Response().Writer.Write(body)
+
+	return nil
+}
+
+func (h handler) orderCancel(c echo.Context) error {
+	httpStatus, body, err := services.OrderCancel(c.Param("number"), h.Keeper)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return c.JSONBlob(httpStatus, body)
 }
 
 func (h handler) addNewGoods(c echo.Context) error {
 	httpStatus, err := services.GoodsAdd(c.Request().Body, h.Keeper)
+	if err != nil {
+		return err
+	}
 
-	c.Response().Writer.WriteHeader(httpStatus)
+	return c.NoContent(httpStatus)
+}
+
+func (h handler) subscribe(c echo.Context) error {
+	httpStatus, body, err := services.Subscribe(c.Request().Body, h.Keeper, h.CallbackHosts)
+	if err != nil {
+		return err
+	}
+
+	return c.JSONBlob(httpStatus, body)
+}
+
+func (h handler) unsubscribe(c echo.Context) error {
+	httpStatus, err := services.Unsubscribe(c.Param("id"), h.Keeper)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(httpStatus)
+}
+
+func (h handler) topRules(c echo.Context) error {
+	httpStatus, body, err := services.TopRules(c.QueryParam("limit"), h.Keeper)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return c.JSONBlob(httpStatus, body)
 }
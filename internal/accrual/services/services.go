@@ -1,21 +1,41 @@
 package services
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/luhnchecker"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/dispatcher"
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/validation"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/ordernum"
+	"github.com/AbramovArseniy/Gofermart/internal/webhook"
+)
+
+const (
+	ordersPath = "/api/orders"
+
+	DefaultTopRules = 10
+	maxTopRules     = 100
 )
 
 func OrderCheck(number string) ([]byte, int) {
 	var orderInfo types.OrdersInfo
 
-	if !luhnchecker.CalculateLuhn(number) {
+	if !ordernum.Valid(number) {
 		orderInfo.Order = number
 		orderInfo.Status = types.StatusInvalid
 		i, err := json.Marshal(orderInfo)
@@ -42,45 +62,170 @@ func OrdersNumber(number string, keeper storage.Keeper) ([]byte, error) {
 }
 
 func OrderAdd(list io.Reader, keeper storage.Keeper) (int, error) {
-	var (
-		order     types.CompleteOrder
-		orderInfo types.OrdersInfo
-		accrual   float64
-	)
+	order, err := decodeOrder(list)
+	if err != nil {
+		return 0, err
+	}
+
+	if keeper.CheckOrderRegistered(order.Order) {
+		return 0, errs.ErrOrderRegistered
+	}
+
+	err = keeper.RegisterOrder(order)
+	if err != nil {
+		return 0, errs.Wrap(errs.Internal, "cannot register order", err)
+	}
+
+	err = processOrder(order, keeper)
+	if err != nil {
+		return 0, errs.Wrap(errs.Internal, "cannot process order", err)
+	}
+
+	return http.StatusAccepted, nil
+}
+
+func decodeOrder(list io.Reader) (types.CompleteOrder, error) {
+	var order types.CompleteOrder
+
+	if err := decodeStrict(list, &order); err != nil {
+		return order, err
+	}
+
+	if fields := validation.Order(order); len(fields) > 0 {
+		return order, errs.Validation("invalid order", fields)
+	}
+
+	return order, nil
+}
+
+func IdempotentOrderAdd(key string, list io.Reader, keeper storage.Keeper) (int, []byte, error) {
+	if key == "" {
+		httpStatus, err := OrderAdd(list, keeper)
+		return httpStatus, nil, err
+	}
 
 	body, err := io.ReadAll(list)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return 0, nil, errs.Wrap(errs.Invalid, "cannot read request body", err)
 	}
+	sum := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(sum[:])
 
-	err = json.Unmarshal(body, &order)
+	record, found, err := keeper.GetIdempotencyRecord(key)
 	if err != nil {
-		log.Println("error unm")
-		return http.StatusBadRequest, err
+		return 0, nil, errs.Wrap(errs.Internal, "cannot get idempotency record", err)
+	}
+	if found {
+		return replay(record, requestHash)
 	}
 
-	if keeper.CheckOrderStatus(order.Order) {
-		err := fmt.Errorf("order already processing")
-		return http.StatusConflict, err
+	// An accepted order is registered together with its record, so a retry
+	// after a crash replays the 202 instead of finding the order registered.
+	order, err := decodeOrder(bytes.NewReader(body))
+	if err == nil {
+		var saved bool
+		saved, err = keeper.RegisterOrderWithKey(order, types.IdempotencyRecord{
+			Key:         key,
+			RequestHash: requestHash,
+			Status:      http.StatusAccepted,
+		})
+		switch {
+		case err == nil && !saved:
+			return replayStored(key, requestHash, keeper)
+		case err == nil:
+			if err = processOrder(order, keeper); err != nil {
+				return 0, nil, errs.Wrap(errs.Internal, "cannot process order", err)
+			}
+			return http.StatusAccepted, nil, nil
+		case !errors.Is(err, errs.ErrOrderRegistered):
+			return 0, nil, errs.Wrap(errs.Internal, "cannot register order", err)
+		}
 	}
 
-	orderInfo.Order = order.Order
+	if errs.KindOf(err) == errs.Internal {
+		return 0, nil, err
+	}
+	httpStatus := errs.HTTPStatus(err)
+	response := errs.ProblemJSON(err, ordersPath)
+	saved, saveErr := keeper.SaveIdempotencyRecord(types.IdempotencyRecord{
+		Key:         key,
+		RequestHash: requestHash,
+		Status:      httpStatus,
+		Body:        response,
+	})
+	if saveErr != nil {
+		log.Println("cannot save idempotency record:", saveErr)
+		return httpStatus, nil, err
+	}
+	if !saved {
+		return replayStored(key, requestHash, keeper)
+	}
 
-	err = keeper.RegisterOrder(order)
+	return httpStatus, nil, err
+}
+
+// replayStored replays the record another request saved for key first.
+func replayStored(key, requestHash string, keeper storage.Keeper) (int, []byte, error) {
+	record, found, err := keeper.GetIdempotencyRecord(key)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return 0, nil, errs.Wrap(errs.Internal, "cannot get idempotency record", err)
+	}
+	if !found {
+		return 0, nil, errs.New(errs.Internal, "idempotency record disappeared")
 	}
+	return replay(record, requestHash)
+}
 
-	orderInfo.Status = types.StatusProcessing
+func replay(record types.IdempotencyRecord, requestHash string) (int, []byte, error) {
+	if record.RequestHash != requestHash {
+		return 0, nil, errs.New(errs.Unprocessable, fmt.Sprintf("idempotency key %q already used with a different request body", record.Key))
+	}
+	return record.Status, record.Body, nil
+}
 
-	err = keeper.UpdateOrderStatus(orderInfo)
+// RecoverOrders finishes orders left half-registered by a crash. An order
+// that fails is logged and skipped, so it does not hold back the others; the
+// returned count covers only the recovered orders.
+func RecoverOrders(keeper storage.Keeper) (int, error) {
+	orders, err := keeper.GetUnfinishedOrders()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get unfinished orders: %w", err)
+	}
+
+	recovered := 0
+	for _, order := range orders {
+		if len(order.Goods) == 0 {
+			err = keeper.DeleteOrder(order.Order)
+		} else {
+			err = processOrder(order, keeper)
+		}
+		if err != nil {
+			log.Printf("cannot recover order %s: %s", order.Order, err)
+			continue
+		}
+		recovered++
+	}
+
+	if failed := len(orders) - recovered; failed > 0 {
+		return recovered, fmt.Errorf("cannot recover %d of %d orders", failed, len(orders))
+	}
+	return recovered, nil
+}
+
+func processOrder(order types.CompleteOrder, keeper storage.Keeper) error {
+	orderInfo := types.OrdersInfo{
+		Order:  order.Order,
+		Status: types.StatusProcessing,
+	}
+
+	err := keeper.UpdateOrderStatus(orderInfo)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
 
-	accrual, err = keeper.FindGoods(order)
+	accrual, err := keeper.FindGoods(order)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
 
 	orderInfo.Status = types.StatusProcesed
@@ -88,35 +233,189 @@ func OrderAdd(list io.Reader, keeper storage.Keeper) (int, error) {
 
 	err = keeper.UpdateOrderStatus(orderInfo)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return err
 	}
 
-	return http.StatusAccepted, nil
+	publishStatus(orderInfo, keeper)
+	return nil
 }
 
-func GoodsAdd(newGoods io.Reader, keeper storage.Keeper) (int, error) {
-	var goods types.Goods
+// OrderCancel marks a processed order as cancelled, e.g. after the goods were
+// returned, and tells subscribers so they can take the points back.
+// Cancelling an already cancelled order is a no-op.
+func OrderCancel(number string, keeper storage.Keeper) (int, []byte, error) {
+	if !ordernum.Valid(number) {
+		return 0, nil, errs.ErrInvalidOrderNumber
+	}
+	if !keeper.CheckOrderRegistered(number) {
+		return 0, nil, errs.New(errs.NotFound, "order not found")
+	}
 
-	body, err := io.ReadAll(newGoods)
+	info, cancelled, err := keeper.CancelOrder(number)
 	if err != nil {
-		return http.StatusBadRequest, err
+		return 0, nil, errs.Wrap(errs.Internal, "cannot cancel order", err)
+	}
+	if cancelled {
+		publishStatus(info, keeper)
+	} else if info.Status != types.StatusCancelled {
+		return 0, nil, errs.New(errs.Conflict, fmt.Sprintf("order in status %s cannot be cancelled", info.Status))
 	}
 
-	err = json.Unmarshal(body, &goods)
+	body, err := json.Marshal(info)
 	if err != nil {
-		log.Println("error unm")
-		return http.StatusBadRequest, err
+		return 0, nil, errs.Wrap(errs.Internal, "cannot marshal order info", err)
+	}
+	return http.StatusOK, body, nil
+}
+
+// publishStatus queues a webhook event for every subscriber. Failing to queue
+// is not fatal: subscribers still learn the status by polling.
+func publishStatus(info types.OrdersInfo, keeper storage.Keeper) {
+	event := webhook.Event{
+		ID:        fmt.Sprintf("%s-%s", info.Order, info.Status),
+		Type:      webhook.EventOrderStatusChanged,
+		Order:     info.Order,
+		Status:    string(info.Status),
+		Accrual:   info.Accrual,
+		CreatedAt: time.Now(),
+	}
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = keeper.EnqueueEvent(event.ID, payload)
+	}
+	if err != nil {
+		log.Printf("cannot queue webhook event for order %s: %s", info.Order, err)
+	}
+}
+
+// Subscribe registers a callback for order events. Callbacks resolving to
+// loopback, private or link-local addresses are refused unless their host is
+// one of allowedHosts, so subscriptions cannot be used to reach internal
+// services.
+func Subscribe(body io.Reader, keeper storage.Keeper, allowedHosts []string) (int, []byte, error) {
+	var sub types.Subscription
+
+	if err := decodeStrict(body, &sub); err != nil {
+		return 0, nil, err
+	}
+
+	if fields := validation.Subscription(sub); len(fields) > 0 {
+		return 0, nil, errs.Validation("invalid subscription", fields)
+	}
+	if err := checkCallbackHost(sub.URL, allowedHosts); err != nil {
+		return 0, nil, err
+	}
+
+	sub, err := keeper.AddSubscription(sub)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "cannot add subscription", err)
+	}
+
+	sub.Secret = ""
+	response, err := json.Marshal(sub)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "cannot marshal subscription", err)
+	}
+
+	return http.StatusCreated, response, nil
+}
+
+func checkCallbackHost(callbackURL string, allowedHosts []string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return errs.Validation("invalid subscription", []errs.FieldError{{Field: "url", Message: "must be an absolute http or https url"}})
+	}
+	host := u.Hostname()
+	for _, allowed := range allowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return nil
+		}
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return errs.Validation("invalid subscription", []errs.FieldError{{Field: "url", Message: "host cannot be resolved"}})
+	}
+	for _, ip := range ips {
+		if dispatcher.PrivateAddress(ip) {
+			return errs.Validation("invalid subscription", []errs.FieldError{{Field: "url", Message: "must not point to a loopback or private address"}})
+		}
+	}
+	return nil
+}
+
+func Unsubscribe(id string, keeper storage.Keeper) (int, error) {
+	subID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, errs.New(errs.Invalid, "subscription id must be a number")
+	}
+
+	deleted, err := keeper.DeleteSubscription(subID)
+	if err != nil {
+		return 0, errs.Wrap(errs.Internal, "cannot delete subscription", err)
+	}
+	if !deleted {
+		return 0, errs.New(errs.NotFound, "subscription not found")
+	}
+
+	return http.StatusNoContent, nil
+}
+
+func GoodsAdd(newGoods io.Reader, keeper storage.Keeper) (int, error) {
+	var goods types.Goods
+
+	if err := decodeStrict(newGoods, &goods); err != nil {
+		return 0, err
+	}
+
+	if fields := validation.Goods(goods); len(fields) > 0 {
+		return 0, errs.Validation("invalid goods", fields)
 	}
 
 	if keeper.CheckGoods(goods.Match) {
-		err := fmt.Errorf("goods already registred")
-		return http.StatusConflict, err
+		return 0, errs.ErrGoodsRegistered
 	}
 
-	err = keeper.RegisterGoods(goods)
+	err := keeper.RegisterGoods(goods)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return 0, errs.Wrap(errs.Internal, "cannot register goods", err)
 	}
 
 	return http.StatusOK, nil
 }
+
+func TopRules(limit string, keeper storage.Keeper) (int, []byte, error) {
+	n := DefaultTopRules
+	if limit != "" {
+		var err error
+		if n, err = strconv.Atoi(limit); err != nil || n < 1 || n > maxTopRules {
+			return 0, nil, errs.Validation("invalid query", []errs.FieldError{{Field: "limit", Message: fmt.Sprintf("must be a number from 1 to %d", maxTopRules)}})
+		}
+	}
+
+	stats, err := keeper.GetTopRules(n)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "cannot get rule statistics", err)
+	}
+	if stats == nil {
+		stats = []types.RuleStats{}
+	}
+
+	response, err := json.Marshal(stats)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "cannot marshal rule statistics", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errs.Wrap(errs.Invalid, "cannot decode request body", err)
+	}
+	if dec.More() {
+		return errs.New(errs.Invalid, "unexpected data after json object")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+)
+
+type failingKeeper struct {
+	*storage.Memory
+	failing string
+}
+
+func (k failingKeeper) UpdateOrderStatus(info types.OrdersInfo) error {
+	if info.Order == k.failing {
+		return errors.New("update failed")
+	}
+	return k.Memory.UpdateOrderStatus(info)
+}
+
+func TestRecoverOrders(t *testing.T) {
+	keeper := failingKeeper{Memory: storage.NewMemory(), failing: "12345678903"}
+	goods := []types.OrderGoods{{Description: "Чайник Bork", Price: 7000}}
+	for _, order := range []types.CompleteOrder{
+		{Order: "12345678903", Goods: goods},
+		{Order: "346436439", Goods: goods},
+		{Order: "9278923470"},
+	} {
+		if err := keeper.RegisterOrder(order); err != nil {
+			t.Fatalf("RegisterOrder: %v", err)
+		}
+	}
+
+	recovered, err := RecoverOrders(keeper)
+	if err == nil || recovered != 2 {
+		t.Fatalf("RecoverOrders = %d, %v; want 2 recovered and an error for the failed order", recovered, err)
+	}
+	if info, err := keeper.GetOrderInfo("346436439"); err != nil || info.Status != types.StatusProcesed {
+		t.Fatalf("order after the failed one: %+v, %v", info, err)
+	}
+	if keeper.CheckOrderRegistered("9278923470") {
+		t.Fatal("order without goods must be deleted")
+	}
+}
+
+func TestIdempotentOrderAddRetryAfterFailure(t *testing.T) {
+	keeper := failingKeeper{Memory: storage.NewMemory(), failing: "12345678903"}
+	body := `{"order":"12345678903","goods":[{"description":"Чайник Bork","price":7000}]}`
+
+	if _, _, err := IdempotentOrderAdd("key", strings.NewReader(body), keeper); err == nil {
+		t.Fatal("IdempotentOrderAdd must fail when the order cannot be processed")
+	}
+	status, _, err := IdempotentOrderAdd("key", strings.NewReader(body), keeper)
+	if err != nil || status != http.StatusAccepted {
+		t.Fatalf("retry with the same key: %d, %v; want a replay of 202", status, err)
+	}
+	if _, _, err = IdempotentOrderAdd("other", strings.NewReader(body), keeper); !errors.Is(err, errs.ErrOrderRegistered) {
+		t.Fatalf("other key for the same order: %v, want %v", err, errs.ErrOrderRegistered)
+	}
+}
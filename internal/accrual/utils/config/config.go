@@ -8,8 +8,14 @@ import (
 )
 
 type Config struct {
-	Address   string `env:"RUN_ADDRESS"`
-	DBAddress string `env:"DATABASE_URI"`
+	Address    string `env:"RUN_ADDRESS"`
+	DBAddress  string `env:"DATABASE_URI"`
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// MerchantToken guards order cancellation.
+	MerchantToken string `env:"MERCHANT_TOKEN"`
+	// CallbackHosts is a comma-separated list of subscription hosts allowed
+	// to resolve to private addresses.
+	CallbackHosts string `env:"CALLBACK_ALLOWED_HOSTS"`
 }
 
 func New() *Config {
@@ -17,6 +23,9 @@ func New() *Config {
 
 	flag.StringVar(&cfg.Address, "a", "127.0.0.1:8080", "set server listening address")
 	flag.StringVar(&cfg.DBAddress, "d", "", "set the DB address")
+	flag.StringVar(&cfg.AdminToken, "adm", "", "bearer token for /api/admin and /api/subscriptions endpoints, disabled when empty")
+	flag.StringVar(&cfg.MerchantToken, "mt", "", "bearer token for /api/orders/:number/cancel, disabled when empty")
+	flag.StringVar(&cfg.CallbackHosts, "cbh", "", "comma-separated subscription hosts allowed to resolve to private addresses")
 	flag.Parse()
 
 	if err := env.Parse(&cfg); err != nil {
@@ -3,19 +3,26 @@ package database
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+//go:embed migrations/*.sql
+var migrations embed.FS
+
 type DataBase struct {
 	db  *sql.DB
 	ctx context.Context
@@ -27,11 +34,49 @@ var (
 	registerGoodsQuery     string = "INSERT INTO goods (match, reward, reward_type) VALUES ($1, $2, $3)"
 	registerOrderInfoQuery string = "INSERT INTO accrual (order_number, status) VALUES ($1, $2)"
 	updateOrderInfoQuery   string = "UPDATE accrual SET status = $1, accrual = $2 WHERE order_number = $3"
-	checkOrderStatusQuery  string = "SELECT EXISTS(SELECT status FROM accrual WHERE order_number = $1)"
+	cancelOrderQuery       string = "UPDATE accrual SET status = $1 WHERE order_number = $2 AND status = $3 RETURNING order_number, status, COALESCE(accrual, 0)"
+	checkOrderQuery        string = "SELECT EXISTS(SELECT status FROM accrual WHERE order_number = $1)"
 	findOrderQuery         string = "SELECT EXISTS(SELECT order_number FROM items WHERE order_number = $1)"
 	findGoodsQuery         string = "SELECT EXISTS(SELECT match FROM goods WHERE match = $1)"
 	selectingGoodsQuery    string = "SELECT  match, reward, reward_type FROM goods"
-	orderInfoQuery         string = "SELECT order_number, status, accrual FROM accrual WHERE order_number = $1"
+	orderInfoQuery         string = "SELECT order_number, status, COALESCE(accrual, 0) FROM accrual WHERE order_number = $1"
+	unfinishedOrdersQuery  string = `SELECT a.order_number, i.description, i.price FROM accrual a
+		LEFT JOIN items i ON i.order_number = a.order_number
+		WHERE a.status IN ($1, $2) ORDER BY a.order_number, i.id`
+	topRulesQuery string = `SELECT g.match, COUNT(DISTINCT i.order_number),
+		SUM(CASE g.reward_type WHEN '%' THEN i.price / 100 * g.reward WHEN 'pt' THEN g.reward ELSE 0 END) AS points
+		FROM items i
+		JOIN goods g ON strpos(i.description, g.match) > 0
+		JOIN accrual a ON a.order_number = i.order_number AND a.status = $1
+		GROUP BY g.match
+		ORDER BY 2 DESC, points DESC, g.match
+		LIMIT $2`
+	deleteItemsQuery       string = "DELETE FROM items WHERE order_number = $1"
+	deleteOrderInfoQuery   string = "DELETE FROM accrual WHERE order_number = $1"
+	selectIdempotencyQuery string = "SELECT key, request_hash, status, body FROM idempotency_keys WHERE key = $1"
+	insertIdempotencyQuery string = "INSERT INTO idempotency_keys (key, request_hash, status, body) VALUES ($1, $2, $3, $4) ON CONFLICT (key) DO NOTHING"
+	upsertSubscription     string = `INSERT INTO subscriptions (url, secret) VALUES ($1, $2)
+		ON CONFLICT (url) DO UPDATE SET secret = EXCLUDED.secret RETURNING id`
+	deleteSubscription string = "DELETE FROM subscriptions WHERE id = $1"
+	enqueueEventQuery  string = `INSERT INTO webhook_deliveries (subscription_id, event_id, payload)
+		SELECT id, $1, $2 FROM subscriptions`
+	claimDeliveriesQuery string = `UPDATE webhook_deliveries d SET next_attempt_at = $3
+		FROM subscriptions s
+		WHERE s.id = d.subscription_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE next_attempt_at <= $2
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event_id, d.payload, d.attempts, s.id, s.url, s.secret`
+	completeDeliveryQuery string = "DELETE FROM webhook_deliveries WHERE id = $1"
+	retryDeliveryQuery    string = `UPDATE webhook_deliveries SET attempts = attempts + 1,
+		next_attempt_at = $2, last_error = $3 WHERE id = $1`
+	deadLetterQuery string = `INSERT INTO webhook_dead_letters (subscription_id, url, event_id, payload, attempts, last_error)
+		SELECT d.subscription_id, s.url, d.event_id, d.payload, d.attempts + 1, $2 FROM webhook_deliveries d
+		JOIN subscriptions s ON s.id = d.subscription_id WHERE d.id = $1`
+	deadLettersQuery string = "SELECT id, subscription_id, url, event_id, payload, attempts, COALESCE(last_error, ''), failed_at FROM webhook_dead_letters ORDER BY id"
 )
 
 func New(ctx context.Context, dba string) (*DataBase, error) {
@@ -56,12 +101,16 @@ func (d *DataBase) Migrate() {
 		log.Println(err)
 	}
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://internal/accrual/utils/database/migrations",
-		d.dba,
-		driver)
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	m, err := migrate.NewWithInstance("iofs", source, d.dba, driver)
 	if err != nil {
 		log.Println(err)
+		return
 	}
 
 	if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
@@ -91,6 +140,28 @@ func (d *DataBase) GetOrderInfo(number string) (types.OrdersInfo, error) {
 	return order, nil
 }
 
+// CancelOrder moves a processed order to CANCELLED. Orders in any other
+// status are returned unchanged.
+func (d *DataBase) CancelOrder(number string) (types.OrdersInfo, bool, error) {
+	var order types.OrdersInfo
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return order, false, err
+	}
+
+	row := d.db.QueryRowContext(d.ctx, cancelOrderQuery, types.StatusCancelled, number, types.StatusProcesed)
+	err := row.Scan(&order.Order, &order.Status, &order.Accrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		order, err = d.GetOrderInfo(number)
+		return order, false, err
+	}
+	if err != nil {
+		return order, false, err
+	}
+
+	return order, true, nil
+}
+
 func (d *DataBase) FindOrder(number string) bool {
 	var exist bool
 
@@ -107,20 +178,20 @@ func (d *DataBase) FindOrder(number string) bool {
 	return exist
 }
 
-func (d *DataBase) CheckOrderStatus(number string) bool {
-	var status string
+func (d *DataBase) CheckOrderRegistered(number string) bool {
+	var exist bool
 
 	if d.db == nil {
 		return false
 	}
 
-	row := d.db.QueryRowContext(d.ctx, checkOrderStatusQuery, number)
+	row := d.db.QueryRowContext(d.ctx, checkOrderQuery, number)
 
-	if err := row.Scan(&status); err != nil {
+	if err := row.Scan(&exist); err != nil {
 		return false
 	}
 
-	return status == string(types.StatusProcessing)
+	return exist
 }
 
 func (d *DataBase) RegisterOrder(order types.CompleteOrder) error {
@@ -129,18 +200,19 @@ func (d *DataBase) RegisterOrder(order types.CompleteOrder) error {
 		return err
 	}
 
-	err := d.regOrderInfo(order.Order)
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	tx, err := d.db.BeginTx(d.ctx, nil)
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(d.ctx, registerOrderInfoQuery, order.Order, types.StatusRegistred)
 	if err != nil {
+		err = fmt.Errorf("exec: %w", err)
 		return err
 	}
 
-	defer tx.Rollback()
-
 	stmt, err := tx.PrepareContext(d.ctx, registerOrderQuery)
 	if err != nil {
 		return err
@@ -186,35 +258,6 @@ func (d *DataBase) UpdateOrderStatus(info types.OrdersInfo) error {
 	return tx.Commit()
 }
 
-func (d *DataBase) regOrderInfo(number string) error {
-	if d.db == nil {
-		err := fmt.Errorf("you haven`t opened the database connection")
-		return err
-	}
-
-	tx, err := d.db.BeginTx(d.ctx, nil)
-	if err != nil {
-		return err
-	}
-
-	defer tx.Rollback()
-
-	stmt, err := tx.PrepareContext(d.ctx, registerOrderInfoQuery)
-	if err != nil {
-		return err
-	}
-
-	defer stmt.Close()
-
-	_, err = stmt.ExecContext(d.ctx, number, types.StatusRegistred)
-	if err != nil {
-		err = fmt.Errorf("exec: %w", err)
-		return err
-	}
-
-	return tx.Commit()
-}
-
 func (d *DataBase) FindGoods(order types.CompleteOrder) (float64, error) {
 	var accrual float64
 
@@ -255,9 +298,9 @@ func (d *DataBase) FindGoods(order types.CompleteOrder) (float64, error) {
 
 			if strings.Contains(v.Description, item.Match) {
 				switch item.RewardType {
-				case "%":
+				case types.RewardPercent:
 					accrual += v.Price / 100 * item.Reward
-				case "pt":
+				case types.RewardPoints:
 					accrual += item.Reward
 				}
 			}
@@ -270,6 +313,34 @@ func (d *DataBase) FindGoods(order types.CompleteOrder) (float64, error) {
 	return accrual, tx.Commit()
 }
 
+func (d *DataBase) GetTopRules(limit int) ([]types.RuleStats, error) {
+	var stats []types.RuleStats
+
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(d.ctx, topRulesQuery, types.StatusProcesed, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var s types.RuleStats
+
+		if err = rows.Scan(&s.Match, &s.Orders, &s.Points); err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
 func (d *DataBase) RegisterGoods(goods types.Goods) error {
 	if d.db == nil {
 		err := fmt.Errorf("you haven`t opened the database connection")
@@ -313,3 +384,310 @@ func (d *DataBase) CheckGoods(match string) bool {
 
 	return exist
 }
+
+func (d *DataBase) GetUnfinishedOrders() ([]types.CompleteOrder, error) {
+	var orders []types.CompleteOrder
+
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(d.ctx, unfinishedOrdersQuery, types.StatusRegistred, types.StatusProcessing)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			number      string
+			description sql.NullString
+			price       sql.NullFloat64
+		)
+
+		err = rows.Scan(&number, &description, &price)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(orders) == 0 || orders[len(orders)-1].Order != number {
+			orders = append(orders, types.CompleteOrder{Order: number})
+		}
+		if description.Valid {
+			last := &orders[len(orders)-1]
+			last.Goods = append(last.Goods, types.OrderGoods{
+				Description: description.String,
+				Price:       price.Float64,
+			})
+		}
+	}
+
+	return orders, rows.Err()
+}
+
+func (d *DataBase) DeleteOrder(number string) error {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return err
+	}
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(d.ctx, deleteItemsQuery, number); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(d.ctx, deleteOrderInfoQuery, number); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataBase) GetIdempotencyRecord(key string) (types.IdempotencyRecord, bool, error) {
+	var record types.IdempotencyRecord
+
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return record, false, err
+	}
+
+	row := d.db.QueryRowContext(d.ctx, selectIdempotencyQuery, key)
+
+	err := row.Scan(&record.Key, &record.RequestHash, &record.Status, &record.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.IdempotencyRecord{}, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+
+	return record, true, nil
+}
+
+func (d *DataBase) SaveIdempotencyRecord(record types.IdempotencyRecord) (bool, error) {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return false, err
+	}
+
+	res, err := d.db.ExecContext(d.ctx, insertIdempotencyQuery, record.Key, record.RequestHash, record.Status, record.Body)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (d *DataBase) RegisterOrderWithKey(order types.CompleteOrder, record types.IdempotencyRecord) (bool, error) {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return false, err
+	}
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(d.ctx, insertIdempotencyQuery, record.Key, record.RequestHash, record.Status, record.Body)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	var exists bool
+	if err = tx.QueryRowContext(d.ctx, checkOrderQuery, order.Order).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, errs.ErrOrderRegistered
+	}
+
+	if _, err = tx.ExecContext(d.ctx, registerOrderInfoQuery, order.Order, types.StatusRegistred); err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+	for _, v := range order.Goods {
+		if _, err = tx.ExecContext(d.ctx, registerOrderQuery, order.Order, v.Description, v.Price); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func (d *DataBase) AddSubscription(sub types.Subscription) (types.Subscription, error) {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return sub, err
+	}
+
+	row := d.db.QueryRowContext(d.ctx, upsertSubscription, sub.URL, sub.Secret)
+	if err := row.Scan(&sub.ID); err != nil {
+		return sub, err
+	}
+
+	return sub, nil
+}
+
+func (d *DataBase) DeleteSubscription(id int64) (bool, error) {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return false, err
+	}
+
+	res, err := d.db.ExecContext(d.ctx, deleteSubscription, id)
+	if err != nil {
+		return false, fmt.Errorf("exec: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (d *DataBase) EnqueueEvent(eventID string, payload []byte) error {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return err
+	}
+
+	_, err := d.db.ExecContext(d.ctx, enqueueEventQuery, eventID, payload)
+	if err != nil {
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DataBase) ClaimDueDeliveries(limit int, lease time.Duration) ([]types.Delivery, error) {
+	var deliveries []types.Delivery
+
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return nil, err
+	}
+
+	now := time.Now()
+	rows, err := d.db.QueryContext(d.ctx, claimDeliveriesQuery, limit, now, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var delivery types.Delivery
+
+		err = rows.Scan(&delivery.ID, &delivery.EventID, &delivery.Payload, &delivery.Attempts,
+			&delivery.Subscription.ID, &delivery.Subscription.URL, &delivery.Subscription.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+func (d *DataBase) CompleteDelivery(id int64) error {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return err
+	}
+
+	_, err := d.db.ExecContext(d.ctx, completeDeliveryQuery, id)
+	return err
+}
+
+func (d *DataBase) RetryDelivery(id int64, delay time.Duration, lastError string) error {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return err
+	}
+
+	_, err := d.db.ExecContext(d.ctx, retryDeliveryQuery, id, time.Now().Add(delay), lastError)
+	return err
+}
+
+func (d *DataBase) DeadLetterDelivery(id int64, lastError string) error {
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return err
+	}
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(d.ctx, deadLetterQuery, id, lastError); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(d.ctx, completeDeliveryQuery, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *DataBase) GetDeadLetters() ([]types.DeadLetter, error) {
+	var letters []types.DeadLetter
+
+	if d.db == nil {
+		err := fmt.Errorf("you haven`t opened the database connection")
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(d.ctx, deadLettersQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var letter types.DeadLetter
+
+		err = rows.Scan(&letter.ID, &letter.SubscriptionID, &letter.URL, &letter.EventID,
+			&letter.Payload, &letter.Attempts, &letter.LastError, &letter.FailedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters, rows.Err()
+}
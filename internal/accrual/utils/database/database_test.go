@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage/storagetest"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+)
+
+const testTables = "accrual, items, goods, idempotency_keys, webhook_dead_letters, webhook_deliveries, subscriptions"
+
+func TestDataBase(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Keeper {
+		return newTestDataBase(t)
+	})
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	d := newTestDataBase(t)
+
+	sub, err := d.AddSubscription(types.Subscription{URL: "http://gophermart/callback", Secret: "secret-one-123456"})
+	if err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+	if err = d.EnqueueEvent("12345678903-PROCESSED", []byte(`{"order":"12345678903"}`)); err != nil {
+		t.Fatalf("EnqueueEvent: %v", err)
+	}
+	due, err := d.ClaimDueDeliveries(10, 0)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("ClaimDueDeliveries: %+v, %v", due, err)
+	}
+	if due[0].EventID != "12345678903-PROCESSED" || string(due[0].Payload) != `{"order":"12345678903"}` ||
+		due[0].Subscription.ID != sub.ID {
+		t.Fatalf("ClaimDueDeliveries returned %+v", due[0])
+	}
+}
+
+func newTestDataBase(t *testing.T) *DataBase {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	d, err := New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	d.Migrate()
+	if _, err = d.db.Exec("TRUNCATE " + testTables + " RESTART IDENTITY"); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	t.Cleanup(func() { d.db.Close() })
+	return d
+}
@@ -0,0 +1,7 @@
+CREATE TABLE idempotency_keys (
+    key varchar(255) primary key,
+    request_hash varchar(64) not null,
+    status int not null,
+    body bytea,
+    created_at timestamp not null default now()
+);
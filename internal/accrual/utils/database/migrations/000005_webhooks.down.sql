@@ -0,0 +1,3 @@
+DROP TABLE webhook_dead_letters;
+DROP TABLE webhook_deliveries;
+DROP TABLE subscriptions;
@@ -0,0 +1,30 @@
+CREATE TABLE subscriptions (
+    id bigserial primary key,
+    url varchar(2048) not null unique,
+    secret varchar(255) not null,
+    created_at timestamp not null default now()
+);
+
+CREATE TABLE webhook_deliveries (
+    id bigserial primary key,
+    subscription_id bigint not null references subscriptions (id) on delete cascade,
+    event_id varchar(255) not null,
+    payload bytea not null,
+    attempts int not null default 0,
+    next_attempt_at timestamp not null default now(),
+    last_error text,
+    created_at timestamp not null default now()
+);
+
+CREATE INDEX webhook_deliveries_next_attempt_at_idx ON webhook_deliveries (next_attempt_at);
+
+CREATE TABLE webhook_dead_letters (
+    id bigserial primary key,
+    subscription_id bigint not null,
+    url varchar(2048) not null,
+    event_id varchar(255) not null,
+    payload bytea not null,
+    attempts int not null,
+    last_error text,
+    failed_at timestamp not null default now()
+);
@@ -1,21 +0,0 @@
-package luhnchecker
-
-func CalculateLuhn(number string) bool {
-	checkNumber := checksum(number)
-	return checkNumber == 0
-}
-
-func checksum(number string) int {
-	var luhn int
-	for i := len(number) - 1; i >= 0; i-- {
-		cur := (int)(number[i] - '0')
-		if (len(number)-i)%2 == 0 { // even
-			cur *= 2
-			if cur > 9 {
-				cur = cur%10 + 1
-			}
-		}
-		luhn = (luhn + cur) % 10
-	}
-	return luhn % 10
-}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+)
+
+type delivery struct {
+	types.Delivery
+	nextAttemptAt time.Time
+}
+
+type Memory struct {
+	mu            sync.RWMutex
+	orders        map[string]types.OrdersInfo
+	items         map[string][]types.OrderGoods
+	goods         []types.Goods
+	idempotency   map[string]types.IdempotencyRecord
+	subscriptions map[int64]types.Subscription
+	deliveries    map[int64]*delivery
+	deadLetters   []types.DeadLetter
+	lastID        int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		orders:        make(map[string]types.OrdersInfo),
+		items:         make(map[string][]types.OrderGoods),
+		idempotency:   make(map[string]types.IdempotencyRecord),
+		subscriptions: make(map[int64]types.Subscription),
+		deliveries:    make(map[int64]*delivery),
+	}
+}
+
+func (m *Memory) GetOrderInfo(number string) (types.OrdersInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info, ok := m.orders[number]
+	if !ok {
+		return types.OrdersInfo{}, fmt.Errorf("order %s not found", number)
+	}
+	return info, nil
+}
+
+func (m *Memory) CheckOrderRegistered(number string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.orders[number]
+	return ok
+}
+
+func (m *Memory) CheckGoods(match string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, g := range m.goods {
+		if g.Match == match {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) RegisterOrder(order types.CompleteOrder) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[order.Order]; ok {
+		return fmt.Errorf("order %s already registered", order.Order)
+	}
+	m.orders[order.Order] = types.OrdersInfo{Order: order.Order, Status: types.StatusRegistred}
+	if len(order.Goods) > 0 {
+		m.items[order.Order] = append([]types.OrderGoods(nil), order.Goods...)
+	}
+	return nil
+}
+
+func (m *Memory) RegisterGoods(goods types.Goods) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range m.goods {
+		if g.Match == goods.Match {
+			return fmt.Errorf("goods %s already registered", goods.Match)
+		}
+	}
+	m.goods = append(m.goods, goods)
+	return nil
+}
+
+func (m *Memory) UpdateOrderStatus(info types.OrdersInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[info.Order]; ok {
+		m.orders[info.Order] = info
+	}
+	return nil
+}
+
+func (m *Memory) CancelOrder(number string) (types.OrdersInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, ok := m.orders[number]
+	if !ok {
+		return types.OrdersInfo{}, false, fmt.Errorf("order %s not found", number)
+	}
+	if info.Status != types.StatusProcesed {
+		return info, false, nil
+	}
+	info.Status = types.StatusCancelled
+	m.orders[number] = info
+	return info, true, nil
+}
+
+func (m *Memory) FindOrder(number string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.items[number]
+	return ok
+}
+
+func (m *Memory) FindGoods(order types.CompleteOrder) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var accrual float64
+	for _, v := range order.Goods {
+		for _, item := range m.goods {
+			if !strings.Contains(v.Description, item.Match) {
+				continue
+			}
+			switch item.RewardType {
+			case types.RewardPercent:
+				accrual += v.Price / 100 * item.Reward
+			case types.RewardPoints:
+				accrual += item.Reward
+			}
+		}
+	}
+	return accrual, nil
+}
+
+func (m *Memory) GetTopRules(limit int) ([]types.RuleStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stats []types.RuleStats
+	for _, rule := range m.goods {
+		s := types.RuleStats{Match: rule.Match}
+		for number, items := range m.items {
+			if m.orders[number].Status != types.StatusProcesed {
+				continue
+			}
+			matched := false
+			for _, v := range items {
+				if !strings.Contains(v.Description, rule.Match) {
+					continue
+				}
+				matched = true
+				switch rule.RewardType {
+				case types.RewardPercent:
+					s.Points += v.Price / 100 * rule.Reward
+				case types.RewardPoints:
+					s.Points += rule.Reward
+				}
+			}
+			if matched {
+				s.Orders++
+			}
+		}
+		if s.Orders > 0 {
+			stats = append(stats, s)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Orders != stats[j].Orders {
+			return stats[i].Orders > stats[j].Orders
+		}
+		if stats[i].Points != stats[j].Points {
+			return stats[i].Points > stats[j].Points
+		}
+		return stats[i].Match < stats[j].Match
+	})
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats, nil
+}
+
+func (m *Memory) GetUnfinishedOrders() ([]types.CompleteOrder, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var orders []types.CompleteOrder
+	for number, info := range m.orders {
+		if info.Status != types.StatusRegistred && info.Status != types.StatusProcessing {
+			continue
+		}
+		orders = append(orders, types.CompleteOrder{
+			Order: number,
+			Goods: append([]types.OrderGoods(nil), m.items[number]...),
+		})
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Order < orders[j].Order })
+	return orders, nil
+}
+
+func (m *Memory) DeleteOrder(number string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.orders, number)
+	delete(m.items, number)
+	return nil
+}
+
+func (m *Memory) GetIdempotencyRecord(key string) (types.IdempotencyRecord, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, ok := m.idempotency[key]
+	return record, ok, nil
+}
+
+func (m *Memory) SaveIdempotencyRecord(record types.IdempotencyRecord) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.idempotency[record.Key]; ok {
+		return false, nil
+	}
+	m.idempotency[record.Key] = record
+	return true, nil
+}
+
+func (m *Memory) RegisterOrderWithKey(order types.CompleteOrder, record types.IdempotencyRecord) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.idempotency[record.Key]; ok {
+		return false, nil
+	}
+	if _, ok := m.orders[order.Order]; ok {
+		return false, errs.ErrOrderRegistered
+	}
+	m.idempotency[record.Key] = record
+	m.orders[order.Order] = types.OrdersInfo{Order: order.Order, Status: types.StatusRegistred}
+	if len(order.Goods) > 0 {
+		m.items[order.Order] = append([]types.OrderGoods(nil), order.Goods...)
+	}
+	return true, nil
+}
+
+func (m *Memory) AddSubscription(sub types.Subscription) (types.Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, existing := range m.subscriptions {
+		if existing.URL == sub.URL {
+			sub.ID = id
+			m.subscriptions[id] = sub
+			return sub, nil
+		}
+	}
+	m.lastID++
+	sub.ID = m.lastID
+	m.subscriptions[sub.ID] = sub
+	return sub, nil
+}
+
+func (m *Memory) DeleteSubscription(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subscriptions[id]; !ok {
+		return false, nil
+	}
+	delete(m.subscriptions, id)
+	for deliveryID, d := range m.deliveries {
+		if d.Subscription.ID == id {
+			delete(m.deliveries, deliveryID)
+		}
+	}
+	return true, nil
+}
+
+func (m *Memory) EnqueueEvent(eventID string, payload []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, sub := range m.subscriptions {
+		m.lastID++
+		m.deliveries[m.lastID] = &delivery{
+			Delivery: types.Delivery{
+				ID:           m.lastID,
+				Subscription: sub,
+				EventID:      eventID,
+				Payload:      append([]byte(nil), payload...),
+			},
+			nextAttemptAt: now,
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ClaimDueDeliveries(limit int, lease time.Duration) ([]types.Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var due []types.Delivery
+	for _, d := range m.deliveries {
+		if !d.nextAttemptAt.After(now) {
+			due = append(due, d.Delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, d := range due {
+		m.deliveries[d.ID].nextAttemptAt = now.Add(lease)
+	}
+	return due, nil
+}
+
+func (m *Memory) CompleteDelivery(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.deliveries, id)
+	return nil
+}
+
+func (m *Memory) RetryDelivery(id int64, delay time.Duration, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if d, ok := m.deliveries[id]; ok {
+		d.Attempts++
+		d.nextAttemptAt = time.Now().Add(delay)
+	}
+	return nil
+}
+
+func (m *Memory) DeadLetterDelivery(id int64, lastError string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.deliveries[id]
+	if !ok {
+		return nil
+	}
+	delete(m.deliveries, id)
+	m.lastID++
+	m.deadLetters = append(m.deadLetters, types.DeadLetter{
+		ID:             m.lastID,
+		SubscriptionID: d.Subscription.ID,
+		URL:            d.Subscription.URL,
+		EventID:        d.EventID,
+		Payload:        d.Payload,
+		Attempts:       d.Attempts + 1,
+		LastError:      lastError,
+		FailedAt:       time.Now(),
+	})
+	return nil
+}
+
+func (m *Memory) GetDeadLetters() ([]types.DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]types.DeadLetter(nil), m.deadLetters...), nil
+}
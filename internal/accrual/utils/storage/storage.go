@@ -1,16 +1,39 @@
 package storage
 
 import (
+	"time"
+
 	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
 )
 
 type Keeper interface {
 	GetOrderInfo(number string) (types.OrdersInfo, error)
-	CheckOrderStatus(number string) bool
+	CheckOrderRegistered(number string) bool
 	CheckGoods(match string) bool
 	RegisterOrder(types.CompleteOrder) error
 	RegisterGoods(types.Goods) error
 	UpdateOrderStatus(types.OrdersInfo) error
+	CancelOrder(number string) (info types.OrdersInfo, cancelled bool, err error)
 	FindOrder(number string) bool
 	FindGoods(order types.CompleteOrder) (float64, error)
+	GetTopRules(limit int) ([]types.RuleStats, error)
+	GetUnfinishedOrders() ([]types.CompleteOrder, error)
+	DeleteOrder(number string) error
+	GetIdempotencyRecord(key string) (types.IdempotencyRecord, bool, error)
+	SaveIdempotencyRecord(record types.IdempotencyRecord) (bool, error)
+	// RegisterOrderWithKey registers order and saves record in one write, so
+	// a retry never finds the order without its record. It writes nothing and
+	// returns false if the key already has a record, and fails with
+	// errs.ErrOrderRegistered if the order is registered.
+	RegisterOrderWithKey(order types.CompleteOrder, record types.IdempotencyRecord) (bool, error)
+	AddSubscription(sub types.Subscription) (types.Subscription, error)
+	DeleteSubscription(id int64) (bool, error)
+	EnqueueEvent(eventID string, payload []byte) error
+	// ClaimDueDeliveries returns up to limit due deliveries and keeps them
+	// from being claimed again for lease, so replicas do not send them twice.
+	ClaimDueDeliveries(limit int, lease time.Duration) ([]types.Delivery, error)
+	CompleteDelivery(id int64) error
+	RetryDelivery(id int64, delay time.Duration, lastError string) error
+	DeadLetterDelivery(id int64, lastError string) error
+	GetDeadLetters() ([]types.DeadLetter, error)
 }
@@ -0,0 +1,415 @@
+package storagetest
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+)
+
+type Factory func(t *testing.T) storage.Keeper
+
+func Run(t *testing.T, newKeeper Factory) {
+	t.Run("RegisterOrder", func(t *testing.T) { testRegisterOrder(t, newKeeper(t)) })
+	t.Run("OrderStatus", func(t *testing.T) { testOrderStatus(t, newKeeper(t)) })
+	t.Run("CancelOrder", func(t *testing.T) { testCancelOrder(t, newKeeper(t)) })
+	t.Run("Goods", func(t *testing.T) { testGoods(t, newKeeper(t)) })
+	t.Run("Rewards", func(t *testing.T) { testRewards(t, newKeeper) })
+	t.Run("TopRules", func(t *testing.T) { testTopRules(t, newKeeper(t)) })
+	t.Run("UnfinishedOrders", func(t *testing.T) { testUnfinishedOrders(t, newKeeper(t)) })
+	t.Run("Idempotency", func(t *testing.T) { testIdempotency(t, newKeeper(t)) })
+	t.Run("Subscriptions", func(t *testing.T) { testSubscriptions(t, newKeeper(t)) })
+	t.Run("Deliveries", func(t *testing.T) { testDeliveries(t, newKeeper(t)) })
+}
+
+func order(number string, goods ...types.OrderGoods) types.CompleteOrder {
+	return types.CompleteOrder{Order: number, Goods: goods}
+}
+
+func item(description string, price float64) types.OrderGoods {
+	return types.OrderGoods{Description: description, Price: price}
+}
+
+func testRegisterOrder(t *testing.T, k storage.Keeper) {
+	if k.CheckOrderRegistered("12345678903") || k.FindOrder("12345678903") {
+		t.Fatal("unknown order reported as registered")
+	}
+
+	if err := k.RegisterOrder(order("12345678903", item("Чайник Bork", 7000))); err != nil {
+		t.Fatalf("RegisterOrder: %v", err)
+	}
+	if !k.CheckOrderRegistered("12345678903") || !k.FindOrder("12345678903") {
+		t.Fatal("registered order not found")
+	}
+	if err := k.RegisterOrder(order("12345678903", item("Bork", 1))); err == nil {
+		t.Fatal("RegisterOrder duplicate: want error")
+	}
+
+	info, err := k.GetOrderInfo("12345678903")
+	if err != nil {
+		t.Fatalf("GetOrderInfo: %v", err)
+	}
+	if info.Order != "12345678903" || info.Status != types.StatusRegistred || info.Accrual != 0 {
+		t.Fatalf("GetOrderInfo returned %+v", info)
+	}
+	if _, err = k.GetOrderInfo("9278923470"); err == nil {
+		t.Fatal("GetOrderInfo for unknown order: want error")
+	}
+}
+
+func testOrderStatus(t *testing.T, k storage.Keeper) {
+	if err := k.RegisterOrder(order("12345678903", item("Bork", 100))); err != nil {
+		t.Fatalf("RegisterOrder: %v", err)
+	}
+
+	steps := []types.OrdersInfo{
+		{Order: "12345678903", Status: types.StatusProcessing},
+		{Order: "12345678903", Status: types.StatusProcesed, Accrual: 42.5},
+	}
+	for _, step := range steps {
+		if err := k.UpdateOrderStatus(step); err != nil {
+			t.Fatalf("UpdateOrderStatus(%s): %v", step.Status, err)
+		}
+		info, err := k.GetOrderInfo(step.Order)
+		if err != nil {
+			t.Fatalf("GetOrderInfo: %v", err)
+		}
+		if info != step {
+			t.Fatalf("GetOrderInfo after update: got %+v, want %+v", info, step)
+		}
+	}
+}
+
+func testCancelOrder(t *testing.T, k storage.Keeper) {
+	if _, _, err := k.CancelOrder("12345678903"); err == nil {
+		t.Fatal("CancelOrder of unknown order: no error")
+	}
+	if err := k.RegisterOrder(order("12345678903", item("Bork", 100))); err != nil {
+		t.Fatalf("RegisterOrder: %v", err)
+	}
+
+	info, cancelled, err := k.CancelOrder("12345678903")
+	if err != nil || cancelled || info.Status != types.StatusRegistred {
+		t.Fatalf("CancelOrder of registered order: %+v, %t, %v", info, cancelled, err)
+	}
+
+	processed := types.OrdersInfo{Order: "12345678903", Status: types.StatusProcesed, Accrual: 42.5}
+	if err = k.UpdateOrderStatus(processed); err != nil {
+		t.Fatalf("UpdateOrderStatus: %v", err)
+	}
+	info, cancelled, err = k.CancelOrder("12345678903")
+	want := types.OrdersInfo{Order: "12345678903", Status: types.StatusCancelled, Accrual: 42.5}
+	if err != nil || !cancelled || info != want {
+		t.Fatalf("CancelOrder: %+v, %t, %v, want %+v", info, cancelled, err, want)
+	}
+	if info, err = k.GetOrderInfo("12345678903"); err != nil || info != want {
+		t.Fatalf("GetOrderInfo after cancel: %+v, %v", info, err)
+	}
+
+	info, cancelled, err = k.CancelOrder("12345678903")
+	if err != nil || cancelled || info != want {
+		t.Fatalf("CancelOrder twice: %+v, %t, %v", info, cancelled, err)
+	}
+}
+
+func testGoods(t *testing.T, k storage.Keeper) {
+	goods := types.Goods{Match: "Bork", Reward: 10, RewardType: types.RewardPercent}
+	if k.CheckGoods("Bork") {
+		t.Fatal("unknown goods reported as registered")
+	}
+	if err := k.RegisterGoods(goods); err != nil {
+		t.Fatalf("RegisterGoods: %v", err)
+	}
+	if !k.CheckGoods("Bork") {
+		t.Fatal("registered goods not found")
+	}
+	if err := k.RegisterGoods(goods); err == nil {
+		t.Fatal("RegisterGoods duplicate: want error")
+	}
+}
+
+func testRewards(t *testing.T, newKeeper Factory) {
+	rules := []types.Goods{
+		{Match: "Bork", Reward: 10, RewardType: types.RewardPercent},
+		{Match: "Чайник", Reward: 15, RewardType: types.RewardPoints},
+		{Match: "LG", Reward: 5, RewardType: types.RewardPercent},
+	}
+
+	tests := []struct {
+		name  string
+		order types.CompleteOrder
+		want  float64
+	}{
+		{"no match", order("1", item("Samsung TV", 1000)), 0},
+		{"percent", order("2", item("Bork kettle", 7000)), 700},
+		{"points", order("3", item("Чайник", 100)), 15},
+		{"percent and points on one item", order("4", item("Чайник Bork", 7000)), 715},
+		{"several items", order("5", item("Bork", 1000), item("LG monitor", 200)), 110},
+		{"match is case sensitive", order("6", item("bork", 1000)), 0},
+	}
+
+	k := newKeeper(t)
+	for _, rule := range rules {
+		if err := k.RegisterGoods(rule); err != nil {
+			t.Fatalf("RegisterGoods(%s): %v", rule.Match, err)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.FindGoods(tt.order)
+			if err != nil {
+				t.Fatalf("FindGoods: %v", err)
+			}
+			if diff := got - tt.want; diff > 1e-6 || diff < -1e-6 {
+				t.Fatalf("FindGoods = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func testTopRules(t *testing.T, k storage.Keeper) {
+	for _, rule := range []types.Goods{
+		{Match: "Bork", Reward: 10, RewardType: types.RewardPercent},
+		{Match: "Чайник", Reward: 15, RewardType: types.RewardPoints},
+		{Match: "LG", Reward: 5, RewardType: types.RewardPercent},
+	} {
+		if err := k.RegisterGoods(rule); err != nil {
+			t.Fatalf("RegisterGoods(%s): %v", rule.Match, err)
+		}
+	}
+	orders := []struct {
+		order     types.CompleteOrder
+		processed bool
+	}{
+		{order("12345678903", item("Bork", 1000)), true},
+		{order("9278923470", item("Чайник Bork", 2000), item("Samsung TV", 500)), true},
+		{order("346436439", item("LG monitor", 200)), false},
+	}
+	for _, o := range orders {
+		if err := k.RegisterOrder(o.order); err != nil {
+			t.Fatalf("RegisterOrder: %v", err)
+		}
+		if !o.processed {
+			continue
+		}
+		if err := k.UpdateOrderStatus(types.OrdersInfo{Order: o.order.Order, Status: types.StatusProcesed}); err != nil {
+			t.Fatalf("UpdateOrderStatus: %v", err)
+		}
+	}
+
+	stats, err := k.GetTopRules(10)
+	want := []types.RuleStats{
+		{Match: "Bork", Orders: 2, Points: 300},
+		{Match: "Чайник", Orders: 1, Points: 15},
+	}
+	if err != nil || len(stats) != len(want) {
+		t.Fatalf("GetTopRules: %+v, %v, want %+v", stats, err, want)
+	}
+	for i := range want {
+		if stats[i].Match != want[i].Match || stats[i].Orders != want[i].Orders || math.Abs(stats[i].Points-want[i].Points) > 1e-6 {
+			t.Fatalf("GetTopRules: %+v, want %+v", stats, want)
+		}
+	}
+	if stats, err = k.GetTopRules(1); err != nil || len(stats) != 1 || stats[0].Match != "Bork" {
+		t.Fatalf("GetTopRules with limit: %+v, %v", stats, err)
+	}
+}
+
+func testUnfinishedOrders(t *testing.T, k storage.Keeper) {
+	for _, o := range []types.CompleteOrder{
+		order("12345678903", item("Bork", 100), item("LG", 50)),
+		order("346436439", item("Bork", 10)),
+		order("9278923470", item("LG", 1)),
+	} {
+		if err := k.RegisterOrder(o); err != nil {
+			t.Fatalf("RegisterOrder: %v", err)
+		}
+	}
+	if err := k.UpdateOrderStatus(types.OrdersInfo{Order: "346436439", Status: types.StatusProcessing}); err != nil {
+		t.Fatalf("UpdateOrderStatus: %v", err)
+	}
+	if err := k.UpdateOrderStatus(types.OrdersInfo{Order: "9278923470", Status: types.StatusProcesed, Accrual: 1}); err != nil {
+		t.Fatalf("UpdateOrderStatus: %v", err)
+	}
+
+	orders, err := k.GetUnfinishedOrders()
+	if err != nil {
+		t.Fatalf("GetUnfinishedOrders: %v", err)
+	}
+	if len(orders) != 2 || orders[0].Order != "12345678903" || orders[1].Order != "346436439" {
+		t.Fatalf("GetUnfinishedOrders returned %+v", orders)
+	}
+	if len(orders[0].Goods) != 2 || orders[0].Goods[0] != item("Bork", 100) || orders[0].Goods[1] != item("LG", 50) {
+		t.Fatalf("GetUnfinishedOrders goods: %+v", orders[0].Goods)
+	}
+
+	if err = k.DeleteOrder("12345678903"); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	if k.CheckOrderRegistered("12345678903") || k.FindOrder("12345678903") {
+		t.Fatal("deleted order still registered")
+	}
+}
+
+func testIdempotency(t *testing.T, k storage.Keeper) {
+	if _, found, err := k.GetIdempotencyRecord("key"); err != nil || found {
+		t.Fatalf("GetIdempotencyRecord for unknown key: found=%t, err=%v", found, err)
+	}
+
+	record := types.IdempotencyRecord{Key: "key", RequestHash: "hash", Status: 202}
+	saved, err := k.SaveIdempotencyRecord(record)
+	if err != nil || !saved {
+		t.Fatalf("SaveIdempotencyRecord: saved=%t, err=%v", saved, err)
+	}
+	saved, err = k.SaveIdempotencyRecord(types.IdempotencyRecord{Key: "key", RequestHash: "other", Status: 409})
+	if err != nil || saved {
+		t.Fatalf("SaveIdempotencyRecord for existing key: saved=%t, err=%v", saved, err)
+	}
+
+	got, found, err := k.GetIdempotencyRecord("key")
+	if err != nil || !found {
+		t.Fatalf("GetIdempotencyRecord: found=%t, err=%v", found, err)
+	}
+	if got.RequestHash != record.RequestHash || got.Status != record.Status || len(got.Body) != 0 {
+		t.Fatalf("GetIdempotencyRecord returned %+v, want %+v", got, record)
+	}
+
+	withKey := order("12345678903", item("Чайник Bork", 7000))
+	saved, err = k.RegisterOrderWithKey(withKey, types.IdempotencyRecord{Key: "order-key", RequestHash: "hash", Status: 202})
+	if err != nil || !saved || !k.CheckOrderRegistered(withKey.Order) {
+		t.Fatalf("RegisterOrderWithKey: saved=%t, err=%v", saved, err)
+	}
+	if _, found, err = k.GetIdempotencyRecord("order-key"); err != nil || !found {
+		t.Fatalf("GetIdempotencyRecord after RegisterOrderWithKey: found=%t, err=%v", found, err)
+	}
+	if saved, err = k.RegisterOrderWithKey(order("346436439"), types.IdempotencyRecord{Key: "order-key", RequestHash: "other", Status: 202}); err != nil || saved {
+		t.Fatalf("RegisterOrderWithKey for existing key: saved=%t, err=%v", saved, err)
+	}
+	if k.CheckOrderRegistered("346436439") {
+		t.Fatal("RegisterOrderWithKey for existing key must not register the order")
+	}
+	if _, err = k.RegisterOrderWithKey(withKey, types.IdempotencyRecord{Key: "other-key", RequestHash: "hash", Status: 202}); !errors.Is(err, errs.ErrOrderRegistered) {
+		t.Fatalf("RegisterOrderWithKey for registered order: %v, want %v", err, errs.ErrOrderRegistered)
+	}
+	if _, found, err = k.GetIdempotencyRecord("other-key"); err != nil || found {
+		t.Fatalf("record of a rejected order must not be saved: found=%t, err=%v", found, err)
+	}
+}
+
+func mustSubscribe(t *testing.T, k storage.Keeper, url, secret string) types.Subscription {
+	t.Helper()
+	sub, err := k.AddSubscription(types.Subscription{URL: url, Secret: secret})
+	if err != nil || sub.ID == 0 {
+		t.Fatalf("AddSubscription(%s): %+v, %v", url, sub, err)
+	}
+	return sub
+}
+
+func mustDue(t *testing.T, k storage.Keeper) []types.Delivery {
+	t.Helper()
+	due, err := k.ClaimDueDeliveries(10, 0)
+	if err != nil {
+		t.Fatalf("ClaimDueDeliveries: %v", err)
+	}
+	return due
+}
+
+func testSubscriptions(t *testing.T, k storage.Keeper) {
+	first := mustSubscribe(t, k, "http://gophermart/callback", "secret-one-123456")
+	again := mustSubscribe(t, k, "http://gophermart/callback", "secret-two-123456")
+	if again.ID != first.ID {
+		t.Fatalf("AddSubscription for the same url: id %d, want %d", again.ID, first.ID)
+	}
+	other := mustSubscribe(t, k, "http://other/callback", "secret-three-1234")
+
+	if err := k.EnqueueEvent("12345678903-PROCESSED", []byte(`{}`)); err != nil {
+		t.Fatalf("EnqueueEvent: %v", err)
+	}
+	due := mustDue(t, k)
+	if len(due) != 2 {
+		t.Fatalf("ClaimDueDeliveries: %+v, want one delivery per subscription", due)
+	}
+	for _, d := range due {
+		if d.Subscription.ID == first.ID && d.Subscription.Secret != "secret-two-123456" {
+			t.Fatalf("delivery uses stale secret: %+v", d.Subscription)
+		}
+	}
+
+	deleted, err := k.DeleteSubscription(other.ID)
+	if err != nil || !deleted {
+		t.Fatalf("DeleteSubscription: %t, %v", deleted, err)
+	}
+	if deleted, err = k.DeleteSubscription(other.ID); err != nil || deleted {
+		t.Fatalf("DeleteSubscription for unknown id: %t, %v", deleted, err)
+	}
+	if due = mustDue(t, k); len(due) != 1 || due[0].Subscription.ID != first.ID {
+		t.Fatalf("deliveries of a deleted subscription must be dropped, got %+v", due)
+	}
+}
+
+func testDeliveries(t *testing.T, k storage.Keeper) {
+	if err := k.EnqueueEvent("no-subscribers", []byte(`{}`)); err != nil {
+		t.Fatalf("EnqueueEvent without subscribers: %v", err)
+	}
+	if due := mustDue(t, k); len(due) != 0 {
+		t.Fatalf("ClaimDueDeliveries without subscribers: %+v", due)
+	}
+
+	sub := mustSubscribe(t, k, "http://gophermart/callback", "secret-one-123456")
+	for _, id := range []string{"a", "b"} {
+		if err := k.EnqueueEvent(id, []byte(`{"id":"`+id+`"}`)); err != nil {
+			t.Fatalf("EnqueueEvent: %v", err)
+		}
+	}
+	due := mustDue(t, k)
+	if len(due) != 2 || due[0].EventID != "a" || string(due[0].Payload) != `{"id":"a"}` || due[0].Attempts != 0 {
+		t.Fatalf("ClaimDueDeliveries: %+v", due)
+	}
+	if claimed, err := k.ClaimDueDeliveries(10, time.Hour); err != nil || len(claimed) != 2 {
+		t.Fatalf("ClaimDueDeliveries with lease: %+v, %v", claimed, err)
+	}
+	if again := mustDue(t, k); len(again) != 0 {
+		t.Fatalf("claimed deliveries must wait for the lease, got %+v", again)
+	}
+
+	if err := k.CompleteDelivery(due[0].ID); err != nil {
+		t.Fatalf("CompleteDelivery: %v", err)
+	}
+	if err := k.RetryDelivery(due[1].ID, time.Hour, "connection refused"); err != nil {
+		t.Fatalf("RetryDelivery: %v", err)
+	}
+	if left := mustDue(t, k); len(left) != 0 {
+		t.Fatalf("ClaimDueDeliveries after retry: %+v", left)
+	}
+
+	if err := k.EnqueueEvent("c", []byte(`{"id":"c"}`)); err != nil {
+		t.Fatalf("EnqueueEvent: %v", err)
+	}
+	if err := k.RetryDelivery(mustDue(t, k)[0].ID, 0, "timeout"); err != nil {
+		t.Fatalf("RetryDelivery: %v", err)
+	}
+	retried := mustDue(t, k)
+	if len(retried) != 1 || retried[0].Attempts != 1 {
+		t.Fatalf("ClaimDueDeliveries after immediate retry: %+v", retried)
+	}
+	if err := k.DeadLetterDelivery(retried[0].ID, "status 500"); err != nil {
+		t.Fatalf("DeadLetterDelivery: %v", err)
+	}
+	if left := mustDue(t, k); len(left) != 0 {
+		t.Fatalf("dead-lettered delivery still due: %+v", left)
+	}
+
+	letters, err := k.GetDeadLetters()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("GetDeadLetters: %+v, %v", letters, err)
+	}
+	letter := letters[0]
+	if letter.SubscriptionID != sub.ID || letter.URL != sub.URL || letter.EventID != "c" ||
+		letter.Attempts != 2 || letter.LastError != "status 500" || letter.FailedAt.IsZero() {
+		t.Fatalf("GetDeadLetters returned %+v", letter)
+	}
+}
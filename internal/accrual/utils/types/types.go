@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type status string
 
 type OrdersInfo struct {
@@ -10,11 +12,11 @@ type OrdersInfo struct {
 
 type (
 	CompleteOrder struct {
-		Order string        `json:"order"`
-		Goods []ordersGoods `json:"goods"`
+		Order string       `json:"order"`
+		Goods []OrderGoods `json:"goods"`
 	}
 
-	ordersGoods struct {
+	OrderGoods struct {
 		Description string  `json:"description"`
 		Price       float64 `json:"price"`
 	}
@@ -31,4 +33,50 @@ const (
 	StatusInvalid    status = "INVALID"
 	StatusProcessing status = "PROCESSING"
 	StatusProcesed   status = "PROCESSED"
+	StatusCancelled  status = "CANCELLED"
 )
+
+// RuleStats is how often a goods rule matched processed orders and how many
+// points it gave.
+type RuleStats struct {
+	Match  string  `json:"match"`
+	Orders int     `json:"orders"`
+	Points float64 `json:"points"`
+}
+
+const (
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+)
+
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	Status      int
+	Body        []byte
+}
+
+type Subscription struct {
+	ID     int64  `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type Delivery struct {
+	ID           int64
+	Subscription Subscription
+	EventID      string
+	Payload      []byte
+	Attempts     int
+}
+
+type DeadLetter struct {
+	ID             int64
+	SubscriptionID int64
+	URL            string
+	EventID        string
+	Payload        []byte
+	Attempts       int
+	LastError      string
+	FailedAt       time.Time
+}
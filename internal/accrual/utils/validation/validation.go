@@ -0,0 +1,90 @@
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/ordernum"
+)
+
+const (
+	maxPercentReward = 100
+	minSecretLength  = 16
+)
+
+type Errors []errs.FieldError
+
+func (e *Errors) add(field, message string) {
+	*e = append(*e, errs.FieldError{Field: field, Message: message})
+}
+
+func Order(order types.CompleteOrder) Errors {
+	var fields Errors
+
+	switch ordernum.Validate(order.Order) {
+	case ordernum.ErrEmpty:
+		fields.add("order", "must not be empty")
+	case ordernum.ErrNotDigits:
+		fields.add("order", "must contain only digits")
+	case ordernum.ErrChecksum:
+		fields.add("order", "failed luhn check")
+	}
+
+	if len(order.Goods) == 0 {
+		fields.add("goods", "must contain at least one item")
+	}
+	for i, item := range order.Goods {
+		if strings.TrimSpace(item.Description) == "" {
+			fields.add(fmt.Sprintf("goods[%d].description", i), "must not be empty")
+		}
+		if item.Price < 0 {
+			fields.add(fmt.Sprintf("goods[%d].price", i), "must not be negative")
+		}
+	}
+
+	return fields
+}
+
+func Goods(goods types.Goods) Errors {
+	var fields Errors
+
+	if strings.TrimSpace(goods.Match) == "" {
+		fields.add("match", "must not be empty")
+	}
+
+	switch goods.RewardType {
+	case types.RewardPercent:
+		if goods.Reward > maxPercentReward {
+			fields.add("reward", fmt.Sprintf("must not exceed %d percent", maxPercentReward))
+		}
+	case types.RewardPoints:
+	default:
+		fields.add("reward_type", fmt.Sprintf("must be one of %q, %q", types.RewardPercent, types.RewardPoints))
+	}
+	if goods.Reward <= 0 {
+		fields.add("reward", "must be positive")
+	}
+
+	return fields
+}
+
+func Subscription(sub types.Subscription) Errors {
+	var fields Errors
+
+	u, err := url.Parse(sub.URL)
+	switch {
+	case sub.URL == "":
+		fields.add("url", "must not be empty")
+	case err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https"):
+		fields.add("url", "must be an absolute http or https url")
+	}
+
+	if len(sub.Secret) < minSecretLength {
+		fields.add("secret", fmt.Sprintf("must be at least %d characters long", minSecretLength))
+	}
+
+	return fields
+}
@@ -0,0 +1,42 @@
+package bearer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/labstack/echo/v4"
+)
+
+func TestRequire(t *testing.T) {
+	e := echo.New()
+	handler := Require("secret")(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		header string
+		ok     bool
+	}{
+		{header: "Bearer secret", ok: true},
+		{header: ""},
+		{header: "secret"},
+		{header: "Bearer other"},
+		{header: "Bearer secret2"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			req.Header.Set(echo.HeaderAuthorization, tc.header)
+		}
+		rec := httptest.NewRecorder()
+		err := handler(e.NewContext(req, rec))
+		if tc.ok && (err != nil || rec.Code != http.StatusOK) {
+			t.Errorf("Authorization %q: code %d, err %v, want it let through", tc.header, rec.Code, err)
+		}
+		if !tc.ok && !errors.Is(err, errs.ErrUnauthorized) {
+			t.Errorf("Authorization %q: err %v, want ErrUnauthorized", tc.header, err)
+		}
+	}
+}
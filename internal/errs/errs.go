@@ -0,0 +1,119 @@
+package errs
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	Invalid
+	Unauthorized
+	PaymentRequired
+	Forbidden
+	NotFound
+	Conflict
+	TooLarge
+	Unprocessable
+	TooManyRequests
+	Unavailable
+)
+
+var statuses = map[Kind]int{
+	Internal:        http.StatusInternalServerError,
+	Invalid:         http.StatusBadRequest,
+	Unauthorized:    http.StatusUnauthorized,
+	PaymentRequired: http.StatusPaymentRequired,
+	Forbidden:       http.StatusForbidden,
+	NotFound:        http.StatusNotFound,
+	Conflict:        http.StatusConflict,
+	TooLarge:        http.StatusRequestEntityTooLarge,
+	Unprocessable:   http.StatusUnprocessableEntity,
+	TooManyRequests: http.StatusTooManyRequests,
+	Unavailable:     http.StatusServiceUnavailable,
+}
+
+func (k Kind) HTTPStatus() int {
+	if status, ok := statuses[k]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type Error struct {
+	Kind    Kind
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	for i, fe := range e.Fields {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString("; ")
+		}
+		b.WriteString(fe.Field + " " + fe.Message)
+	}
+	if e.Err != nil {
+		b.WriteString(": " + e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func New(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+func Wrap(kind Kind, message string, err error) *Error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+func Validation(message string, fields []FieldError) *Error {
+	return &Error{Kind: Invalid, Message: message, Fields: fields}
+}
+
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Internal
+}
+
+func HTTPStatus(err error) int {
+	return KindOf(err).HTTPStatus()
+}
+
+var (
+	ErrUserExists         = New(Conflict, "login is already taken")
+	ErrInvalidCredentials = New(Unauthorized, "invalid login or password")
+	ErrUnauthorized       = New(Unauthorized, "user is not authenticated")
+	ErrHashGenerate       = New(Internal, "can't generate password hash")
+	ErrScanData           = New(Internal, "error while scan user ID")
+	ErrKeyNotFound        = New(Internal, "user ID not found")
+	ErrInvalidOrderNumber = New(Unprocessable, "wrong order number format")
+	ErrOrderOwnedByOther  = New(Conflict, "order already uploaded by another user")
+	ErrOrderRegistered    = New(Conflict, "order already registered")
+	ErrGoodsRegistered    = New(Conflict, "goods already registered")
+	ErrInsufficientFunds  = New(PaymentRequired, "not enough accrual on balance")
+	ErrWithdrawalNotFound = New(NotFound, "withdrawal not found")
+	ErrWithdrawalConflict = New(Conflict, "order number already used for another withdrawal")
+	ErrRecipientNotFound  = New(Unprocessable, "recipient not found")
+	ErrTransferLimit      = New(Forbidden, "daily transfer limit exceeded")
+)
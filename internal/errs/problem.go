@@ -0,0 +1,66 @@
+package errs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEProblemJSON = "application/problem+json"
+
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+func NewProblem(err error, instance string) Problem {
+	var (
+		httpErr *echo.HTTPError
+		e       *Error
+	)
+	problem := Problem{
+		Type:     "about:blank",
+		Status:   http.StatusInternalServerError,
+		Instance: instance,
+	}
+	switch {
+	case errors.As(err, &e):
+		problem.Status = e.Kind.HTTPStatus()
+		if e.Kind != Internal {
+			problem.Detail = e.Message
+			problem.Errors = e.Fields
+		}
+	case errors.As(err, &httpErr):
+		problem.Status = httpErr.Code
+		if msg, ok := httpErr.Message.(string); ok {
+			problem.Detail = msg
+		}
+	}
+	problem.Title = http.StatusText(problem.Status)
+	return problem
+}
+
+func ProblemJSON(err error, instance string) []byte {
+	body, _ := json.Marshal(NewProblem(err, instance))
+	return body
+}
+
+func WriteProblem(w http.ResponseWriter, r *http.Request, err error) {
+	problem := NewProblem(err, r.URL.Path)
+	w.Header().Set("Content-Type", MIMEProblemJSON)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	WriteProblem(c.Response(), c.Request(), err)
+}
@@ -0,0 +1,74 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+// Broker wakes up subscribers of a user when one of the user's orders
+// changes. It carries no payload: subscribers read the changes from storage,
+// which also lets them resume from a Last-Event-ID.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[int]map[chan struct{}]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[int]map[chan struct{}]struct{})}
+}
+
+func (b *Broker) Subscribe(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan struct{}]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[userID], ch)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+	}
+}
+
+func (b *Broker) Publish(userID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type notifyingStorage struct {
+	types.Storage
+	broker *Broker
+}
+
+// Notifying wraps storage so that every successful UpgradeOrderStatus
+// publishes to broker.
+func Notifying(storage types.Storage, broker *Broker) types.Storage {
+	return notifyingStorage{Storage: storage, broker: broker}
+}
+
+func (s notifyingStorage) UpgradeOrderStatus(order accrualclient.Order) error {
+	if err := s.Storage.UpgradeOrderStatus(order); err != nil {
+		return err
+	}
+	userID, err := s.Storage.GetOrderUser(order.Number)
+	if err == nil && userID != 0 {
+		s.broker.Publish(userID)
+	}
+	return nil
+}
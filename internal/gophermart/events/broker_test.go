@@ -0,0 +1,67 @@
+package events
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+func received(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	alice, unsubscribe := b.Subscribe(1)
+	bob, _ := b.Subscribe(2)
+
+	b.Publish(1)
+	b.Publish(1)
+	if !received(alice) {
+		t.Fatal("alice was not notified")
+	}
+	if received(alice) {
+		t.Fatal("notifications must be coalesced")
+	}
+	if received(bob) {
+		t.Fatal("bob was notified about alice's order")
+	}
+
+	unsubscribe()
+	b.Publish(1)
+	if received(alice) {
+		t.Fatal("notified after unsubscribe")
+	}
+}
+
+func TestNotifying(t *testing.T) {
+	b := NewBroker()
+	s := Notifying(storage.NewMemory(context.Background()), b)
+	alice, err := s.RegisterNewUser("alice", "hash")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	if err = s.SaveOrder(&types.Order{UserID: alice.ID, Number: "12345678903", Status: "NEW"}); err != nil {
+		t.Fatalf("SaveOrder: %v", err)
+	}
+	ch, unsubscribe := b.Subscribe(alice.ID)
+	defer unsubscribe()
+
+	if err := s.UpgradeOrderStatus(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 1}); err != nil {
+		t.Fatalf("UpgradeOrderStatus: %v", err)
+	}
+	if !received(ch) {
+		t.Fatal("UpgradeOrderStatus did not publish")
+	}
+	if err := s.UpgradeOrderStatus(accrualclient.Order{Number: "79927398713", Status: accrualclient.StatusProcessed}); err != nil {
+		t.Fatalf("UpgradeOrderStatus for unknown order: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package expiry
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+const (
+	DefaultInterval  = defaults.ExpiryInterval
+	DefaultBatchSize = 100
+)
+
+// Job zeroes point lots past their expiry date. Every expired amount is
+// recorded by the storage, so users can see where their points went.
+type Job struct {
+	store     types.PointsExpirer
+	interval  time.Duration
+	batchSize int
+}
+
+func New(store types.PointsExpirer, interval time.Duration) *Job {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Job{
+		store:     store,
+		interval:  interval,
+		batchSize: DefaultBatchSize,
+	}
+}
+
+func (j *Job) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := j.RunOnce(time.Now()); err != nil {
+			log.Println("expiry:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce expires every lot due at now, in batches, and returns the number
+// of lots expired.
+func (j *Job) RunOnce(now time.Time) (int, error) {
+	total := 0
+	for {
+		expired, err := j.store.ExpirePoints(now, j.batchSize)
+		if err != nil {
+			return total, err
+		}
+		for _, e := range expired {
+			log.Printf("expiry: %.2f points of user %d expired (order %s)", e.Amount, e.UserID, e.OrderNum)
+		}
+		total += len(expired)
+		if len(expired) < j.batchSize {
+			return total, nil
+		}
+	}
+}
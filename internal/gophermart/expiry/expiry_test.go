@@ -0,0 +1,50 @@
+package expiry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/expiry"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+func TestRunOnce(t *testing.T) {
+	store := storage.NewMemory(context.Background())
+	store.SetPointsExpiry(6)
+	alice, err := store.RegisterNewUser("alice", "hash")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	for _, number := range []string{"12345678903", "9278923470"} {
+		if err = store.SaveOrder(&types.Order{UserID: alice.ID, Number: number, Status: "NEW"}); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+		err = store.UpgradeOrderStatus(accrualclient.Order{Number: number, Status: accrualclient.StatusProcessed, Accrual: 100})
+		if err != nil {
+			t.Fatalf("UpgradeOrderStatus: %v", err)
+		}
+	}
+	job := expiry.New(store, time.Hour)
+
+	if n, err := job.RunOnce(time.Now()); err != nil || n != 0 {
+		t.Fatalf("RunOnce before expiry: %d, %v", n, err)
+	}
+	if n, err := job.RunOnce(time.Now().AddDate(0, 7, 0)); err != nil || n != 2 {
+		t.Fatalf("RunOnce after expiry: %d, %v", n, err)
+	}
+	if n, err := job.RunOnce(time.Now().AddDate(0, 7, 0)); err != nil || n != 0 {
+		t.Fatalf("RunOnce twice: %d, %v", n, err)
+	}
+
+	balance, _, err := store.GetBalance(alice.ID)
+	if err != nil || balance != 0 {
+		t.Fatalf("GetBalance: %v, %v", balance, err)
+	}
+	expirations, err := store.GetPointExpirations(alice.ID)
+	if err != nil || len(expirations) != 2 {
+		t.Fatalf("GetPointExpirations: %+v, %v", expirations, err)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/database"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
 	"github.com/go-chi/jwtauth"
 	jwx "github.com/lestrrat-go/jwx/jwt"
@@ -36,11 +36,15 @@ func NewAuth(context context.Context, store types.UserDB, secret string) *AuthJW
 }
 
 func (a *AuthJWT) CheckData(u types.UserData) error {
+	var fields []errs.FieldError
 	if u.Login == "" {
-		return errors.New("error: login is empty")
+		fields = append(fields, errs.FieldError{Field: "login", Message: "must not be empty"})
 	}
 	if u.Password == "" {
-		return errors.New("error: password is empty")
+		fields = append(fields, errs.FieldError{Field: "password", Message: "must not be empty"})
+	}
+	if len(fields) > 0 {
+		return errs.Validation("invalid user data", fields)
 	}
 
 	return nil
@@ -50,12 +54,12 @@ func (a *AuthJWT) RegisterUser(userdata types.UserData) (types.User, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(userdata.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Println("error during bcrypt")
-		return types.User{}, types.ErrHashGenerate
+		return types.User{}, errs.ErrHashGenerate
 	}
 	user, err := a.UserStorage.RegisterNewUser(userdata.Login, string(hash))
 	if err != nil {
 		log.Println("error Register New User")
-		return types.User{}, database.ErrUserExists
+		return types.User{}, err
 	}
 
 	return user, nil
@@ -64,13 +68,13 @@ func (a *AuthJWT) RegisterUser(userdata types.UserData) (types.User, error) {
 func (a *AuthJWT) LoginUser(userdata types.UserData) (types.User, error) {
 	user, err := a.UserStorage.GetUserData(userdata.Login)
 	if err != nil {
-		return types.User{}, err
+		return types.User{}, errs.Wrap(errs.Internal, "cannot get user data", err)
 	}
 	if user.ID == 0 {
-		return types.User{}, types.ErrInvalidData
+		return types.User{}, errs.ErrInvalidCredentials
 	}
 	if err = bcrypt.CompareHashAndPassword([]byte(user.HashPassword), []byte(userdata.Password)); err != nil {
-		return types.User{}, types.ErrInvalidData
+		return types.User{}, errs.ErrInvalidCredentials
 	}
 
 	return user, nil
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MIMETextEventStream = "text/event-stream"
+	lastEventIDHeader   = "Last-Event-ID"
+	orderEventsBatch    = 100
+	orderEventsRefresh  = 15 * time.Second
+)
+
+// OrderEventsHandler streams changes of the user's orders as server-sent
+// events. Every event id is the id of the stored change, so a client that
+// reconnects with Last-Event-ID gets exactly the changes it missed. A client
+// that connects without it starts at the latest stored change and does not
+// get the history replayed. Besides broker notifications the stream re-reads
+// storage every orderEventsRefresh, which covers changes made by a separate
+// worker process.
+func (g *Gophermart) OrderEventsHandler(c echo.Context) error {
+	lastID, resume, err := lastEventID(c.Request())
+	if err != nil {
+		return err
+	}
+	userID := g.Auth.GetUserID(c.Request())
+	if !resume {
+		if lastID, err = g.Storage.GetLastOrderEventID(userID); err != nil {
+			return err
+		}
+	}
+
+	notify, unsubscribe := g.Events.Subscribe(userID)
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, MIMETextEventStream)
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	refresh := time.NewTicker(orderEventsRefresh)
+	defer refresh.Stop()
+	for {
+		if lastID, err = g.writeOrderEvents(w, userID, lastID); err != nil {
+			log.Println("OrderEventsHandler:", err)
+			return nil
+		}
+
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-notify:
+		case <-refresh.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+func (g *Gophermart) writeOrderEvents(w *echo.Response, userID int, lastID int64) (int64, error) {
+	for {
+		events, err := g.Storage.GetOrderEvents(userID, lastID, orderEventsBatch)
+		if err != nil {
+			return lastID, err
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return lastID, err
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: order\ndata: %s\n\n", event.ID, data); err != nil {
+				return lastID, err
+			}
+			lastID = event.ID
+		}
+		w.Flush()
+		if len(events) < orderEventsBatch {
+			return lastID, nil
+		}
+	}
+}
+
+// lastEventID reports the id the client wants to resume after and whether
+// it asked to resume at all.
+func lastEventID(r *http.Request) (int64, bool, error) {
+	value := r.Header.Get(lastEventIDHeader)
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, errs.New(errs.Invalid, "Last-Event-ID must be a non-negative number")
+	}
+	return id, true, nil
+}
@@ -1,14 +1,14 @@
 package handlers
 
 import (
-	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"time"
 
+	"github.com/AbramovArseniy/Gofermart/internal/bearer"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/events"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/services"
-	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/database"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
@@ -22,129 +22,241 @@ const (
 
 type Gophermart struct {
 	Storage            types.Storage
-	AccrualSysClient   types.Client
+	AccrualSysClient   *accrualclient.Client
 	AuthenticatedUser  types.User
-	CheckOrderInterval time.Duration
 	Auth               types.Authorization
+	WebhookSecret      string
+	AdminToken         string
+	MerchantToken      string
+	ExpiringSoon       time.Duration
+	TransferMin        float64
+	TransferDailyLimit float64
+	Events             *events.Broker
 	secret             string
 }
 
-func NewGophermart(accrualSysAddress, secret string, database *database.DataBase, auth *AuthJWT) *Gophermart {
-	accrualAddr, _ := url.Parse(accrualSysAddress)
-	accrualAddr.Path = "api/orders"
+func NewGophermart(accrualSysClient *accrualclient.Client, secret string, storage types.Storage, auth *AuthJWT) *Gophermart {
+	broker := events.NewBroker()
 	return &Gophermart{
-		Storage: database,
-		AccrualSysClient: types.Client{
-			URL:    *accrualAddr,
-			Client: http.Client{},
-		},
+		Storage:          events.Notifying(storage, broker),
+		Events:           broker,
+		AccrualSysClient: accrualSysClient,
 		AuthenticatedUser: types.User{
 			Login:        "",
 			HashPassword: "",
 			ID:           1,
 		},
-		CheckOrderInterval: 5 * time.Second,
 		Auth:               auth,
+		ExpiringSoon:       services.DefaultExpiringSoonWindow,
+		TransferMin:        services.DefaultTransferMinAmount,
+		TransferDailyLimit: services.DefaultTransferDailyLimit,
 		secret:             secret,
 	}
 }
 
-func (g *Gophermart) DoRequest(number string) ([]byte, error) {
-	resp, err := http.Get(g.AccrualSysClient.URL.String())
-	if err != nil {
-		return nil, fmt.Errorf("DoRequest: cannot get info from accrual system: %w", err)
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("DoRequest: error while reading response body from accrual system: %w", err)
-	}
-	resp.Body.Close()
-	if resp.StatusCode > 299 {
-		return nil, fmt.Errorf("DoRequest: accrual system returned status %d, error", resp.StatusCode)
-	}
-	return body, nil
-}
-
 func (g *Gophermart) RegistHandler(c echo.Context) error {
 	httpStatus, token, err := services.RegistService(c.Request(), g.Auth)
+	if err != nil {
+		return err
+	}
 
 	c.Response().Header().Set("Authorization", "Bearer "+token)
 	c.Response().Writer.WriteHeader(httpStatus)
 
-	return err
+	return nil
 }
 
 func (g *Gophermart) AuthHandler(c echo.Context) error {
 	httpStatus, token, err := services.AuthService(c.Request(), g.Storage, g.Auth)
-	c.Response().Header().Set("Authorization", token)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Authorization", "Bearer "+token)
 	c.Response().Writer.WriteHeader(httpStatus)
-	return err
+
+	return nil
 }
 
 func (g *Gophermart) PostOrderHandler(c echo.Context) error {
-	httpStatus, err := services.PostOrderService(c.Request(), g.Storage, g.Auth, g.AccrualSysClient)
+	httpStatus, err := services.PostOrderService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
 	c.Response().WriteHeader(httpStatus)
 
-	return err
+	return nil
 }
 
-func (g *Gophermart) GetOrdersHandler(c echo.Context) error {
-	c.Response().Header().Set("Content-Type", "application/json")
+func (g *Gophermart) PostOrdersBatchHandler(c echo.Context) error {
+	httpStatus, body, err := services.PostOrdersBatchService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
-	httpStatus, body, err := services.GetOrderService(c.Request(), g.Storage, g.Auth)
+	return c.JSONBlob(httpStatus, body)
+}
 
-	c.Response().Writer.WriteHeader(httpStatus)
-	c.Response().Writer.Write(body)
+func (g *Gophermart) GetOrdersHandler(c echo.Context) error {
+	httpStatus, body, err := services.GetOrderService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return writeJSON(c, httpStatus, body)
 }
 
 func (g *Gophermart) PostWithdrawalHandler(c echo.Context) error {
 	httpStatus, err := services.PostWithdrawalService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
 	c.Response().Writer.WriteHeader(httpStatus)
 
-	return err
+	return nil
 }
 
 func (g *Gophermart) GetBalanceHandler(c echo.Context) error {
-	c.Response().Writer.Header().Add("Content-Type", "application/json")
+	httpStatus, response, err := services.GetBalanceService(c.Request(), g.Storage, g.Auth, g.ExpiringSoon)
+	if err != nil {
+		return err
+	}
 
-	httpStatus, response, err := services.GetBalanceService(c.Request(), g.Storage, g.Auth)
+	return writeJSON(c, httpStatus, response)
+}
 
-	c.Response().Writer.WriteHeader(httpStatus)
-	c.Response().Writer.Write(response)
+func (g *Gophermart) GetWithdrawalsHandler(c echo.Context) error {
+	httpStatus, response, err := services.GetWithdrawalsService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return writeJSON(c, httpStatus, response)
 }
 
-func (g *Gophermart) GetWithdrawalsHandler(c echo.Context) error {
-	c.Response().Writer.Header().Add("Content-Type", "application/json")
+func (g *Gophermart) GetPointExpirationsHandler(c echo.Context) error {
+	httpStatus, response, err := services.GetPointExpirationsService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
 
-	httpStatus, response, err := services.GetWithdrawalsService(c.Request(), g.Storage, g.Auth)
+	return writeJSON(c, httpStatus, response)
+}
 
-	c.Response().Writer.WriteHeader(httpStatus)
-	c.Response().Write(response)
+func (g *Gophermart) TransferHandler(c echo.Context) error {
+	httpStatus, response, err := services.TransferService(c.Request(), g.Storage, g.Auth, g.TransferMin, g.TransferDailyLimit)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(c, httpStatus, response)
+}
+
+func (g *Gophermart) GetTransactionsHandler(c echo.Context) error {
+	httpStatus, response, err := services.GetTransactionsService(c.Request(), g.Storage, g.Auth)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(c, httpStatus, response)
+}
+
+func (g *Gophermart) ReverseWithdrawalHandler(c echo.Context) error {
+	httpStatus, response, err := services.ReverseWithdrawalService(c.Request(), c.Param("id"), g.Storage)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(c, httpStatus, response)
+}
+
+func (g *Gophermart) DailyReportHandler(c echo.Context) error {
+	httpStatus, response, err := services.DailyReportService(c.Request(), g.Storage)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(c, httpStatus, response)
+}
+
+func (g *Gophermart) TopRulesHandler(c echo.Context) error {
+	httpStatus, response, err := services.TopRulesService(c.Request(), g.AccrualSysClient)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(c, httpStatus, response)
+}
+
+func (g *Gophermart) MerchantReverseWithdrawalHandler(c echo.Context) error {
+	httpStatus, response, err := services.MerchantReverseWithdrawalService(c.Request(), g.Storage)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return writeJSON(c, httpStatus, response)
+}
+
+func writeJSON(c echo.Context, httpStatus int, body []byte) error {
+	if httpStatus == http.StatusNoContent {
+		return c.NoContent(httpStatus)
+	}
+	return c.JSONBlob(httpStatus, body)
+}
+
+func (g *Gophermart) AccrualEventHandler(c echo.Context) error {
+	httpStatus, err := services.AccrualEventService(c.Request(), g.Storage, g.WebhookSecret)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(httpStatus)
 }
 
 func (g *Gophermart) Router() *echo.Echo {
 	e := echo.New()
+	e.HTTPErrorHandler = errs.HTTPErrorHandler
 
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "time=${time_rfc3339}, method=${method}, uri=${uri}, status=${status}, error=${error}\n",
 	}))
-	e.POST("/api/user/register", g.RegistHandler)
-	e.POST("/api/user/login", g.AuthHandler)
+	e.Use(LimitBody(MaxBodySize))
+
+	e.GET("/ready", g.ReadyHandler)
+	e.GET("/metrics", g.MetricsHandler)
+
+	if g.WebhookSecret != "" {
+		e.POST("/api/accrual/events", g.AccrualEventHandler, RequireContentType(MIMEApplicationJSON))
+	}
+
+	if g.AdminToken != "" {
+		admin := e.Group("/api/admin", bearer.Require(g.AdminToken))
+		admin.POST("/withdrawals/:id/reverse", g.ReverseWithdrawalHandler)
+		admin.GET("/reports/daily", g.DailyReportHandler)
+		admin.GET("/reports/rules", g.TopRulesHandler)
+	}
+	if g.MerchantToken != "" {
+		merchant := e.Group("/api/merchant", bearer.Require(g.MerchantToken))
+		merchant.POST("/withdrawals/reverse", g.MerchantReverseWithdrawalHandler, RequireContentType(MIMEApplicationJSON))
+	}
+
+	e.POST("/api/user/register", g.RegistHandler, RequireContentType(MIMEApplicationJSON))
+	e.POST("/api/user/login", g.AuthHandler, RequireContentType(MIMEApplicationJSON))
 
 	logged := e.Group("/api/user", echojwt.WithConfig(echojwt.Config{SigningKey: []byte(g.secret)}))
 
-	logged.POST("/orders", g.PostOrderHandler)
+	logged.POST("/orders", g.PostOrderHandler, RequireContentType(MIMETextPlain))
+	logged.POST("/orders/batch", g.PostOrdersBatchHandler, RequireContentType(MIMEApplicationJSON, MIMETextPlain))
 	logged.GET("/orders", g.GetOrdersHandler)
-	logged.POST("/balance/withdraw", g.PostWithdrawalHandler)
+	logged.GET("/orders/events", g.OrderEventsHandler)
+	logged.POST("/balance/withdraw", g.PostWithdrawalHandler, RequireContentType(MIMEApplicationJSON))
 	logged.GET("/balance", g.GetBalanceHandler)
+	logged.GET("/balance/expirations", g.GetPointExpirationsHandler)
+	logged.POST("/balance/transfer", g.TransferHandler, RequireContentType(MIMEApplicationJSON))
+	logged.GET("/transactions", g.GetTransactionsHandler)
+	logged.GET("/statement", g.StatementHandler)
 	logged.GET("/withdrawals", g.GetWithdrawalsHandler)
 	return e
 }
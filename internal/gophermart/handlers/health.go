@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/labstack/echo/v4"
+)
+
+func (g *Gophermart) ReadyHandler(c echo.Context) error {
+	if breaker := g.AccrualSysClient.Breaker(); breaker != nil {
+		if breaker.State() == accrualclient.StateOpen {
+			return errs.New(errs.Unavailable, "accrual system circuit breaker is open")
+		}
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+func (g *Gophermart) MetricsHandler(c echo.Context) error {
+	var b strings.Builder
+	if breaker := g.AccrualSysClient.Breaker(); breaker != nil {
+		stats := breaker.Stats()
+		fmt.Fprintln(&b, "# HELP accrual_circuit_state Accrual circuit breaker state (0 closed, 1 open, 2 half-open).")
+		fmt.Fprintln(&b, "# TYPE accrual_circuit_state gauge")
+		fmt.Fprintf(&b, "accrual_circuit_state %d\n", stats.State)
+		fmt.Fprintln(&b, "# TYPE accrual_circuit_consecutive_failures gauge")
+		fmt.Fprintf(&b, "accrual_circuit_consecutive_failures %d\n", stats.ConsecutiveFailures)
+		fmt.Fprintln(&b, "# TYPE accrual_requests_total counter")
+		fmt.Fprintf(&b, "accrual_requests_total{result=\"success\"} %d\n", stats.Successes)
+		fmt.Fprintf(&b, "accrual_requests_total{result=\"failure\"} %d\n", stats.Failures)
+		fmt.Fprintf(&b, "accrual_requests_total{result=\"rejected\"} %d\n", stats.Rejected)
+		fmt.Fprintln(&b, "# TYPE accrual_circuit_opened_total counter")
+		fmt.Fprintf(&b, "accrual_circuit_opened_total %d\n", stats.Opened)
+	}
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
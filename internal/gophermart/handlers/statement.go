@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/services"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MIMETextCSV        = "text/csv"
+	statementFlushRows = 100
+)
+
+var statementCSVHeader = []string{"created_at", "type", "order", "status", "counterparty", "amount", "balance"}
+
+// StatementHandler streams the user's statement as it is read from storage.
+// Headers are sent with the first entry, so a storage error before that is
+// still reported with a proper status; after that the response is cut short
+// and the error is only logged.
+func (g *Gophermart) StatementHandler(c echo.Context) error {
+	q, err := services.ParseStatementQuery(c.Request())
+	if err != nil {
+		return err
+	}
+	userID := g.Auth.GetUserID(c.Request())
+
+	var sw statementWriter
+	if q.Format == services.StatementCSV {
+		sw = newCSVStatement(c.Response())
+	} else {
+		sw = &jsonStatement{w: c.Response()}
+	}
+	err = g.Storage.StreamStatement(userID, q.From, q.To, sw.Write)
+	if err == nil {
+		err = sw.Close()
+	}
+	if err != nil {
+		if !c.Response().Committed {
+			return errs.Wrap(errs.Internal, "error while building statement", err)
+		}
+		log.Println("StatementHandler:", err)
+	}
+	return nil
+}
+
+type statementWriter interface {
+	Write(e types.StatementEntry) error
+	Close() error
+}
+
+type csvStatement struct {
+	w    *echo.Response
+	csv  *csv.Writer
+	rows int
+}
+
+func newCSVStatement(w *echo.Response) *csvStatement {
+	return &csvStatement{w: w, csv: csv.NewWriter(w)}
+}
+
+func (s *csvStatement) start() error {
+	if s.w.Committed {
+		return nil
+	}
+	s.w.Header().Set(echo.HeaderContentType, MIMETextCSV)
+	s.w.Header().Set(echo.HeaderContentDisposition, `attachment; filename="statement.csv"`)
+	s.w.WriteHeader(http.StatusOK)
+	return s.csv.Write(statementCSVHeader)
+}
+
+func (s *csvStatement) Write(e types.StatementEntry) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	err := s.csv.Write([]string{
+		e.CreatedAt.Format(time.RFC3339),
+		string(e.Type),
+		e.Order,
+		e.Status,
+		e.Counterparty,
+		strconv.FormatFloat(e.Amount, 'f', -1, 64),
+		strconv.FormatFloat(e.Balance, 'f', -1, 64),
+	})
+	if err != nil {
+		return err
+	}
+	if s.rows++; s.rows%statementFlushRows == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *csvStatement) Close() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *csvStatement) flush() error {
+	s.csv.Flush()
+	if err := s.csv.Error(); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+type jsonStatement struct {
+	w    *echo.Response
+	rows int
+}
+
+func (s *jsonStatement) start() error {
+	if s.w.Committed {
+		return nil
+	}
+	s.w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	s.w.WriteHeader(http.StatusOK)
+	_, err := s.w.Write([]byte("["))
+	return err
+}
+
+func (s *jsonStatement) Write(e types.StatementEntry) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if s.rows > 0 {
+		data = append([]byte(","), data...)
+	}
+	if _, err = s.w.Write(data); err != nil {
+		return err
+	}
+	if s.rows++; s.rows%statementFlushRows == 0 {
+		s.w.Flush()
+	}
+	return nil
+}
+
+func (s *jsonStatement) Close() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	_, err := s.w.Write([]byte("]"))
+	return err
+}
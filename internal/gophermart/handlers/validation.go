@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MIMETextPlain       = "text/plain"
+	MIMEApplicationJSON = "application/json"
+	MaxBodySize         = 1 << 20
+)
+
+func RequireContentType(contentTypes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+			if err != nil {
+				return errs.New(errs.Invalid, fmt.Sprintf("invalid Content-Type, expected %s", strings.Join(contentTypes, " or ")))
+			}
+			for _, ct := range contentTypes {
+				if mediaType == ct {
+					return next(c)
+				}
+			}
+			return errs.New(errs.Invalid, fmt.Sprintf("unsupported Content-Type %q, expected %s", mediaType, strings.Join(contentTypes, " or ")))
+		}
+	}
+}
+
+func LimitBody(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if r.ContentLength > limit {
+				return errs.New(errs.TooLarge, fmt.Sprintf("request body is larger than %d bytes", limit))
+			}
+			r.Body = http.MaxBytesReader(c.Response(), r.Body, limit)
+			return next(c)
+		}
+	}
+}
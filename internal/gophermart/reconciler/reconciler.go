@@ -0,0 +1,150 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+const (
+	DefaultInterval  = defaults.ReconcileInterval
+	DefaultBatchSize = 100
+	DefaultLease     = 2 * time.Minute
+	maxRetryDelay    = 5 * time.Minute
+
+	DefaultCancellationCheckInterval = defaults.CancellationCheckInterval
+)
+
+// Reconciler claims pending orders under a lease before polling them, so
+// several replicas can run it against one database without polling the
+// same order twice; orders of a crashed replica are picked up once the
+// lease expires.
+type Reconciler struct {
+	id        string
+	lease     time.Duration
+	orders    types.PendingOrders
+	client    *accrualclient.Client
+	scheduler Scheduler
+	batchSize int
+	// cancelCheck is how often processed orders are polled for a
+	// cancellation.
+	cancelCheck time.Duration
+}
+
+func New(orders types.PendingOrders, client *accrualclient.Client, scheduler Scheduler) *Reconciler {
+	return &Reconciler{
+		id:          workerID(),
+		lease:       DefaultLease,
+		orders:      orders,
+		client:      client,
+		scheduler:   scheduler,
+		batchSize:   DefaultBatchSize,
+		cancelCheck: DefaultCancellationCheckInterval,
+	}
+}
+
+// SetCancellationCheckInterval sets how often processed orders are polled
+// until their cancellation window ends.
+func (r *Reconciler) SetCancellationCheckInterval(interval time.Duration) {
+	r.cancelCheck = interval
+}
+
+func (r *Reconciler) Run(ctx context.Context) {
+	wait := r.scheduler.Next(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		processed, pause := r.RunOnce(ctx)
+		wait = r.scheduler.Next(processed)
+		if pause > wait {
+			log.Printf("reconciler: accrual system asked to retry after %s", pause)
+			wait = pause
+		}
+	}
+}
+
+// RunOnce polls the accrual system for one batch of pending orders. It
+// returns the number of orders handled and, when the accrual system is
+// rate limiting, how long to pause before the next pass.
+func (r *Reconciler) RunOnce(ctx context.Context) (int, time.Duration) {
+	orders, err := r.orders.ClaimPendingOrders(r.id, r.batchSize, r.lease)
+	if err != nil {
+		log.Println("reconciler:", err)
+		return 0, 0
+	}
+
+	for i, order := range orders {
+		info, err := r.client.GetOrder(ctx, order.Number)
+		var rateLimitErr *accrualclient.RateLimitError
+		switch {
+		case errors.Is(err, accrualclient.ErrCircuitOpen):
+			r.release(orders[i:], 0)
+			return i, 0
+		case errors.As(err, &rateLimitErr):
+			r.release(orders[i:], rateLimitErr.RetryAfter)
+			return i, rateLimitErr.RetryAfter
+		case errors.Is(err, accrualclient.ErrNotRegistered):
+			log.Printf("reconciler: order %s is not registered in accrual system yet", order.Number)
+		case err != nil:
+			log.Println("reconciler:", err)
+		default:
+			if err = r.orders.UpgradeOrderStatus(info); err != nil {
+				log.Println("reconciler:", err)
+			}
+			order.Processed = info.Status == accrualclient.StatusProcessed
+		}
+		r.reschedule(order, 0)
+	}
+
+	return len(orders), 0
+}
+
+func (r *Reconciler) reschedule(order types.PendingOrder, delay time.Duration) {
+	switch {
+	case order.Processed && delay < r.cancelCheck:
+		delay = r.cancelCheck
+	case delay == 0:
+		delay = RetryDelay(order.Attempts)
+	}
+	if err := r.orders.RescheduleOrder(order.Number, delay); err != nil {
+		log.Println("reconciler:", err)
+	}
+}
+
+// release hands back orders claimed but not polled in this pass. Their attempt
+// counter is bumped as a side effect, which only lengthens the next back-off.
+func (r *Reconciler) release(orders []types.PendingOrder, delay time.Duration) {
+	for _, order := range orders {
+		r.reschedule(order, delay)
+	}
+}
+
+func workerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gophermart"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+func RetryDelay(attempts int) time.Duration {
+	delay := DefaultInterval
+	for i := 0; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
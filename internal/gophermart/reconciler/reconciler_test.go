@@ -0,0 +1,197 @@
+package reconciler_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/reconciler"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient/accrualtest"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+func setup(t *testing.T, numbers ...string) (*storage.Memory, *accrualtest.Server, *reconciler.Reconciler) {
+	t.Helper()
+	server := accrualtest.NewServer()
+	t.Cleanup(server.Close)
+	client, err := accrualclient.New(server.URL, accrualclient.WithRetries(0, 0))
+	if err != nil {
+		t.Fatalf("accrualclient.New: %v", err)
+	}
+	store := storage.NewMemory(context.Background())
+	alice, err := store.RegisterNewUser("alice", "hash")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	for _, number := range numbers {
+		if err = store.SaveOrder(&types.Order{UserID: alice.ID, Number: number, Status: "NEW"}); err != nil {
+			t.Fatalf("SaveOrder: %v", err)
+		}
+	}
+	return store, server, reconciler.New(store, client, reconciler.FixedInterval(time.Millisecond))
+}
+
+func orderStatus(t *testing.T, store *storage.Memory, number string) types.Order {
+	t.Helper()
+	alice, err := store.GetUserData("alice")
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	orders, _, err := store.GetOrdersByUser(alice.ID)
+	if err != nil {
+		t.Fatalf("GetOrdersByUser: %v", err)
+	}
+	for _, order := range orders {
+		if order.Number == number {
+			return order
+		}
+	}
+	t.Fatalf("order %s not found", number)
+	return types.Order{}
+}
+
+func TestRunOnce(t *testing.T) {
+	store, server, r := setup(t, "12345678903", "9278923470", "346436439")
+	server.SetOrder(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 500})
+	server.SetOrder(accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusInvalid})
+
+	processed, pause := r.RunOnce(context.Background())
+	if processed != 3 || pause != 0 {
+		t.Fatalf("RunOnce = %d, %s; want 3, 0", processed, pause)
+	}
+	if order := orderStatus(t, store, "12345678903"); order.Status != "PROCESSED" || order.Accrual != 500 {
+		t.Fatalf("processed order = %+v", order)
+	}
+	if order := orderStatus(t, store, "9278923470"); order.Status != "INVALID" {
+		t.Fatalf("invalid order = %+v", order)
+	}
+
+	pending, err := store.ClaimPendingOrders("test", 10, 0)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("ClaimPendingOrders = %+v, %v; unregistered order must be rescheduled", pending, err)
+	}
+}
+
+func TestRunOnceCancellation(t *testing.T) {
+	store, server, r := setup(t, "12345678903")
+	store.SetCancellationWindow(time.Hour)
+	r.SetCancellationCheckInterval(time.Hour)
+	server.SetOrder(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 500})
+
+	if processed, _ := r.RunOnce(context.Background()); processed != 1 {
+		t.Fatalf("RunOnce = %d, want 1", processed)
+	}
+	if pending, err := store.ClaimPendingOrders("test", 10, 0); err != nil || len(pending) != 0 {
+		t.Fatalf("ClaimPendingOrders = %+v, %v; processed order must wait for the cancellation check interval", pending, err)
+	}
+
+	server.SetOrder(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusCancelled})
+	if err := store.RescheduleOrder("12345678903", 0); err != nil {
+		t.Fatalf("RescheduleOrder: %v", err)
+	}
+	r.RunOnce(context.Background())
+	if order := orderStatus(t, store, "12345678903"); order.Status != "CANCELLED" {
+		t.Fatalf("cancelled order = %+v", order)
+	}
+	if pending, err := store.ClaimPendingOrders("test", 10, 0); err != nil || len(pending) != 0 {
+		t.Fatalf("ClaimPendingOrders = %+v, %v; cancelled order must leave the queue", pending, err)
+	}
+}
+
+func TestRunOnceRateLimited(t *testing.T) {
+	store, server, r := setup(t, "12345678903", "9278923470")
+	server.RateLimit(30 * time.Second)
+
+	processed, pause := r.RunOnce(context.Background())
+	if processed != 0 || pause != 30*time.Second {
+		t.Fatalf("RunOnce = %d, %s; want 0, 30s", processed, pause)
+	}
+	if server.Requests() != 1 {
+		t.Fatalf("requests = %d, rate limited pass must stop after the first order", server.Requests())
+	}
+	if pending, err := store.ClaimPendingOrders("test", 10, 0); err != nil || len(pending) != 0 {
+		t.Fatalf("ClaimPendingOrders = %+v, %v; orders must wait for Retry-After", pending, err)
+	}
+}
+
+func TestReplicasDoNotPollTwice(t *testing.T) {
+	numbers := []string{"12345678903", "9278923470", "346436439", "2377225624"}
+	store, server, _ := setup(t, numbers...)
+	for _, number := range numbers {
+		server.SetOrder(accrualclient.Order{Number: number, Status: accrualclient.StatusProcessing})
+	}
+	client, err := accrualclient.New(server.URL, accrualclient.WithRetries(0, 0))
+	if err != nil {
+		t.Fatalf("accrualclient.New: %v", err)
+	}
+
+	done := make(chan int)
+	for i := 0; i < 4; i++ {
+		go func() {
+			processed, _ := reconciler.New(store, client, reconciler.FixedInterval(time.Millisecond)).RunOnce(context.Background())
+			done <- processed
+		}()
+	}
+	total := 0
+	for i := 0; i < 4; i++ {
+		total += <-done
+	}
+	if total != len(numbers) || server.Requests() != len(numbers) {
+		t.Fatalf("processed %d orders with %d requests, want %d each", total, server.Requests(), len(numbers))
+	}
+}
+
+func TestRun(t *testing.T) {
+	store, server, r := setup(t, "12345678903")
+	server.SetOrder(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 42})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for orderStatus(t, store, "12345678903").Status != "PROCESSED" {
+		if time.Now().After(deadline) {
+			t.Fatal("order was not reconciled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestAdaptive(t *testing.T) {
+	a := reconciler.NewAdaptive(time.Second, 8*time.Second, 10)
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		if got := a.Next(0); got != want {
+			t.Fatalf("idle pass %d: Next = %s, want %s", i, got, want)
+		}
+	}
+	if got := a.Next(10); got != time.Second {
+		t.Fatalf("full batch: Next = %s, want 1s", got)
+	}
+	if got := a.Next(5); got != 4500*time.Millisecond {
+		t.Fatalf("half batch: Next = %s, want 4.5s", got)
+	}
+	if got := a.Next(0); got != time.Second {
+		t.Fatalf("idle after activity: Next = %s, want 1s", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if got := reconciler.RetryDelay(0); got != reconciler.DefaultInterval {
+		t.Fatalf("RetryDelay(0) = %s", got)
+	}
+	if got := reconciler.RetryDelay(2); got != 4*reconciler.DefaultInterval {
+		t.Fatalf("RetryDelay(2) = %s", got)
+	}
+	if got := reconciler.RetryDelay(100); got != 5*time.Minute {
+		t.Fatalf("RetryDelay(100) = %s", got)
+	}
+}
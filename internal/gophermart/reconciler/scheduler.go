@@ -0,0 +1,51 @@
+package reconciler
+
+import "time"
+
+// Scheduler decides how long the reconciler waits before the next pass,
+// given the number of orders handled by the previous one.
+type Scheduler interface {
+	Next(processed int) time.Duration
+}
+
+type FixedInterval time.Duration
+
+func (f FixedInterval) Next(int) time.Duration {
+	return time.Duration(f)
+}
+
+// Adaptive polls at Min while the queue yields full batches and backs off
+// towards Max while it stays empty.
+type Adaptive struct {
+	Min       time.Duration
+	Max       time.Duration
+	BatchSize int
+
+	idle time.Duration
+}
+
+func NewAdaptive(min, max time.Duration, batchSize int) *Adaptive {
+	return &Adaptive{Min: min, Max: max, BatchSize: batchSize}
+}
+
+func (a *Adaptive) Next(processed int) time.Duration {
+	switch {
+	case processed >= a.BatchSize:
+		a.idle = 0
+		return a.Min
+	case processed > 0:
+		a.idle = 0
+		fill := float64(processed) / float64(a.BatchSize)
+		return a.Max - time.Duration(fill*float64(a.Max-a.Min))
+	}
+
+	if a.idle == 0 {
+		a.idle = a.Min
+	} else if a.idle < a.Max {
+		a.idle *= 2
+	}
+	if a.idle > a.Max {
+		a.idle = a.Max
+	}
+	return a.idle
+}
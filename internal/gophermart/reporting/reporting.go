@@ -0,0 +1,48 @@
+package reporting
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+const DefaultInterval = defaults.ReportRefreshInterval
+
+// Job refreshes the precomputed aggregates behind the admin reports.
+type Job struct {
+	store    types.Reporter
+	interval time.Duration
+}
+
+func New(store types.Reporter, interval time.Duration) *Job {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Job{
+		store:    store,
+		interval: interval,
+	}
+}
+
+func (j *Job) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.RunOnce(); err != nil {
+			log.Println("reporting:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *Job) RunOnce() error {
+	return j.store.RefreshReports()
+}
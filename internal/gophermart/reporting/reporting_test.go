@@ -0,0 +1,60 @@
+package reporting_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/reporting"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+type fakeReporter struct {
+	refreshes int32
+	err       error
+}
+
+func (f *fakeReporter) GetDailyReport(from, to time.Time) ([]types.DailyReport, error) {
+	return nil, nil
+}
+
+func (f *fakeReporter) RefreshReports() error {
+	atomic.AddInt32(&f.refreshes, 1)
+	return f.err
+}
+
+func TestRunOnce(t *testing.T) {
+	store := &fakeReporter{err: errors.New("refresh failed")}
+	if err := reporting.New(store, time.Hour).RunOnce(); !errors.Is(err, store.err) {
+		t.Fatalf("RunOnce: err=%v, want %v", err, store.err)
+	}
+	if n := atomic.LoadInt32(&store.refreshes); n != 1 {
+		t.Fatalf("RunOnce refreshed %d times", n)
+	}
+}
+
+func TestRun(t *testing.T) {
+	store := &fakeReporter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reporting.New(store, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&store.refreshes) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Run refreshed %d times within a second", atomic.LoadInt32(&store.refreshes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not stop after cancel")
+	}
+}
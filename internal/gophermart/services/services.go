@@ -4,203 +4,548 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
-	"path"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/luhnchecker"
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/orderstate"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/ordernum"
+	"github.com/AbramovArseniy/Gofermart/internal/webhook"
+)
+
+const (
+	maxBatchOrders = 1000
+
+	DefaultExpiringSoonWindow = defaults.ExpiringSoonWindow
+
+	ActorAdmin        = "admin"
+	ActorMerchant     = "merchant"
+	maxReversalReason = 255
+
+	DefaultTransferMinAmount  = defaults.TransferMinAmount
+	DefaultTransferDailyLimit = defaults.TransferDailyLimit
+
+	StatementJSON = "json"
+	StatementCSV  = "csv"
+
+	statementDateLayout = "2006-01-02"
+
+	DefaultReportDays = 30
+	maxReportDays     = 366
+
+	DefaultTopRules = 10
+	maxTopRules     = 100
 )
 
 func RegistService(r *http.Request, auth types.Authorization) (int, string, error) {
-	var (
-		userData types.UserData
-		token    string
-	)
-	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-		return http.StatusBadRequest, token, fmt.Errorf("failed decode %w", err)
+	var userData types.UserData
+	if err := decodeJSON(r, &userData); err != nil {
+		return 0, "", err
 	}
 	if err := auth.CheckData(userData); err != nil {
-		return http.StatusBadRequest, token, fmt.Errorf("no data provided: %w", err)
+		return 0, "", err
 	}
 	user, err := auth.RegisterUser(userData)
-	if err != nil && !errors.Is(err, types.ErrInvalidData) {
-		return http.StatusLoopDetected, token, fmt.Errorf("RegistHandler: %w", err)
-	}
-	if errors.Is(err, types.ErrInvalidData) {
-		return http.StatusUnauthorized, token, fmt.Errorf("RegistHandler: %w", err)
+	if err != nil {
+		return 0, "", err
 	}
-	token, err = auth.GenerateToken(user)
+	token, err := auth.GenerateToken(user)
 	if err != nil {
-		return http.StatusInternalServerError, token, fmt.Errorf("RegistHandler: can't generate token %w", err)
+		return 0, "", errs.Wrap(errs.Internal, "RegistService: can't generate token", err)
 	}
 
 	return http.StatusOK, token, nil
 }
 
 func AuthService(r *http.Request, storage types.Storage, auth types.Authorization) (int, string, error) {
-	var (
-		userData types.UserData
-		token    string
-	)
-	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-		return http.StatusBadRequest, token, err
+	var userData types.UserData
+	if err := decodeJSON(r, &userData); err != nil {
+		return 0, "", err
 	}
 	if err := auth.CheckData(userData); err != nil {
-		return http.StatusBadRequest, token, err
+		return 0, "", err
 	}
 	user, err := auth.LoginUser(userData)
-	if err != nil && !errors.Is(err, types.ErrInvalidData) {
-		return http.StatusInternalServerError, token, err
-	}
-	if errors.Is(err, types.ErrInvalidData) {
-		return http.StatusUnauthorized, token, err
+	if err != nil {
+		return 0, "", err
 	}
-	token, err = auth.GenerateToken(user)
+	token, err := auth.GenerateToken(user)
 	if err != nil {
-		return http.StatusInternalServerError, token, err
+		return 0, "", errs.Wrap(errs.Internal, "AuthService: can't generate token", err)
 	}
 
-	return http.StatusOK, token, err
+	return http.StatusOK, token, nil
 }
 
-func PostOrderService(r *http.Request, storage types.Storage, auth types.Authorization, accrualSysClient types.Client) (int, error) {
-	body, err := io.ReadAll(r.Body)
+func PostOrderService(r *http.Request, storage types.Storage, auth types.Authorization) (int, error) {
+	orderNum, err := readOrderNumber(r)
 	if err != nil {
-		err := fmt.Errorf("cannot read request body %w", err)
-		return http.StatusInternalServerError, err
+		return 0, err
 	}
-	user := auth.GetUserLogin(r)
-	orderNum := string(body)
-	numIsRight := luhnchecker.OrderNumIsRight(orderNum)
+	userID := auth.GetUserID(r)
 
-	_, exists, err := storage.GetOrderUserByNum(orderNum)
+	// SaveOrders inserts unless the number exists and reports its owner in the
+	// same transaction, so concurrent uploads of a number cannot both insert.
+	results, err := storage.SaveOrders(userID, []string{orderNum})
 	if err != nil {
-		err := fmt.Errorf("cannot get user id by order number %w", err)
-		return http.StatusInternalServerError, err
+		return 0, errs.Wrap(errs.Internal, "cannot save order", err)
+	}
+	switch results[orderNum] {
+	case types.OrderAccepted:
+		return http.StatusAccepted, nil
+	case types.OrderAlreadyUploaded:
+		return http.StatusOK, nil
+	default:
+		return 0, errs.ErrOrderOwnedByOther
 	}
+}
 
-	if !numIsRight {
-		err := fmt.Errorf("luhnchecker %t", numIsRight)
-		return http.StatusUnprocessableEntity, err
+func PostOrdersBatchService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
+	numbers, err := parseOrderNumbers(r)
+	if err != nil {
+		return 0, nil, err
 	}
-	order := types.Order{
-		User:   user,
-		Number: orderNum,
-		Status: "NEW",
+	if len(numbers) == 0 {
+		return 0, nil, errs.New(errs.Invalid, "no order numbers provided")
 	}
-	if !exists {
-		err = storage.SaveOrder(&order)
-		if err != nil {
-			err := fmt.Errorf("cannot save order %w", err)
-			return http.StatusInternalServerError, err
-		}
-		url := accrualSysClient.URL
-		url.Path = path.Join(accrualSysClient.URL.Path, orderNum)
-		resp, err := accrualSysClient.Client.Get(url.String())
-		if err != nil {
-			log.Println("can't get response from accrual system:", err)
-			return http.StatusInternalServerError, err
+	if len(numbers) > maxBatchOrders {
+		return 0, nil, errs.New(errs.Invalid, "too many order numbers in one batch")
+	}
+
+	valid := make([]string, 0, len(numbers))
+	for _, number := range numbers {
+		if ordernum.Valid(number) {
+			valid = append(valid, number)
 		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("can't read body of reponsefrom accrual sysem:", err)
-			return http.StatusInternalServerError, err
+	}
+
+	saved, err := storage.SaveOrders(auth.GetUserID(r), valid)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "PostOrdersBatchService: cannot save orders", err)
+	}
+
+	httpStatus := http.StatusOK
+	results := make([]types.BatchOrderResult, 0, len(numbers))
+	for _, number := range numbers {
+		result, ok := saved[number]
+		if !ok {
+			result = types.OrderInvalid
 		}
-		if resp.StatusCode > 299 {
-			log.Println("accrual system returned statuscode:", resp.StatusCode)
-			return http.StatusInternalServerError, fmt.Errorf("accrual system returned statuscode: %d", resp.StatusCode)
+		if result == types.OrderAccepted {
+			httpStatus = http.StatusAccepted
 		}
-		storage.UpgradeOrderStatus(body, orderNum)
+		results = append(results, types.BatchOrderResult{Number: number, Result: result})
+	}
 
-		return http.StatusAccepted, err
+	body, err := json.Marshal(results)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "PostOrdersBatchService: error while marshaling response json", err)
 	}
-	orderUser, err := storage.GetOrderUser(orderNum)
+
+	return httpStatus, body, nil
+}
+
+func parseOrderNumbers(r *http.Request) ([]string, error) {
+	body, err := readBody(r)
 	if err != nil {
-		err := fmt.Errorf("cannot get orderUser id by order number %w", err)
-		return http.StatusInternalServerError, err
+		return nil, err
 	}
-	if user == orderUser {
-		return http.StatusOK, nil
+
+	var numbers []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err = json.Unmarshal(body, &numbers); err != nil {
+			return nil, errs.Wrap(errs.Invalid, "cannot decode order numbers", err)
+		}
+	} else {
+		numbers = strings.Split(string(body), "\n")
 	}
-	return http.StatusConflict, fmt.Errorf("order already uploaded by another user")
+
+	result := make([]string, 0, len(numbers))
+	seen := make(map[string]bool, len(numbers))
+	for _, number := range numbers {
+		number = strings.TrimSpace(number)
+		if number != "" && !seen[number] {
+			seen[number] = true
+			result = append(result, number)
+		}
+	}
+	return result, nil
 }
 
 func GetOrderService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
-	userid := auth.GetUserLogin(r)
-	orders, exist, err := storage.GetOrdersByUser(userid)
+	userID := auth.GetUserID(r)
+	orders, exist, err := storage.GetOrdersByUser(userID)
 	if err != nil {
-		return http.StatusInternalServerError, nil, fmt.Errorf("GetOrdersHandler: error while getting orders by user: %w", err)
+		return 0, nil, errs.Wrap(errs.Internal, "GetOrdersHandler: error while getting orders by user", err)
 	}
 	if !exist {
-		err = fmt.Errorf("order exists? %t", exist)
-		return http.StatusNoContent, nil, err
+		return http.StatusNoContent, nil, nil
 	}
 	var body []byte
 	if body, err = json.Marshal(&orders); err != nil {
-		return http.StatusInternalServerError, nil, err
+		return 0, nil, errs.Wrap(errs.Internal, "GetOrdersHandler: error while marshaling response json", err)
 	}
 	return http.StatusOK, body, nil
 }
 
 func PostWithdrawalService(r *http.Request, storage types.Storage, auth types.Authorization) (int, error) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("error while reading request body: %w", err)
-	}
 	var w types.Withdrawal
-	err = json.Unmarshal(body, &w)
-	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("error while reading request body: %w", err)
+	if err := decodeJSON(r, &w); err != nil {
+		return 0, err
 	}
-	if !luhnchecker.OrderNumIsRight(w.OrderNum) {
-		return http.StatusUnprocessableEntity, fmt.Errorf("wrong order number ")
+	if w.Accrual <= 0 {
+		return 0, errs.Validation("invalid withdrawal", []errs.FieldError{{Field: "sum", Message: "must be positive"}})
 	}
-	balance, _, err := storage.GetBalance(auth.GetUserLogin(r))
-	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("error while counting balance: %w", err)
+	w.OrderNum = strings.TrimSpace(w.OrderNum)
+	if !ordernum.Valid(w.OrderNum) {
+		return 0, errs.ErrInvalidOrderNumber
 	}
-
-	if balance < w.Accrual {
-		return http.StatusPaymentRequired, fmt.Errorf("not enough accrual on balance")
+	err := storage.SaveWithdrawal(w, auth.GetUserID(r))
+	if errors.Is(err, errs.ErrInsufficientFunds) {
+		return 0, errs.ErrInsufficientFunds
+	}
+	if errors.Is(err, errs.ErrWithdrawalConflict) {
+		return 0, errs.ErrWithdrawalConflict
+	}
+	if err != nil {
+		return 0, errs.Wrap(errs.Internal, "error while saving withdrawal", err)
 	}
-	storage.SaveWithdrawal(w, auth.GetUserLogin(r))
 
 	return http.StatusOK, nil
 }
 
-func GetBalanceService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
+func GetBalanceService(r *http.Request, storage types.Storage, auth types.Authorization, expiringSoon time.Duration) (int, []byte, error) {
 	var (
-		b        types.Balance
-		response []byte
-		err      error
+		b   types.Balance
+		err error
 	)
-	b.Balance, b.Withdrawn, err = storage.GetBalance(auth.GetUserLogin(r))
+	userID := auth.GetUserID(r)
+	b.Balance, b.Withdrawn, err = storage.GetBalance(userID)
 	if err != nil {
-		return http.StatusInternalServerError, response, fmt.Errorf("GetBalanceService: error while counting balance: %w", err)
+		return 0, nil, errs.Wrap(errs.Internal, "GetBalanceService: error while counting balance", err)
 	}
-	response, err = json.Marshal(b)
+	b.ExpiringSoon, err = storage.GetExpiringPoints(userID, time.Now().Add(expiringSoon))
 	if err != nil {
-		return http.StatusInternalServerError, response, fmt.Errorf("GetBalanceService: error while marshaling response json: %w", err)
+		return 0, nil, errs.Wrap(errs.Internal, "GetBalanceService: error while counting expiring points", err)
+	}
+	response, err := json.Marshal(b)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "GetBalanceService: error while marshaling response json", err)
 	}
 
 	return http.StatusOK, response, nil
 }
 
 func GetWithdrawalsService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
-	var response []byte
-	w, exist, err := storage.GetWithdrawalsByUser(auth.GetUserLogin(r))
+	w, exist, err := storage.GetWithdrawalsByUser(auth.GetUserID(r))
 	if err != nil {
-		return http.StatusInternalServerError, response, fmt.Errorf("error while getting user's withdrawals: %w", err)
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting user's withdrawals", err)
 	}
 	if !exist {
-		return http.StatusNoContent, response, fmt.Errorf("is withdrawal exist? %t", exist)
+		return http.StatusNoContent, nil, nil
+	}
+	response, err := json.Marshal(w)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+func ReverseWithdrawalService(r *http.Request, id string, storage types.Storage) (int, []byte, error) {
+	withdrawalID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, nil, errs.New(errs.Invalid, "withdrawal id must be a number")
+	}
+	var reversal types.WithdrawalReversal
+	if r.ContentLength != 0 {
+		if err = decodeJSON(r, &reversal); err != nil {
+			return 0, nil, err
+		}
 	}
-	response, err = json.Marshal(w)
+	return reverseWithdrawal(storage, withdrawalID, reversal.Reason, ActorAdmin)
+}
+
+func MerchantReverseWithdrawalService(r *http.Request, storage types.Storage) (int, []byte, error) {
+	var reversal types.WithdrawalReversal
+	if err := decodeJSON(r, &reversal); err != nil {
+		return 0, nil, err
+	}
+	reversal.Order = strings.TrimSpace(reversal.Order)
+	if !ordernum.Valid(reversal.Order) {
+		return 0, nil, errs.ErrInvalidOrderNumber
+	}
+	w, exists, err := storage.GetWithdrawalByOrder(reversal.Order)
 	if err != nil {
-		return http.StatusInternalServerError, response, fmt.Errorf("error while marshaling response json: %w", err)
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting withdrawal by order", err)
+	}
+	if !exists {
+		return 0, nil, errs.ErrWithdrawalNotFound
+	}
+	return reverseWithdrawal(storage, w.ID, reversal.Reason, ActorMerchant)
+}
+
+func reverseWithdrawal(storage types.Storage, id int64, reason, actor string) (int, []byte, error) {
+	if len(reason) > maxReversalReason {
+		return 0, nil, errs.Validation("invalid reversal", []errs.FieldError{{Field: "reason", Message: fmt.Sprintf("must be at most %d characters", maxReversalReason)}})
+	}
+	w, err := storage.ReverseWithdrawal(id, reason, actor)
+	if errors.Is(err, errs.ErrWithdrawalNotFound) {
+		return 0, nil, errs.ErrWithdrawalNotFound
+	}
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while reversing withdrawal", err)
+	}
+	response, err := json.Marshal(w)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
 	}
 	return http.StatusOK, response, nil
 }
+
+func GetPointExpirationsService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
+	expirations, err := storage.GetPointExpirations(auth.GetUserID(r))
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting user's expired points", err)
+	}
+	if len(expirations) == 0 {
+		return http.StatusNoContent, nil, nil
+	}
+	response, err := json.Marshal(expirations)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+func TransferService(r *http.Request, storage types.Storage, auth types.Authorization, minAmount, dailyLimit float64) (int, []byte, error) {
+	var t types.Transfer
+	if err := decodeJSON(r, &t); err != nil {
+		return 0, nil, err
+	}
+	t.FromID, t.From = auth.GetUserID(r), auth.GetUserLogin(r)
+	t.To = strings.TrimSpace(t.To)
+	var fields []errs.FieldError
+	if t.To == "" {
+		fields = append(fields, errs.FieldError{Field: "to", Message: "is required"})
+	} else if t.To == t.From {
+		fields = append(fields, errs.FieldError{Field: "to", Message: "must differ from sender"})
+	}
+	if t.Amount <= 0 {
+		fields = append(fields, errs.FieldError{Field: "sum", Message: "must be positive"})
+	} else if t.Amount < minAmount {
+		fields = append(fields, errs.FieldError{Field: "sum", Message: fmt.Sprintf("must be at least %v", minAmount)})
+	}
+	if len(fields) > 0 {
+		return 0, nil, errs.Validation("invalid transfer", fields)
+	}
+	recipient, err := storage.GetUserData(t.To)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting recipient", err)
+	}
+	if recipient.ID == 0 {
+		return 0, nil, errs.ErrRecipientNotFound
+	}
+	t.ToID = recipient.ID
+	t, err = storage.Transfer(t, dailyLimit)
+	switch {
+	case errors.Is(err, errs.ErrInsufficientFunds):
+		return 0, nil, errs.ErrInsufficientFunds
+	case errors.Is(err, errs.ErrRecipientNotFound):
+		return 0, nil, errs.ErrRecipientNotFound
+	case errors.Is(err, errs.ErrTransferLimit):
+		return 0, nil, errs.ErrTransferLimit
+	case err != nil:
+		return 0, nil, errs.Wrap(errs.Internal, "error while transferring points", err)
+	}
+	response, err := json.Marshal(t)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+func GetTransactionsService(r *http.Request, storage types.Storage, auth types.Authorization) (int, []byte, error) {
+	transactions, err := storage.GetTransactions(auth.GetUserID(r))
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting user's transactions", err)
+	}
+	if len(transactions) == 0 {
+		return http.StatusNoContent, nil, nil
+	}
+	response, err := json.Marshal(transactions)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+type StatementQuery struct {
+	Format string
+	From   time.Time
+	To     time.Time
+}
+
+// ParseStatementQuery reads format, from and to of a statement request.
+// Bounds are RFC 3339 timestamps or dates; a date in to includes that whole
+// day. Missing bounds select the whole history up to now.
+func ParseStatementQuery(r *http.Request) (StatementQuery, error) {
+	q := StatementQuery{Format: StatementJSON, To: time.Now()}
+	params := r.URL.Query()
+	var fields []errs.FieldError
+	if format := params.Get("format"); format != "" {
+		q.Format = strings.ToLower(format)
+	}
+	if q.Format != StatementJSON && q.Format != StatementCSV {
+		fields = append(fields, errs.FieldError{Field: "format", Message: "must be csv or json"})
+	}
+	if from := params.Get("from"); from != "" {
+		t, _, err := parseStatementTime(from)
+		if err != nil {
+			fields = append(fields, errs.FieldError{Field: "from", Message: "must be a date or an RFC 3339 time"})
+		}
+		q.From = t
+	}
+	if to := params.Get("to"); to != "" {
+		t, dateOnly, err := parseStatementTime(to)
+		if err != nil {
+			fields = append(fields, errs.FieldError{Field: "to", Message: "must be a date or an RFC 3339 time"})
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		q.To = t
+	}
+	if len(fields) == 0 && !q.From.Before(q.To) {
+		fields = append(fields, errs.FieldError{Field: "to", Message: "must be after from"})
+	}
+	if len(fields) > 0 {
+		return StatementQuery{}, errs.Validation("invalid statement query", fields)
+	}
+	return q, nil
+}
+
+func parseStatementTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(statementDateLayout, value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// DailyReportService returns the daily program totals between from and to,
+// both dates and both inclusive, for the last DefaultReportDays by default.
+func DailyReportService(r *http.Request, storage types.Storage) (int, []byte, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to := today.AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -DefaultReportDays)
+	var (
+		fields []errs.FieldError
+		err    error
+	)
+	params := r.URL.Query()
+	if v := params.Get("from"); v != "" {
+		if from, err = time.Parse(types.DayLayout, v); err != nil {
+			fields = append(fields, errs.FieldError{Field: "from", Message: "must be a date"})
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if to, err = time.Parse(types.DayLayout, v); err != nil {
+			fields = append(fields, errs.FieldError{Field: "to", Message: "must be a date"})
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if len(fields) == 0 {
+		if !from.Before(to) {
+			fields = append(fields, errs.FieldError{Field: "to", Message: "must not be before from"})
+		} else if to.Sub(from) > maxReportDays*24*time.Hour {
+			fields = append(fields, errs.FieldError{Field: "from", Message: fmt.Sprintf("must be at most %d days before to", maxReportDays)})
+		}
+	}
+	if len(fields) > 0 {
+		return 0, nil, errs.Validation("invalid report query", fields)
+	}
+
+	report, err := storage.GetDailyReport(from, to)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while getting daily report", err)
+	}
+	for i := range report {
+		day := &report[i]
+		if day.OrdersProcessed > 0 {
+			day.AverageAccrual = math.Round(day.PointsIssued/float64(day.OrdersProcessed)*100) / 100
+		}
+		if day.OrdersUploaded > 0 {
+			day.InvalidRate = math.Round(float64(day.OrdersInvalid)/float64(day.OrdersUploaded)*10000) / 10000
+		}
+	}
+	response, err := json.Marshal(report)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+// TopRulesService returns the goods rules that gave the most points. Rules
+// and their stats live in the accrual system, so it is asked on every call.
+func TopRulesService(r *http.Request, client *accrualclient.Client) (int, []byte, error) {
+	limit := DefaultTopRules
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxTopRules {
+			return 0, nil, errs.Validation("invalid report query", []errs.FieldError{{Field: "limit", Message: fmt.Sprintf("must be a number from 1 to %d", maxTopRules)}})
+		}
+	}
+
+	rules, err := client.TopRules(r.Context(), limit)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Unavailable, "cannot get top rules from accrual system", err)
+	}
+	response, err := json.Marshal(rules)
+	if err != nil {
+		return 0, nil, errs.Wrap(errs.Internal, "error while marshaling response json", err)
+	}
+	return http.StatusOK, response, nil
+}
+
+func AccrualEventService(r *http.Request, storage types.Storage, secret string) (int, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return 0, err
+	}
+	if err = webhook.Verify(secret, r.Header, body, webhook.DefaultTolerance); err != nil {
+		return 0, errs.Wrap(errs.Unauthorized, "cannot verify accrual event", err)
+	}
+
+	var event webhook.Event
+	if err = json.Unmarshal(body, &event); err != nil {
+		return 0, errs.Wrap(errs.Invalid, "cannot decode accrual event", err)
+	}
+	if event.Type != webhook.EventOrderStatusChanged {
+		return http.StatusNoContent, nil
+	}
+
+	err = storage.UpgradeOrderStatus(accrualclient.Order{
+		Number:  event.Order,
+		Status:  accrualclient.Status(event.Status),
+		Accrual: event.Accrual,
+	})
+	if errors.Is(err, orderstate.ErrUnknownStatus) {
+		return 0, errs.Wrap(errs.Unprocessable, "cannot apply accrual event", err)
+	}
+	if errors.Is(err, orderstate.ErrIllegalTransition) {
+		log.Printf("AccrualEventService: ignoring stale event %s: %s", event.ID, err)
+		return http.StatusNoContent, nil
+	}
+	if err != nil {
+		return 0, errs.Wrap(errs.Internal, "AccrualEventService: cannot update order status", err)
+	}
+
+	return http.StatusNoContent, nil
+}
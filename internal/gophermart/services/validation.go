@@ -0,0 +1,51 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/ordernum"
+)
+
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, errs.New(errs.TooLarge, fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit))
+		}
+		return nil, errs.Wrap(errs.Invalid, "cannot read request body", err)
+	}
+	return body, nil
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		return errs.Wrap(errs.Invalid, "cannot decode request body", err)
+	}
+	return nil
+}
+
+func readOrderNumber(r *http.Request) (string, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return "", err
+	}
+	orderNum := strings.TrimSpace(string(body))
+	if orderNum == "" {
+		return "", errs.New(errs.Invalid, "order number is empty")
+	}
+	if !ordernum.Valid(orderNum) {
+		return "", errs.ErrInvalidOrderNumber
+	}
+	return orderNum, nil
+}
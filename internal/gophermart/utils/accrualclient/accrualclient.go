@@ -0,0 +1,309 @@
+package accrualclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+)
+
+const (
+	DefaultTimeout      = defaults.AccrualTimeout
+	DefaultRetries      = 2
+	DefaultRetryBackoff = 100 * time.Millisecond
+	ordersPath          = "api/orders"
+	subscriptionsPath   = "api/subscriptions"
+	rulesReportPath     = "api/admin/reports/rules"
+	maxErrorBodySize    = 1 << 10
+)
+
+type Status string
+
+const (
+	StatusRegistered Status = "REGISTERED"
+	StatusInvalid    Status = "INVALID"
+	StatusProcessing Status = "PROCESSING"
+	StatusProcessed  Status = "PROCESSED"
+	StatusCancelled  Status = "CANCELLED"
+)
+
+type Order struct {
+	Number  string  `json:"order"`
+	Status  Status  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
+
+// RuleStats is how often a goods rule of the accrual system matched
+// processed orders and how many points it gave.
+type RuleStats struct {
+	Match  string  `json:"match"`
+	Orders int     `json:"orders"`
+	Points float64 `json:"points"`
+}
+
+var ErrNotRegistered = errors.New("order is not registered in accrual system")
+
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit exceeded, retry after %s: %s", e.RetryAfter, e.Message)
+}
+
+type ServerError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("accrual system returned status %d: %s", e.StatusCode, e.Body)
+}
+
+type Client struct {
+	baseURL      url.URL
+	httpClient   *http.Client
+	retries      int
+	retryBackoff time.Duration
+	breaker      *Breaker
+	token        string
+}
+
+type Option func(*Client)
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.httpClient.Timeout = timeout
+	}
+}
+
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken sets the bearer token sent with subscription requests.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+func WithBreaker(breaker *Breaker) Option {
+	return func(c *Client) {
+		c.breaker = breaker
+	}
+}
+
+func New(address string, opts ...Option) (*Client, error) {
+	baseURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accrual system address %q: %w", address, err)
+	}
+	c := &Client{
+		baseURL:      *baseURL,
+		httpClient:   &http.Client{Timeout: DefaultTimeout},
+		retries:      DefaultRetries,
+		retryBackoff: DefaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+func (c *Client) GetOrder(ctx context.Context, number string) (Order, error) {
+	var (
+		order Order
+		err   error
+	)
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return Order{}, ctx.Err()
+			case <-time.After(c.retryBackoff * time.Duration(attempt)):
+			}
+		}
+		order, err = c.call(ctx, number)
+		if errors.Is(err, ErrCircuitOpen) || !retryable(err) {
+			return order, err
+		}
+	}
+	return order, err
+}
+
+func (c *Client) Breaker() *Breaker {
+	return c.breaker
+}
+
+func (c *Client) call(ctx context.Context, number string) (Order, error) {
+	if c.breaker == nil {
+		return c.getOrder(ctx, number)
+	}
+	if err := c.breaker.Allow(); err != nil {
+		return Order{}, err
+	}
+	order, err := c.getOrder(ctx, number)
+	switch {
+	case ctx.Err() != nil:
+		c.breaker.release()
+	case retryable(err):
+		c.breaker.Failure()
+	default:
+		c.breaker.Success()
+	}
+	return order, err
+}
+
+func (c *Client) getOrder(ctx context.Context, number string) (Order, error) {
+	var order Order
+
+	u := c.baseURL
+	u.Path = path.Join("/", c.baseURL.Path, ordersPath, number)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return order, fmt.Errorf("cannot create request to accrual system: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return order, fmt.Errorf("can't get response from accrual system: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err = json.NewDecoder(resp.Body).Decode(&order); err != nil {
+			return order, fmt.Errorf("cannot decode response from accrual system: %w", err)
+		}
+		return order, nil
+	case resp.StatusCode == http.StatusNoContent:
+		return order, ErrNotRegistered
+	case resp.StatusCode == http.StatusTooManyRequests:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return order, &RateLimitError{
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Message:    string(body),
+		}
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return order, &ServerError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+}
+
+// Subscribe registers callbackURL to receive signed order status events
+// from the accrual system and returns the subscription id. Registering the
+// same url again only updates its secret.
+func (c *Client) Subscribe(ctx context.Context, callbackURL, secret string) (int64, error) {
+	body, err := json.Marshal(map[string]string{"url": callbackURL, "secret": secret})
+	if err != nil {
+		return 0, fmt.Errorf("cannot encode subscription: %w", err)
+	}
+
+	u := c.baseURL
+	u.Path = path.Join("/", c.baseURL.Path, subscriptionsPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("cannot create request to accrual system: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("can't get response from accrual system: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return 0, &ServerError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var sub struct {
+		ID int64 `json:"id"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&sub); err != nil {
+		return 0, fmt.Errorf("cannot decode response from accrual system: %w", err)
+	}
+	return sub.ID, nil
+}
+
+// TopRules returns up to limit goods rules that gave the most points. The
+// accrual system serves them only with its admin token.
+func (c *Client) TopRules(ctx context.Context, limit int) ([]RuleStats, error) {
+	u := c.baseURL
+	u.Path = path.Join("/", c.baseURL.Path, rulesReportPath)
+	u.RawQuery = url.Values{"limit": {strconv.Itoa(limit)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request to accrual system: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't get response from accrual system: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return nil, &ServerError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var rules []RuleStats
+	if err = json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("cannot decode response from accrual system: %w", err)
+	}
+	return rules, nil
+}
+
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, ErrNotRegistered) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return false
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
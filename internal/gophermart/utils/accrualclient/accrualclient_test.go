@@ -0,0 +1,141 @@
+package accrualclient_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient/accrualtest"
+)
+
+func newClient(t *testing.T, server *accrualtest.Server, opts ...accrualclient.Option) *accrualclient.Client {
+	t.Helper()
+	client, err := accrualclient.New(server.URL, opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return client
+}
+
+func TestGetOrder(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	want := accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 729.98}
+	server.SetOrder(want)
+
+	got, err := newClient(t, server).GetOrder(context.Background(), want.Number)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got != want {
+		t.Fatalf("GetOrder = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetOrderNotRegistered(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+
+	_, err := newClient(t, server).GetOrder(context.Background(), "12345678903")
+	if !errors.Is(err, accrualclient.ErrNotRegistered) {
+		t.Fatalf("GetOrder error = %v, want ErrNotRegistered", err)
+	}
+	if server.Requests() != 1 {
+		t.Fatalf("requests = %d, want 1", server.Requests())
+	}
+}
+
+func TestGetOrderRateLimited(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	server.RateLimit(60 * time.Second)
+
+	_, err := newClient(t, server).GetOrder(context.Background(), "12345678903")
+	var rateLimitErr *accrualclient.RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("GetOrder error = %v, want RateLimitError", err)
+	}
+	if rateLimitErr.RetryAfter != 60*time.Second {
+		t.Fatalf("RetryAfter = %s, want 60s", rateLimitErr.RetryAfter)
+	}
+	if server.Requests() != 1 {
+		t.Fatalf("requests = %d, want no retries on rate limit", server.Requests())
+	}
+}
+
+func TestGetOrderRetriesServerErrors(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	server.SetOrder(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessing})
+	server.FailNext(2)
+
+	client := newClient(t, server, accrualclient.WithRetries(2, time.Millisecond))
+	got, err := client.GetOrder(context.Background(), "12345678903")
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got.Status != accrualclient.StatusProcessing {
+		t.Fatalf("Status = %s, want PROCESSING", got.Status)
+	}
+	if server.Requests() != 3 {
+		t.Fatalf("requests = %d, want 3", server.Requests())
+	}
+}
+
+func TestGetOrderServerError(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	server.FailNext(3)
+
+	client := newClient(t, server, accrualclient.WithRetries(1, time.Millisecond))
+	_, err := client.GetOrder(context.Background(), "12345678903")
+	var serverErr *accrualclient.ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != 500 {
+		t.Fatalf("GetOrder error = %v, want ServerError with status 500", err)
+	}
+	if server.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2", server.Requests())
+	}
+}
+
+func TestGetOrderTimeout(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	server.Delay(time.Second)
+
+	client := newClient(t, server, accrualclient.WithTimeout(20*time.Millisecond), accrualclient.WithRetries(0, 0))
+	start := time.Now()
+	if _, err := client.GetOrder(context.Background(), "12345678903"); err == nil {
+		t.Fatal("GetOrder: want timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("GetOrder took %s, want timeout to apply", elapsed)
+	}
+}
+
+func TestGetOrderCircuitBreaker(t *testing.T) {
+	server := accrualtest.NewServer()
+	defer server.Close()
+	server.FailNext(10)
+
+	breaker := accrualclient.NewBreaker(accrualclient.BreakerConfig{FailureThreshold: 2, CoolDown: time.Hour})
+	client := newClient(t, server, accrualclient.WithRetries(5, time.Millisecond), accrualclient.WithBreaker(breaker))
+
+	_, err := client.GetOrder(context.Background(), "12345678903")
+	if !errors.Is(err, accrualclient.ErrCircuitOpen) {
+		t.Fatalf("GetOrder error = %v, want ErrCircuitOpen", err)
+	}
+	if server.Requests() != 2 {
+		t.Fatalf("requests = %d, want 2", server.Requests())
+	}
+
+	server.FailNext(0)
+	if _, err = client.GetOrder(context.Background(), "12345678903"); !errors.Is(err, accrualclient.ErrCircuitOpen) {
+		t.Fatalf("GetOrder error = %v, want ErrCircuitOpen", err)
+	}
+	if server.Requests() != 2 {
+		t.Fatalf("requests = %d, open circuit must not reach the server", server.Requests())
+	}
+}
@@ -0,0 +1,97 @@
+package accrualtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+)
+
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	orders     map[string]accrualclient.Order
+	retryAfter time.Duration
+	failures   int
+	delay      time.Duration
+	requests   int
+}
+
+func NewServer() *Server {
+	s := &Server{orders: make(map[string]accrualclient.Order)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) SetOrder(order accrualclient.Order) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[order.Number] = order
+}
+
+func (s *Server) RateLimit(retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retryAfter = retryAfter
+}
+
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+func (s *Server) Delay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	delay, retryAfter := s.delay, s.retryAfter
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	order, ok := s.orders[strings.TrimPrefix(r.URL.Path, "/api/orders/")]
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch {
+	case r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/api/orders/"):
+		http.NotFound(w, r)
+	case retryAfter > 0:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than N requests per minute allowed"))
+	case fail:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	case !ok:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(order)
+	}
+}
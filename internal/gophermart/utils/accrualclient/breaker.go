@@ -0,0 +1,156 @@
+package accrualclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
+)
+
+const (
+	DefaultFailureThreshold    = defaults.AccrualFailureThreshold
+	DefaultCoolDown            = defaults.AccrualCoolDown
+	DefaultHalfOpenMaxRequests = 1
+)
+
+var ErrCircuitOpen = errors.New("accrual system circuit breaker is open")
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type BreakerConfig struct {
+	FailureThreshold    int
+	CoolDown            time.Duration
+	HalfOpenMaxRequests int
+}
+
+type BreakerStats struct {
+	State               State
+	ConsecutiveFailures int
+	Successes           uint64
+	Failures            uint64
+	Rejected            uint64
+	Opened              uint64
+}
+
+// Breaker stops calls to the accrual system after FailureThreshold consecutive
+// failures and lets a limited number of probe requests through once CoolDown
+// has passed.
+type Breaker struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    State
+	openedAt time.Time
+	inFlight int
+	stats    BreakerStats
+	now      func() time.Time
+}
+
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = DefaultFailureThreshold
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = DefaultCoolDown
+	}
+	if cfg.HalfOpenMaxRequests <= 0 {
+		cfg.HalfOpenMaxRequests = DefaultHalfOpenMaxRequests
+	}
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.cfg.CoolDown {
+		b.state = StateHalfOpen
+		b.inFlight = 0
+	}
+	switch b.state {
+	case StateOpen:
+		b.stats.Rejected++
+		return ErrCircuitOpen
+	case StateHalfOpen:
+		if b.inFlight >= b.cfg.HalfOpenMaxRequests {
+			b.stats.Rejected++
+			return ErrCircuitOpen
+		}
+		b.inFlight++
+	}
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stats.Successes++
+	b.stats.ConsecutiveFailures = 0
+	b.state = StateClosed
+	b.inFlight = 0
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stats.Failures++
+	b.stats.ConsecutiveFailures++
+	if b.state == StateHalfOpen || b.stats.ConsecutiveFailures >= b.cfg.FailureThreshold {
+		b.open()
+	}
+}
+
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen && b.inFlight > 0 {
+		b.inFlight--
+	}
+}
+
+func (b *Breaker) open() {
+	if b.state != StateOpen {
+		b.stats.Opened++
+	}
+	b.state = StateOpen
+	b.openedAt = b.now()
+	b.inFlight = 0
+}
+
+func (b *Breaker) State() State {
+	return b.Stats().State
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.State = b.state
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.cfg.CoolDown {
+		stats.State = StateHalfOpen
+	}
+	return stats
+}
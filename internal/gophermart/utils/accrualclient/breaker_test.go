@@ -0,0 +1,78 @@
+package accrualclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(threshold int, coolDown time.Duration) (*Breaker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBreaker(BreakerConfig{FailureThreshold: threshold, CoolDown: coolDown})
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, _ := newTestBreaker(3, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow #%d: %v", i, err)
+		}
+		b.Failure()
+	}
+	if b.State() != StateOpen {
+		t.Fatalf("State = %s, want open", b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow on open circuit = %v, want ErrCircuitOpen", err)
+	}
+	if stats := b.Stats(); stats.Rejected != 1 || stats.Opened != 1 || stats.Failures != 3 {
+		t.Fatalf("Stats = %+v", stats)
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b, _ := newTestBreaker(2, time.Minute)
+
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if b.State() != StateClosed {
+		t.Fatalf("State = %s, want closed", b.State())
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := newTestBreaker(1, time.Minute)
+	b.Failure()
+
+	*now = now.Add(time.Minute)
+	if b.State() != StateHalfOpen {
+		t.Fatalf("State after cool-down = %s, want half-open", b.State())
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow probe: %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow second probe = %v, want ErrCircuitOpen", err)
+	}
+
+	b.Failure()
+	if b.State() != StateOpen {
+		t.Fatalf("State after failed probe = %s, want open", b.State())
+	}
+
+	*now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow probe: %v", err)
+	}
+	b.Success()
+	if b.State() != StateClosed {
+		t.Fatalf("State after successful probe = %s, want closed", b.State())
+	}
+	if stats := b.Stats(); stats.Opened != 2 {
+		t.Fatalf("Opened = %d, want 2", stats.Opened)
+	}
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"flag"
 	"log"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/defaults"
 
 	"github.com/caarlos0/env"
 )
@@ -12,6 +15,32 @@ type Config struct {
 	DBAddress string `env:"DATABASE_URI"`
 	Accrual   string `env:"ACCRUAL_SYSTEM_ADDRESS"`
 	JWTSecret string `env:"JWT_SECRET"`
+
+	AccrualTimeout          time.Duration `env:"ACCRUAL_TIMEOUT"`
+	AccrualFailureThreshold int           `env:"ACCRUAL_FAILURE_THRESHOLD"`
+	AccrualCoolDown         time.Duration `env:"ACCRUAL_COOL_DOWN"`
+	CallbackURL             string        `env:"ACCRUAL_CALLBACK_URL"`
+	WebhookSecret           string        `env:"ACCRUAL_WEBHOOK_SECRET"`
+	AccrualToken            string        `env:"ACCRUAL_ADMIN_TOKEN"`
+	AdminToken              string        `env:"ADMIN_TOKEN"`
+	MerchantToken           string        `env:"MERCHANT_TOKEN"`
+
+	EmbeddedWorker      bool          `env:"EMBEDDED_WORKER"`
+	Scheduler           string        `env:"RECONCILER_SCHEDULER"`
+	ReconcileInterval   time.Duration `env:"RECONCILER_INTERVAL"`
+	ReconcileMaxBackoff time.Duration `env:"RECONCILER_MAX_INTERVAL"`
+
+	CancellationWindow        time.Duration `env:"CANCELLATION_WINDOW"`
+	CancellationCheckInterval time.Duration `env:"CANCELLATION_CHECK_INTERVAL"`
+
+	PointsExpiryMonths int           `env:"POINTS_EXPIRY_MONTHS"`
+	ExpiryInterval     time.Duration `env:"POINTS_EXPIRY_INTERVAL"`
+	ExpiringSoon       time.Duration `env:"POINTS_EXPIRING_SOON"`
+
+	TransferMinAmount  float64 `env:"TRANSFER_MIN_AMOUNT"`
+	TransferDailyLimit float64 `env:"TRANSFER_DAILY_LIMIT"`
+
+	ReportRefreshInterval time.Duration `env:"REPORT_REFRESH_INTERVAL"`
 }
 
 func New() *Config {
@@ -21,6 +50,26 @@ func New() *Config {
 	flag.StringVar(&cfg.DBAddress, "d", "", "set the DB address")
 	flag.StringVar(&cfg.Accrual, "r", "", "accrual system address")
 	flag.StringVar(&cfg.JWTSecret, "js", "secret", "secret token for jwt")
+	flag.DurationVar(&cfg.AccrualTimeout, "at", defaults.AccrualTimeout, "accrual system request timeout")
+	flag.IntVar(&cfg.AccrualFailureThreshold, "af", defaults.AccrualFailureThreshold, "consecutive accrual system failures before the circuit opens")
+	flag.DurationVar(&cfg.AccrualCoolDown, "ac", defaults.AccrualCoolDown, "time the accrual circuit stays open before probing again")
+	flag.StringVar(&cfg.CallbackURL, "cb", "", "public url of /api/accrual/events to receive accrual system events")
+	flag.StringVar(&cfg.WebhookSecret, "ws", "", "secret used to verify accrual system event signatures")
+	flag.StringVar(&cfg.AccrualToken, "rt", "", "accrual system admin token used to subscribe to its events")
+	flag.StringVar(&cfg.AdminToken, "adm", "", "bearer token for /api/admin endpoints, disabled when empty")
+	flag.StringVar(&cfg.MerchantToken, "mt", "", "bearer token for /api/merchant endpoints, disabled when empty")
+	flag.BoolVar(&cfg.EmbeddedWorker, "w", true, "poll accrual system from the server process")
+	flag.StringVar(&cfg.Scheduler, "s", "fixed", "reconciler scheduler: fixed or adaptive")
+	flag.DurationVar(&cfg.ReconcileInterval, "pi", defaults.ReconcileInterval, "interval between accrual polling passes")
+	flag.DurationVar(&cfg.ReconcileMaxBackoff, "pm", defaults.ReconcileMaxBackoff, "maximum interval between passes for adaptive scheduler")
+	flag.DurationVar(&cfg.CancellationWindow, "cw", 0, "time a processed order is still polled for a cancellation, 0 to stop polling once an order is processed")
+	flag.DurationVar(&cfg.CancellationCheckInterval, "ci", defaults.CancellationCheckInterval, "interval between polls of a processed order for a cancellation")
+	flag.IntVar(&cfg.PointsExpiryMonths, "pe", 0, "months after processing when accrued points expire, 0 to keep them forever")
+	flag.DurationVar(&cfg.ExpiryInterval, "ei", defaults.ExpiryInterval, "interval between point expiry passes")
+	flag.DurationVar(&cfg.ExpiringSoon, "es", defaults.ExpiringSoonWindow, "window reported as expiring_soon in balance")
+	flag.Float64Var(&cfg.TransferMinAmount, "tmin", defaults.TransferMinAmount, "minimum amount of a single point transfer")
+	flag.Float64Var(&cfg.TransferDailyLimit, "tday", defaults.TransferDailyLimit, "points a user may transfer within 24 hours, 0 for no limit")
+	flag.DurationVar(&cfg.ReportRefreshInterval, "ri", defaults.ReportRefreshInterval, "interval between refreshes of admin report aggregates")
 	flag.Parse()
 
 	if err := env.Parse(&cfg); err != nil {
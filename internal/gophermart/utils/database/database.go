@@ -3,54 +3,122 @@ package database
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math"
-	"path"
 	"time"
 
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/orderstate"
 	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 
-	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
 var (
-	ErrUserExists   = errors.New("such user already exist in DB")
-	ErrScanData     = errors.New("error while scan user ID")
-	ErrInvalidData  = errors.New("error user data is invalid")
-	ErrHashGenerate = errors.New("error can't generate hash")
-	ErrKeyNotFound  = errors.New("error user ID not found")
-	ErrAlarm        = errors.New("error tx.BeginTx alarm")
-	ErrAlarm2       = errors.New("error tx.PrepareContext alarm")
-
-	selectOrdersByUserStmt            string        = `SELECT * FROM orders WHERE login=$1`
-	updateOrderStatusToProcessingStmt string        = `UPDATE orders SET order_status='PROCESSING' WHERE order_num=$1`
-	updateOrderStatusToProcessedStmt  string        = `UPDATE orders SET order_status='PROCESSED', accrual=$1 WHERE order_num=$2`
-	updateOrderStatusToInvalidStmt    string        = `UPDATE orders SET order_status='INVALID' WHERE order_num=$1`
-	updateOrderStatusToUnknownStmt    string        = `UPDATE orders SET order_status='UNKNOWN' WHERE order_num=$1`
-	selectUserStmt                    string        = `SELECT id, login, password_hash FROM users WHERE login = $1`
-	selectNotProcessedOrdersStmt      string        = `SELECT order_num FROM orders WHERE order_status='NEW' OR order_status='PROCESSING'`
-	selectAccrualBalanceOrdersStmt    string        = `SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE order_status = 'PROCESSED' AND login = $1`
-	selectAccrualWithdrawnStmt        string        = `SELECT COALESCE(SUM(accrual), 0) FROM withdrawals WHERE login = $1`
-	insertWirdrawalStmt               string        = "INSERT INTO withdrawals (login, order_num, accrual, created_at) VALUES ($1, $2, $3, $4)"
-	selectWithdrawalsByUserStmt       string        = `SELECT order_num, accrual, created_at FROM withdrawals WHERE login=$1`
-	selectUserIDByOrderNumStmt        string        = `SELECT login FROM orders WHERE EXISTS(SELECT login FROM orders WHERE order_num = $1);`
-	selectUserIDStmt                  string        = `SELECT login from orders WHERE order_num = $1;`
-	checkUserDatastmt                 string        = `SELECT EXISTS(SELECT login, password_hash FROM users WHERE login = $1 AND password_hash = $2)`
-	checkOrderInterval                time.Duration = 5 * time.Second
+	selectOrdersByUserStmt   string = `SELECT order_num, user_id, order_status, accrual, date_time FROM orders WHERE user_id=$1 ORDER BY date_time`
+	selectOrderForUpdateStmt string = `SELECT user_id, order_status, COALESCE(accrual, 0) FROM orders WHERE order_num = $1 FOR UPDATE`
+	updateOrderStatusStmt    string = `UPDATE orders SET order_status = $1, accrual = $2 WHERE order_num = $3`
+	insertOrderEventStmt     string = `INSERT INTO order_events (user_id, order_num, previous_status, order_status, accrual, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	selectOrderEventsStmt    string = `SELECT id, order_num, previous_status, order_status, accrual, created_at FROM order_events WHERE user_id = $1 AND id > $2 ORDER BY id LIMIT $3`
+	selectLastOrderEventStmt string = `SELECT COALESCE(MAX(id), 0) FROM order_events WHERE user_id = $1`
+	selectUserStmt           string = `SELECT id, login, password_hash FROM users WHERE login = $1`
+	claimPendingOrdersStmt   string = `UPDATE order_outbox SET locked_by = $1, locked_until = $2
+		WHERE order_num IN (
+			SELECT order_num FROM order_outbox
+			WHERE next_attempt_at <= $3 AND (locked_until IS NULL OR locked_until <= $3)
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING order_num, attempts, watch_until IS NOT NULL`
+	insertOutboxStmt               string = `INSERT INTO order_outbox (order_num, attempts, next_attempt_at, created_at) VALUES ($1, 0, $2, $2) ON CONFLICT (order_num) DO NOTHING`
+	rescheduleOutboxStmt           string = `UPDATE order_outbox SET attempts = attempts + 1, next_attempt_at = $1, locked_by = NULL, locked_until = NULL WHERE order_num = $2`
+	deleteOutboxStmt               string = `DELETE FROM order_outbox WHERE order_num = $1`
+	watchOutboxStmt                string = `UPDATE order_outbox SET watch_until = $1 WHERE order_num = $2`
+	deleteWatchedOutboxStmt        string = `DELETE FROM order_outbox WHERE order_num = $1 AND (watch_until IS NULL OR watch_until <= $2)`
+	selectUnexpiredLotsBalanceStmt string = `SELECT COALESCE(SUM(remaining), 0) FROM point_lots WHERE user_id = $1 AND remaining > 0 AND (expires_at IS NULL OR expires_at > $2)`
+	selectExpiringPointsStmt       string = `SELECT COALESCE(SUM(remaining), 0) FROM point_lots WHERE user_id = $1 AND remaining > 0 AND expires_at > $2 AND expires_at <= $3`
+	selectSpendableLotsStmt        string = `SELECT id, remaining, expires_at FROM point_lots WHERE user_id = $1 AND remaining > 0 AND (expires_at IS NULL OR expires_at > $2) ORDER BY order_num IS NOT DISTINCT FROM $3 DESC, created_at, id FOR UPDATE`
+	updateLotRemainingStmt         string = `UPDATE point_lots SET remaining = $1 WHERE id = $2`
+	insertPointLotStmt             string = `INSERT INTO point_lots (user_id, order_num, withdrawal_id, transfer_id, amount, remaining, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	selectUserLoginStmt            string = `SELECT login FROM users WHERE id = $1`
+	selectColumnExistsStmt         string = `SELECT EXISTS(SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2)`
+	insertMigrationStmt            string = `INSERT INTO gophermart_migrations (name, applied_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`
+	selectTransferredSinceStmt     string = `SELECT COALESCE(SUM(amount), 0) FROM transfers WHERE sender_id = $1 AND created_at > $2`
+	insertTransferStmt             string = `INSERT INTO transfers (sender_id, recipient_id, amount, created_at) VALUES ($1, $2, $3, $4) RETURNING id`
+	selectPointDebtStmt            string = `SELECT COALESCE((SELECT amount FROM point_debts WHERE user_id = $1), 0)`
+	selectPointDebtForUpdateStmt   string = `SELECT amount FROM point_debts WHERE user_id = $1 FOR UPDATE`
+	updatePointDebtStmt            string = `UPDATE point_debts SET amount = $1 WHERE user_id = $2`
+	addPointDebtStmt               string = `INSERT INTO point_debts (user_id, amount) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET amount = point_debts.amount + EXCLUDED.amount`
+	selectExpiredLotsStmt          string = `SELECT id, user_id, COALESCE(order_num, ''), remaining, expires_at FROM point_lots WHERE remaining > 0 AND expires_at <= $1 ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED`
+	insertPointExpirationStmt      string = `INSERT INTO point_expirations (lot_id, user_id, order_num, amount, expires_at, expired_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	selectPointExpirationsStmt     string = `SELECT id, order_num, amount, expires_at, expired_at FROM point_expirations WHERE user_id = $1 ORDER BY id`
+	selectAccrualWithdrawnStmt     string = `SELECT COALESCE(SUM(accrual), 0) FROM withdrawals WHERE user_id = $1 AND status <> 'REVERSED'`
+	insertWirdrawalStmt            string = "INSERT INTO withdrawals (user_id, order_num, accrual, created_at, status) VALUES ($1, $2, $3, $4, 'COMPLETED') ON CONFLICT (order_num) DO NOTHING RETURNING id"
+	selectWithdrawalsByUserStmt    string = `SELECT id, order_num, accrual, status, created_at, reversed_at, reversal_reason FROM withdrawals WHERE user_id=$1 ORDER BY created_at`
+	selectWithdrawalByOrderStmt    string = `SELECT id, order_num, accrual, status, created_at, reversed_at, reversal_reason FROM withdrawals WHERE order_num = $1`
+	selectWithdrawalOwnerStmt      string = `SELECT user_id, accrual FROM withdrawals WHERE order_num = $1`
+	selectWithdrawalForUpdateStmt  string = `SELECT user_id, id, order_num, accrual, status, created_at, reversed_at, reversal_reason FROM withdrawals WHERE id = $1 FOR UPDATE`
+	updateWithdrawalReversedStmt   string = `UPDATE withdrawals SET status = 'REVERSED', reversed_at = $1, reversal_reason = $2 WHERE id = $3`
+	insertWithdrawalReversalStmt   string = `INSERT INTO withdrawal_reversals (withdrawal_id, user_id, amount, reason, actor, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	insertWithdrawalLotStmt        string = `INSERT INTO withdrawal_lots (withdrawal_id, lot_id, amount, expires_at) VALUES ($1, $2, $3, $4)`
+	selectWithdrawalLotsStmt       string = `SELECT lot_id, amount, expires_at FROM withdrawal_lots WHERE withdrawal_id = $1 ORDER BY lot_id`
+	selectDailyReportStmt          string = `SELECT day, points_issued, points_redeemed, active_users, orders_uploaded, orders_processed, orders_invalid FROM daily_report WHERE day >= $1 AND day < $2 ORDER BY day`
+	refreshDailyReportStmt         string = `REFRESH MATERIALIZED VIEW CONCURRENTLY daily_report`
+	selectUserIDByOrderNumStmt     string = `SELECT user_id FROM orders WHERE order_num = $1;`
+	selectUserIDStmt               string = `SELECT user_id from orders WHERE order_num = $1;`
+	checkUserDatastmt              string = `SELECT EXISTS(SELECT login, password_hash FROM users WHERE login = $1 AND password_hash = $2)`
+	insertOrderIfNotExistsStmt     string = `INSERT INTO orders (order_num, user_id, order_status, accrual, date_time) VALUES ($1, $2, $3, 0, $4) ON CONFLICT (order_num) DO NOTHING`
+	historyStmt                    string = `
+			SELECT 'accrual' AS kind, accrual AS amount, order_num, '' AS counterparty, created_at FROM order_events
+			WHERE user_id = $1 AND order_status = 'PROCESSED' AND accrual > 0
+			UNION ALL
+			SELECT 'clawback', -accrual, order_num, '', created_at FROM order_events
+			WHERE user_id = $1 AND previous_status = 'PROCESSED' AND order_status = 'CANCELLED'
+			UNION ALL
+			SELECT 'withdrawal', -accrual, order_num, '', created_at FROM withdrawals WHERE user_id = $1
+			UNION ALL
+			SELECT 'reversal', r.amount, w.order_num, '', r.created_at FROM withdrawal_reversals r
+			JOIN withdrawals w ON w.id = r.withdrawal_id WHERE r.user_id = $1
+			UNION ALL
+			SELECT 'transfer_out', -t.amount, '', u.login, t.created_at FROM transfers t
+			JOIN users u ON u.id = t.recipient_id WHERE t.sender_id = $1
+			UNION ALL
+			SELECT 'transfer_in', t.amount, '', u.login, t.created_at FROM transfers t
+			JOIN users u ON u.id = t.sender_id WHERE t.recipient_id = $1
+			UNION ALL
+			SELECT 'expiration', -amount, order_num, '', expired_at FROM point_expirations WHERE user_id = $1`
+	selectTransactionsStmt string = `SELECT kind, amount, order_num, counterparty, created_at FROM (` + historyStmt + `
+		) history
+		ORDER BY created_at`
+	selectStatementStmt string = `SELECT kind, amount, order_num, order_status, counterparty, created_at, balance FROM (
+			SELECT kind, amount, order_num, order_status, counterparty, created_at,
+				ROW_NUMBER() OVER running AS seq,
+				SUM(amount) OVER running AS balance
+			FROM (
+				SELECT kind, amount, order_num, '' AS order_status, counterparty, created_at FROM (` + historyStmt + `
+				) history
+				UNION ALL
+				SELECT 'order', 0, order_num, order_status, '', date_time FROM orders WHERE user_id = $1
+			) statement
+			WINDOW running AS (ORDER BY created_at, kind, order_num, counterparty ROWS UNBOUNDED PRECEDING)
+		) entries
+		WHERE created_at >= $2 AND created_at < $3
+		ORDER BY seq`
 )
 
 type DataBase struct {
-	db  *sql.DB
-	ctx context.Context
-	dba string
+	db                 *sql.DB
+	ctx                context.Context
+	dba                string
+	expiryMonths       int
+	cancellationWindow time.Duration
 }
 
 func NewDataBase(ctx context.Context, dba string) (*DataBase, error) {
@@ -58,10 +126,13 @@ func NewDataBase(ctx context.Context, dba string) (*DataBase, error) {
 		err := fmt.Errorf("there is no DB address")
 		return nil, err
 	}
-	db, err := sql.Open("pgx", dba)
+	config, err := pgx.ParseConfig(dba)
 	if err != nil {
 		return nil, err
 	}
+	// Date casts in the reports depend on the session time zone.
+	config.RuntimeParams["timezone"] = "UTC"
+	db := stdlib.OpenDB(*config)
 	return &DataBase{
 		db:  db,
 		ctx: ctx,
@@ -69,8 +140,32 @@ func NewDataBase(ctx context.Context, dba string) (*DataBase, error) {
 	}, nil
 }
 
-func (d *DataBase) Migrate() {
-	_, err := d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS users (
+// SetPointsExpiry makes points accrued from now on expire the given number
+// of months after the order is processed. Zero keeps them forever.
+func (d *DataBase) SetPointsExpiry(months int) {
+	d.expiryMonths = months
+}
+
+// SetCancellationWindow keeps orders processed from now on pending for the
+// given time, so that a cancellation is picked up by polling even without
+// accrual system events. Zero stops polling an order once it is processed.
+func (d *DataBase) SetCancellationWindow(window time.Duration) {
+	d.cancellationWindow = window
+}
+
+// Migrate brings the schema up to date. It fails when the service cannot run
+// on the schema it leaves behind, e.g. when rows refer to unknown logins or
+// withdrawals repeat an order number; other errors are logged.
+func (d *DataBase) Migrate() error {
+	_, err := d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS gophermart_migrations (
+		name VARCHAR PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create gophermart_migrations %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS users (
 		id SERIAL UNIQUE,
 		login VARCHAR UNIQUE NOT NULL,
 		password_hash VARCHAR NOT NULL
@@ -81,7 +176,7 @@ func (d *DataBase) Migrate() {
 
 	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS orders (
 		order_num VARCHAR(255) PRIMARY KEY,
-		login VARCHAR(16) NOT NULL,
+		user_id INT NOT NULL REFERENCES users (id),
 		order_status VARCHAR(16) NOT NULL,
 		accrual FLOAT,
 		date_time TIMESTAMP NOT NULL
@@ -92,7 +187,7 @@ func (d *DataBase) Migrate() {
 
 	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS withdrawals (
 		id serial primary key,
-		login VARCHAR(16) NOT NULL,
+		user_id INT NOT NULL REFERENCES users (id),
 		order_num VARCHAR(255) NOT NULL,
 		accrual FLOAT NOT NULL,
 		created_at TIMESTAMP NOT NULL
@@ -100,10 +195,288 @@ func (d *DataBase) Migrate() {
 	if err != nil {
 		log.Printf("error during create withdrawals %s", err)
 	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS order_outbox (
+		order_num VARCHAR(255) PRIMARY KEY,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create order_outbox %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE order_outbox
+		ADD COLUMN IF NOT EXISTS locked_by VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;`)
+	if err != nil {
+		log.Printf("error during alter order_outbox %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE order_outbox ADD COLUMN IF NOT EXISTS watch_until TIMESTAMP;`)
+	if err != nil {
+		log.Printf("error during alter order_outbox %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE INDEX IF NOT EXISTS order_outbox_next_attempt_at_idx ON order_outbox (next_attempt_at);`)
+	if err != nil {
+		log.Printf("error during create order_outbox index %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS order_events (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users (id),
+		order_num VARCHAR(255) NOT NULL,
+		order_status VARCHAR(16) NOT NULL,
+		accrual FLOAT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create order_events %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE order_events ADD COLUMN IF NOT EXISTS previous_status VARCHAR(16) NOT NULL DEFAULT '';`)
+	if err != nil {
+		log.Printf("error during alter order_events %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS point_lots (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users (id),
+		order_num VARCHAR(255) UNIQUE,
+		amount FLOAT NOT NULL,
+		remaining FLOAT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP
+	);`)
+	if err != nil {
+		log.Printf("error during create point_lots %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE INDEX IF NOT EXISTS point_lots_expires_at_idx ON point_lots (expires_at) WHERE remaining > 0;`)
+	if err != nil {
+		log.Printf("error during create point_lots index %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS point_expirations (
+		id BIGSERIAL PRIMARY KEY,
+		lot_id BIGINT NOT NULL REFERENCES point_lots (id),
+		user_id INT NOT NULL REFERENCES users (id),
+		order_num VARCHAR(255) NOT NULL,
+		amount FLOAT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		expired_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create point_expirations %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE withdrawals
+		ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'COMPLETED',
+		ADD COLUMN IF NOT EXISTS reversed_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS reversal_reason VARCHAR(255) NOT NULL DEFAULT '';`)
+	if err != nil {
+		log.Printf("error during alter withdrawals %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS withdrawal_reversals (
+		withdrawal_id INT PRIMARY KEY REFERENCES withdrawals (id),
+		user_id INT NOT NULL REFERENCES users (id),
+		amount FLOAT NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		actor VARCHAR NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create withdrawal_reversals %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE withdrawal_reversals ALTER COLUMN actor TYPE VARCHAR;`)
+	if err != nil {
+		log.Printf("error during alter withdrawal_reversals %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE point_lots ADD COLUMN IF NOT EXISTS withdrawal_id INT REFERENCES withdrawals (id);`)
+	if err != nil {
+		log.Printf("error during alter point_lots %s", err)
+	}
+
+	// A reversed withdrawal is credited back as one lot per lot it was paid
+	// from, so withdrawal_id is no longer unique.
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE point_lots DROP CONSTRAINT IF EXISTS point_lots_withdrawal_id_key;`)
+	if err != nil {
+		log.Printf("error during alter point_lots %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS withdrawal_lots (
+		withdrawal_id INT NOT NULL REFERENCES withdrawals (id),
+		lot_id BIGINT NOT NULL REFERENCES point_lots (id),
+		amount FLOAT NOT NULL,
+		expires_at TIMESTAMP,
+		PRIMARY KEY (withdrawal_id, lot_id)
+	);`)
+	if err != nil {
+		log.Printf("error during create withdrawal_lots %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS point_debts (
+		user_id INT PRIMARY KEY REFERENCES users (id),
+		amount FLOAT NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create point_debts %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS transfers (
+		id BIGSERIAL PRIMARY KEY,
+		sender_id INT NOT NULL REFERENCES users (id),
+		recipient_id INT NOT NULL REFERENCES users (id),
+		amount FLOAT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		log.Printf("error during create transfers %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `ALTER TABLE point_lots ADD COLUMN IF NOT EXISTS transfer_id BIGINT REFERENCES transfers (id);`)
+	if err != nil {
+		log.Printf("error during alter point_lots %s", err)
+	}
+
+	// Tables created before users were referenced by id keep the login; it is
+	// replaced with the user's id. Rows of unknown users stop the conversion
+	// of their table and must be resolved by hand.
+	for _, ref := range []struct {
+		table, loginColumn, idColumn string
+		after                        []string
+	}{
+		{table: "orders", loginColumn: "login", idColumn: "user_id"},
+		{table: "withdrawals", loginColumn: "login", idColumn: "user_id"},
+		{table: "order_events", loginColumn: "login", idColumn: "user_id"},
+		{table: "point_lots", loginColumn: "login", idColumn: "user_id"},
+		{table: "point_expirations", loginColumn: "login", idColumn: "user_id"},
+		{table: "withdrawal_reversals", loginColumn: "login", idColumn: "user_id"},
+		{table: "point_debts", loginColumn: "login", idColumn: "user_id", after: []string{`ALTER TABLE point_debts ADD PRIMARY KEY (user_id)`}},
+		{table: "transfers", loginColumn: "sender", idColumn: "sender_id"},
+		{table: "transfers", loginColumn: "recipient", idColumn: "recipient_id"},
+	} {
+		if err = d.referenceUsers(ref.table, ref.loginColumn, ref.idColumn, ref.after...); err != nil {
+			return fmt.Errorf("cannot convert %s.%s to %s, rows with unknown logins must be resolved by hand: %w", ref.table, ref.loginColumn, ref.idColumn, err)
+		}
+	}
+
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id, date_time);`,
+		`CREATE INDEX IF NOT EXISTS orders_order_status_idx ON orders (order_status);`,
+		`CREATE INDEX IF NOT EXISTS withdrawals_user_id_idx ON withdrawals (user_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS order_events_user_id_idx ON order_events (user_id, id);`,
+		`CREATE INDEX IF NOT EXISTS point_lots_user_id_idx ON point_lots (user_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS point_expirations_user_id_idx ON point_expirations (user_id, id);`,
+		`CREATE INDEX IF NOT EXISTS withdrawal_reversals_user_id_idx ON withdrawal_reversals (user_id);`,
+		`CREATE INDEX IF NOT EXISTS transfers_sender_id_idx ON transfers (sender_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS transfers_recipient_id_idx ON transfers (recipient_id, created_at);`,
+	} {
+		if _, err = d.db.ExecContext(d.ctx, index); err != nil {
+			log.Printf("error during create index %s", err)
+		}
+	}
+
+	// Balances accrued before lots existed are carried over as a single lot
+	// per user that never expires.
+	_, err = d.db.ExecContext(d.ctx, `INSERT INTO point_lots (user_id, amount, remaining, created_at)
+		SELECT id, balance, balance, NOW() FROM (
+			SELECT u.id,
+				COALESCE((SELECT SUM(accrual) FROM orders o WHERE o.user_id = u.id AND o.order_status = 'PROCESSED'), 0) -
+				COALESCE((SELECT SUM(accrual) FROM withdrawals w WHERE w.user_id = u.id AND w.status <> 'REVERSED'), 0) AS balance
+			FROM users u
+			WHERE NOT EXISTS (SELECT 1 FROM point_lots l WHERE l.user_id = u.id)
+		) legacy
+		WHERE balance > 0;`)
+	if err != nil {
+		log.Printf("error during fill point_lots %s", err)
+	}
+
+	// Withdrawals are charged once per order number, which SaveWithdrawal
+	// relies on, so the service does not start while duplicates remain.
+	if err = d.dedupeWithdrawals(); err != nil {
+		return fmt.Errorf("cannot make withdrawal order numbers unique, duplicate withdrawals must be resolved by hand: %w", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `INSERT INTO order_outbox (order_num, attempts, next_attempt_at, created_at)
+		SELECT order_num, 0, NOW(), NOW() FROM orders WHERE order_status IN ('NEW', 'PROCESSING')
+		ON CONFLICT (order_num) DO NOTHING;`)
+	if err != nil {
+		log.Printf("error during fill order_outbox %s", err)
+	}
+
+	// Timestamps are written in UTC, so the plain date is the UTC day. Views
+	// created before that are replaced.
+	if err = d.migrateOnce("daily_report_utc_days", `DROP MATERIALIZED VIEW IF EXISTS daily_report`); err != nil {
+		log.Printf("error during drop daily_report %s", err)
+	}
+
+	_, err = d.db.ExecContext(d.ctx, `CREATE MATERIALIZED VIEW IF NOT EXISTS daily_report AS
+		WITH uploaded AS (
+			SELECT date_time::date AS day, COUNT(*) AS orders, COUNT(*) FILTER (WHERE order_status = 'INVALID') AS invalid
+			FROM orders GROUP BY 1
+		), issued AS (
+			SELECT created_at::date AS day, COUNT(*) AS orders, SUM(accrual) AS points
+			FROM order_events WHERE order_status = 'PROCESSED' GROUP BY 1
+		), redeemed AS (
+			SELECT created_at::date AS day, SUM(accrual) AS points
+			FROM withdrawals WHERE status <> 'REVERSED' GROUP BY 1
+		), active AS (
+			SELECT day, COUNT(DISTINCT user_id) AS users FROM (
+				SELECT date_time::date AS day, user_id FROM orders
+				UNION ALL
+				SELECT created_at::date, user_id FROM withdrawals
+			) activity GROUP BY 1
+		), days AS (
+			SELECT day FROM uploaded UNION SELECT day FROM issued UNION SELECT day FROM redeemed
+		)
+		SELECT days.day,
+			COALESCE(issued.points, 0) AS points_issued,
+			COALESCE(redeemed.points, 0) AS points_redeemed,
+			COALESCE(active.users, 0) AS active_users,
+			COALESCE(uploaded.orders, 0) AS orders_uploaded,
+			COALESCE(issued.orders, 0) AS orders_processed,
+			COALESCE(uploaded.invalid, 0) AS orders_invalid
+		FROM days
+		LEFT JOIN uploaded ON uploaded.day = days.day
+		LEFT JOIN issued ON issued.day = days.day
+		LEFT JOIN redeemed ON redeemed.day = days.day
+		LEFT JOIN active ON active.day = days.day;`)
+	if err != nil {
+		log.Printf("error during create daily_report %s", err)
+	}
+
+	// REFRESH ... CONCURRENTLY needs a unique index on the view.
+	_, err = d.db.ExecContext(d.ctx, `CREATE UNIQUE INDEX IF NOT EXISTS daily_report_day_idx ON daily_report (day);`)
+	if err != nil {
+		log.Printf("error during create daily_report index %s", err)
+	}
+	return nil
 }
 
-func (d *DataBase) UpgradeOrderStatus(body []byte, orderNum string) error {
-	var o types.Order
+// dedupeWithdrawals keeps the earliest withdrawal of every order number and
+// moves the later ones to withdrawal_duplicates, refunding those that were
+// not reversed as a lot that never expires. It runs after balances have been
+// carried over to lots, so the refund is not counted twice. A duplicate that
+// has been reversed or paid from recorded lots is referenced elsewhere and
+// stops the whole cleanup.
+func (d *DataBase) dedupeWithdrawals() error {
+	_, err := d.db.ExecContext(d.ctx, `CREATE TABLE IF NOT EXISTS withdrawal_duplicates (
+		id INT PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users (id),
+		order_num VARCHAR(255) NOT NULL,
+		accrual FLOAT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		removed_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
 
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
@@ -112,115 +485,607 @@ func (d *DataBase) UpgradeOrderStatus(body []byte, orderNum string) error {
 
 	defer tx.Rollback()
 
-	updateOrderStatusToProcessingStmt, err := tx.PrepareContext(d.ctx, updateOrderStatusToProcessingStmt)
+	const duplicates = `SELECT id FROM withdrawals w WHERE EXISTS (
+		SELECT 1 FROM withdrawals e WHERE e.order_num = w.order_num AND e.id < w.id)`
+	for _, stmt := range []string{
+		`INSERT INTO withdrawal_duplicates (id, user_id, order_num, accrual, status, created_at, removed_at)
+			SELECT id, user_id, order_num, accrual, status, created_at, NOW() FROM withdrawals
+			WHERE id IN (` + duplicates + `)`,
+		`INSERT INTO point_lots (user_id, amount, remaining, created_at)
+			SELECT user_id, accrual, accrual, NOW() FROM withdrawals
+			WHERE id IN (` + duplicates + `) AND status <> 'REVERSED'`,
+		`DELETE FROM withdrawals WHERE id IN (` + duplicates + `)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS withdrawals_order_num_key ON withdrawals (order_num)`,
+	} {
+		if _, err = tx.ExecContext(d.ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateOnce runs stmts in one transaction unless the step called name was
+// applied before, for changes that IF NOT EXISTS cannot tell apart.
+func (d *DataBase) migrateOnce(name string, stmts ...string) error {
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	updateOrderStatusToInvalidStmt, err := tx.PrepareContext(d.ctx, updateOrderStatusToInvalidStmt)
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(d.ctx, insertMigrationStmt, name, time.Now().UTC())
 	if err != nil {
 		return err
 	}
+	applied, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if applied == 0 {
+		return nil
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(d.ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
-	updateOrderStatusToProcessedStmt, err := tx.PrepareContext(d.ctx, updateOrderStatusToProcessedStmt)
+// referenceUsers replaces loginColumn of table with idColumn referencing
+// users (id) and runs after once the column is replaced. It does nothing if
+// loginColumn is already gone. daily_report depends on the login columns, so
+// it is dropped here and created again at the end of Migrate.
+func (d *DataBase) referenceUsers(table, loginColumn, idColumn string, after ...string) error {
+	var exists bool
+	if err := d.db.QueryRowContext(d.ctx, selectColumnExistsStmt, table, loginColumn).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	updateOrderStatusToUnknownStmt, err := tx.PrepareContext(d.ctx, updateOrderStatusToUnknownStmt)
+	defer tx.Rollback()
+
+	stmts := append([]string{
+		`DROP MATERIALIZED VIEW IF EXISTS daily_report`,
+		fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s INT REFERENCES users (id)`, table, idColumn),
+		fmt.Sprintf(`UPDATE %[1]s SET %[2]s = users.id FROM users WHERE users.login = %[1]s.%[3]s`, table, idColumn, loginColumn),
+		fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s SET NOT NULL`, table, idColumn),
+		fmt.Sprintf(`ALTER TABLE %s DROP COLUMN %s`, table, loginColumn),
+	}, after...)
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(d.ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *DataBase) UpgradeOrderStatus(o accrualclient.Order) error {
+	var (
+		userID  int
+		status  string
+		accrual float64
+	)
+
+	to, err := orderstate.FromAccrual(o.Status)
 	if err != nil {
 		return err
 	}
-	defer updateOrderStatusToInvalidStmt.Close()
-	defer updateOrderStatusToProcessingStmt.Close()
-	defer updateOrderStatusToProcessedStmt.Close()
-	defer updateOrderStatusToUnknownStmt.Close()
 
-	err = json.Unmarshal(body, &o)
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		log.Println("failed to unmarshal json from response body from accrual system:", err)
-		return fmt.Errorf("failed to unmarshal json from response body from accrual system: %w", err)
+		return err
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(d.ctx, selectOrderForUpdateStmt, o.Number).Scan(&userID, &status, &accrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
 	}
-	switch o.Status {
-	case "PROCESSING":
-		_, err = updateOrderStatusToProcessingStmt.Exec(orderNum)
-	case "REGISTERED":
-		_, err = updateOrderStatusToProcessingStmt.Exec(orderNum)
-	case "INVALID":
-		_, err = updateOrderStatusToInvalidStmt.Exec(orderNum)
-	case "PROCESSED":
-		_, err = updateOrderStatusToProcessedStmt.Exec(o.Accrual, orderNum)
-	default:
-		_, err = updateOrderStatusToProcessedStmt.Exec(o.Accrual, orderNum)
+	if err != nil {
+		return fmt.Errorf("error selecting order from db: %w", err)
 	}
+
+	from, err := orderstate.Parse(status)
 	if err != nil {
-		log.Println("error updating orders status to db:", err)
-		return fmt.Errorf("error inserting data to db: %w", err)
+		return err
+	}
+	if err = orderstate.Transition(from, to); err != nil {
+		return err
+	}
+
+	if from != to {
+		now := time.Now().UTC()
+		if to == orderstate.Processed {
+			accrual = o.Accrual
+			source := lotSource{orderNum: sql.NullString{String: o.Number, Valid: true}}
+			if err = d.insertLot(tx, userID, source, accrual, now, d.lotExpiry(now)); err != nil {
+				return err
+			}
+		}
+		if from == orderstate.Processed && to == orderstate.Cancelled {
+			if err = d.clawBack(tx, userID, o.Number, accrual, now); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.ExecContext(d.ctx, updateOrderStatusStmt, to, accrual, o.Number); err != nil {
+			log.Println("error updating orders status to db:", err)
+			return fmt.Errorf("error inserting data to db: %w", err)
+		}
+		if _, err = tx.ExecContext(d.ctx, insertOrderEventStmt, userID, o.Number, from, to, accrual, now); err != nil {
+			return fmt.Errorf("error inserting order event: %w", err)
+		}
+	}
+	switch {
+	case to == orderstate.Processed && from != to && d.cancellationWindow > 0:
+		if _, err = tx.ExecContext(d.ctx, watchOutboxStmt, time.Now().UTC().Add(d.cancellationWindow), o.Number); err != nil {
+			return fmt.Errorf("error updating order in outbox: %w", err)
+		}
+	case to == orderstate.Processed:
+		if _, err = tx.ExecContext(d.ctx, deleteWatchedOutboxStmt, o.Number, time.Now().UTC()); err != nil {
+			return fmt.Errorf("error deleting order from outbox: %w", err)
+		}
+	case to.Terminal():
+		if _, err = tx.ExecContext(d.ctx, deleteOutboxStmt, o.Number); err != nil {
+			return fmt.Errorf("error deleting order from outbox: %w", err)
+		}
 	}
 	return tx.Commit()
 }
 
-func (d *DataBase) GetBalance(authUserLogin string) (float64, float64, error) {
-	var order, withdrawn float64
+// lotSource is what credited a lot: a processed order, a reversed withdrawal
+// or a transfer.
+type lotSource struct {
+	orderNum     sql.NullString
+	withdrawalID sql.NullInt64
+	transferID   sql.NullInt64
+}
+
+// insertLot credits points to the user, paying off any clawback debt first.
+func (d *DataBase) insertLot(tx *sql.Tx, userID int, source lotSource, amount float64, now time.Time, expiresAt sql.NullTime) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	var debt float64
+	err := tx.QueryRowContext(d.ctx, selectPointDebtForUpdateStmt, userID).Scan(&debt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error selecting point debt: %w", err)
+	}
+	remaining := amount
+	if debt > 0 {
+		paid := math.Min(debt, amount)
+		if _, err = tx.ExecContext(d.ctx, updatePointDebtStmt, Round(debt-paid, 0.01), userID); err != nil {
+			return fmt.Errorf("error updating point debt: %w", err)
+		}
+		remaining = Round(amount-paid, 0.01)
+	}
+
+	_, err = tx.ExecContext(d.ctx, insertPointLotStmt, userID, source.orderNum, source.withdrawalID, source.transferID, amount, remaining, now, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error inserting point lot: %w", err)
+	}
+	return nil
+}
+
+// clawBack takes back the points of a cancelled order: from the order's own
+// lot first, then from the oldest lots. Whatever the user has already spent
+// becomes a debt that later accruals pay off.
+func (d *DataBase) clawBack(tx *sql.Tx, userID int, orderNum string, amount float64, now time.Time) error {
+	lots, _, err := d.lockLots(tx, userID, orderNum, now)
+	if err != nil {
+		return err
+	}
+	_, left, err := d.drainLots(tx, lots, amount)
+	if err != nil {
+		return err
+	}
+	if left = Round(left, 0.01); left > 0 {
+		if _, err = tx.ExecContext(d.ctx, addPointDebtStmt, userID, left); err != nil {
+			return fmt.Errorf("error adding point debt: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *DataBase) lotExpiry(now time.Time) sql.NullTime {
+	if d.expiryMonths <= 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: now.AddDate(0, d.expiryMonths, 0), Valid: true}
+}
+
+func (d *DataBase) GetBalance(authUserID int) (float64, float64, error) {
+	var balance, withdrawn float64
 
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		return order, withdrawn, err
+		return balance, withdrawn, err
 	}
 
 	defer tx.Rollback()
 
-	selectAccrualBalanceOrdersStmt, err := tx.PrepareContext(d.ctx, selectAccrualBalanceOrdersStmt)
+	selectUnexpiredLotsBalanceStmt, err := tx.PrepareContext(d.ctx, selectUnexpiredLotsBalanceStmt)
 	if err != nil {
-		return order, withdrawn, err
+		return balance, withdrawn, err
 	}
 
-	defer selectAccrualBalanceOrdersStmt.Close()
+	defer selectUnexpiredLotsBalanceStmt.Close()
 
-	err = selectAccrualBalanceOrdersStmt.QueryRow(authUserLogin).Scan(&order)
+	err = selectUnexpiredLotsBalanceStmt.QueryRow(authUserID, time.Now().UTC()).Scan(&balance)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot select balance from point lots: %w", err)
+	}
+	var debt float64
+	err = tx.QueryRowContext(d.ctx, selectPointDebtStmt, authUserID).Scan(&debt)
 	if err != nil {
-		return 0, 0, fmt.Errorf("cannot select accrual sum from order database: %w", err)
+		return 0, 0, fmt.Errorf("cannot select point debt: %w", err)
 	}
-	order = Round(order, 0.01)
+	balance = Round(balance-debt, 0.01)
 	selectAccrualWithdrawnStmt, err := tx.PrepareContext(d.ctx, selectAccrualWithdrawnStmt)
 	if err != nil {
-		return order, withdrawn, err
+		return balance, withdrawn, err
 	}
 
 	defer selectAccrualWithdrawnStmt.Close()
 
-	err = selectAccrualWithdrawnStmt.QueryRow(authUserLogin).Scan(&withdrawn)
+	err = selectAccrualWithdrawnStmt.QueryRow(authUserID).Scan(&withdrawn)
 	if err != nil {
 		return 0, 0, fmt.Errorf("cannot select accrual sum from withdrawals database: %w", err)
 	}
-	balance := order - withdrawn
 
 	return balance, withdrawn, nil
 }
 
-func (d *DataBase) SaveWithdrawal(w types.Withdrawal, authUserLogin string) error {
+func (d *DataBase) GetExpiringPoints(authUserID int, before time.Time) (float64, error) {
+	before = before.UTC()
+	var expiring float64
+	err := d.db.QueryRowContext(d.ctx, selectExpiringPointsStmt, authUserID, time.Now().UTC(), before).Scan(&expiring)
+	if err != nil {
+		return 0, fmt.Errorf("GetExpiringPoints: error while selecting data from database: %w", err)
+	}
+	return Round(expiring, 0.01), nil
+}
+
+// GetDailyReport reads the daily_report materialized view, which is only as
+// fresh as the last RefreshReports.
+func (d *DataBase) GetDailyReport(from, to time.Time) ([]types.DailyReport, error) {
+	rows, err := d.db.QueryContext(d.ctx, selectDailyReportStmt, from.Format(types.DayLayout), to.Format(types.DayLayout))
+	if err != nil {
+		return nil, fmt.Errorf("GetDailyReport: error while selecting data from database: %w", err)
+	}
+	defer rows.Close()
+
+	report := []types.DailyReport{}
+	for rows.Next() {
+		var (
+			r   types.DailyReport
+			day time.Time
+		)
+		err = rows.Scan(&day, &r.PointsIssued, &r.PointsRedeemed, &r.ActiveUsers, &r.OrdersUploaded, &r.OrdersProcessed, &r.OrdersInvalid)
+		if err != nil {
+			return nil, fmt.Errorf("GetDailyReport: error while scanning rows: %w", err)
+		}
+		r.Day = day.Format(types.DayLayout)
+		r.PointsIssued = Round(r.PointsIssued, 0.01)
+		r.PointsRedeemed = Round(r.PointsRedeemed, 0.01)
+		report = append(report, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetDailyReport: rows.Err: %w", err)
+	}
+	return report, nil
+}
+
+func (d *DataBase) RefreshReports() error {
+	if _, err := d.db.ExecContext(d.ctx, refreshDailyReportStmt); err != nil {
+		return fmt.Errorf("RefreshReports: %w", err)
+	}
+	return nil
+}
+
+func (d *DataBase) ExpirePoints(now time.Time, limit int) ([]types.PointExpiration, error) {
+	now = now.UTC()
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer tx.Rollback()
 
-	insertWirdrawalStmt, err := tx.PrepareContext(d.ctx, insertWirdrawalStmt)
+	rows, err := tx.QueryContext(d.ctx, selectExpiredLotsStmt, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ExpirePoints: error while selecting expired lots: %w", err)
+	}
+	var (
+		lots        []int64
+		expirations []types.PointExpiration
+	)
+	for rows.Next() {
+		var (
+			lotID int64
+			e     types.PointExpiration
+		)
+		if err = rows.Scan(&lotID, &e.UserID, &e.OrderNum, &e.Amount, &e.ExpiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ExpirePoints: error while scanning rows: %w", err)
+		}
+		e.ExpiredAt = now
+		lots = append(lots, lotID)
+		expirations = append(expirations, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("ExpirePoints: rows.Err: %w", err)
+	}
+
+	for i, lotID := range lots {
+		e := &expirations[i]
+		if _, err = tx.ExecContext(d.ctx, updateLotRemainingStmt, 0, lotID); err != nil {
+			return nil, fmt.Errorf("ExpirePoints: error while updating lot: %w", err)
+		}
+		err = tx.QueryRowContext(d.ctx, insertPointExpirationStmt, lotID, e.UserID, e.OrderNum, e.Amount, e.ExpiresAt, e.ExpiredAt).Scan(&e.ID)
+		if err != nil {
+			return nil, fmt.Errorf("ExpirePoints: error while inserting expiration: %w", err)
+		}
+	}
+
+	return expirations, tx.Commit()
+}
+
+func (d *DataBase) GetPointExpirations(authUserID int) ([]types.PointExpiration, error) {
+	rows, err := d.db.QueryContext(d.ctx, selectPointExpirationsStmt, authUserID)
+	if err != nil {
+		return nil, fmt.Errorf("GetPointExpirations: error while selecting data from database: %w", err)
+	}
+	defer rows.Close()
+
+	var expirations []types.PointExpiration
+	for rows.Next() {
+		e := types.PointExpiration{UserID: authUserID}
+		if err = rows.Scan(&e.ID, &e.OrderNum, &e.Amount, &e.ExpiresAt, &e.ExpiredAt); err != nil {
+			return nil, fmt.Errorf("GetPointExpirations: error while scanning rows: %w", err)
+		}
+		expirations = append(expirations, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetPointExpirations: rows.Err: %w", err)
+	}
+
+	return expirations, nil
+}
+
+// SaveWithdrawal charges the user once per order number. Replaying the same
+// withdrawal succeeds without charging again, even after it was reversed:
+// the order number stays used and withdrawing again takes a new one. Reusing
+// the order number with another user or sum returns ErrWithdrawalConflict.
+func (d *DataBase) SaveWithdrawal(w types.Withdrawal, authUserID int) error {
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	defer insertWirdrawalStmt.Close()
+	defer tx.Rollback()
 
-	_, err = insertWirdrawalStmt.Exec(authUserLogin, w.OrderNum, w.Accrual, time.Now().Format(time.RFC3339))
+	now := time.Now().UTC()
+	var id int64
+	err = tx.QueryRowContext(d.ctx, insertWirdrawalStmt, authUserID, w.OrderNum, w.Accrual, now).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		var (
+			userID  int
+			accrual float64
+		)
+		if err = tx.QueryRowContext(d.ctx, selectWithdrawalOwnerStmt, w.OrderNum).Scan(&userID, &accrual); err != nil {
+			return fmt.Errorf("error while getting existing withdrawal: %w", err)
+		}
+		if userID != authUserID || Round(accrual, 0.01) != Round(w.Accrual, 0.01) {
+			return errs.ErrWithdrawalConflict
+		}
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("PostWithdrawalHandler: error while insert data into database: %w", err)
 	}
+
+	taken, err := d.spendLots(tx, authUserID, w.Accrual, now)
+	if err != nil {
+		return err
+	}
+	for _, l := range taken {
+		if _, err = tx.ExecContext(d.ctx, insertWithdrawalLotStmt, id, l.id, l.remaining, l.expiresAt); err != nil {
+			return fmt.Errorf("PostWithdrawalHandler: error while inserting withdrawal lot: %w", err)
+		}
+	}
 	return tx.Commit()
 }
 
-func (d *DataBase) GetWithdrawalsByUser(authUserLogin string) ([]types.Withdrawal, bool, error) {
+type pointLot struct {
+	id        int64
+	remaining float64
+	expiresAt sql.NullTime
+}
+
+// spendLots takes amount from the user's unexpired lots, oldest first, and
+// returns what was taken from each lot.
+func (d *DataBase) spendLots(tx *sql.Tx, userID int, amount float64, now time.Time) ([]pointLot, error) {
+	lots, available, err := d.lockLots(tx, userID, "", now)
+	if err != nil {
+		return nil, err
+	}
+	if Round(available, 0.01) < amount {
+		return nil, errs.ErrInsufficientFunds
+	}
+	taken, _, err := d.drainLots(tx, lots, amount)
+	return taken, err
+}
+
+// lockLots locks the user's unexpired lots in the order they are spent, with
+// the lot of orderNum, if any, first.
+func (d *DataBase) lockLots(tx *sql.Tx, userID int, orderNum string, now time.Time) ([]pointLot, float64, error) {
+	rows, err := tx.QueryContext(d.ctx, selectSpendableLotsStmt, userID, now, orderNum)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while selecting point lots: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		lots      []pointLot
+		available float64
+	)
+	for rows.Next() {
+		var l pointLot
+		if err = rows.Scan(&l.id, &l.remaining, &l.expiresAt); err != nil {
+			return nil, 0, fmt.Errorf("error while scanning point lots: %w", err)
+		}
+		lots = append(lots, l)
+		available += l.remaining
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error while selecting point lots: %w", err)
+	}
+	return lots, available, nil
+}
+
+// drainLots takes up to amount from lots in order. It returns what was
+// taken from each lot and what is left.
+func (d *DataBase) drainLots(tx *sql.Tx, lots []pointLot, amount float64) ([]pointLot, float64, error) {
+	var taken []pointLot
+	for _, l := range lots {
+		if amount <= 0 {
+			break
+		}
+		take := math.Min(l.remaining, amount)
+		if _, err := tx.ExecContext(d.ctx, updateLotRemainingStmt, Round(l.remaining-take, 0.01), l.id); err != nil {
+			return nil, 0, fmt.Errorf("error while updating point lot: %w", err)
+		}
+		amount -= take
+		taken = append(taken, pointLot{id: l.id, remaining: take, expiresAt: l.expiresAt})
+	}
+	return taken, amount, nil
+}
+
+// Transfer moves points between users. The recipient's lots keep the expiry
+// of the sender's lots they were taken from, so passing points back and
+// forth does not extend their life.
+func (d *DataBase) Transfer(t types.Transfer, dailyLimit float64) (types.Transfer, error) {
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return types.Transfer{}, err
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(d.ctx, selectUserLoginStmt, t.ToID).Scan(&t.To)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Transfer{}, errs.ErrRecipientNotFound
+	}
+	if err != nil {
+		return types.Transfer{}, fmt.Errorf("Transfer: error while selecting recipient: %w", err)
+	}
+	if err = tx.QueryRowContext(d.ctx, selectUserLoginStmt, t.FromID).Scan(&t.From); err != nil {
+		return types.Transfer{}, fmt.Errorf("Transfer: error while selecting sender: %w", err)
+	}
+
+	// Locking the sender's lots first serializes concurrent transfers of one
+	// sender, so the daily limit below sees every committed transfer.
+	now := time.Now().UTC()
+	lots, available, err := d.lockLots(tx, t.FromID, "", now)
+	if err != nil {
+		return types.Transfer{}, err
+	}
+	if dailyLimit > 0 {
+		var sent float64
+		if err = tx.QueryRowContext(d.ctx, selectTransferredSinceStmt, t.FromID, now.Add(-24*time.Hour)).Scan(&sent); err != nil {
+			return types.Transfer{}, fmt.Errorf("Transfer: error while selecting sent amount: %w", err)
+		}
+		if Round(sent+t.Amount, 0.01) > dailyLimit {
+			return types.Transfer{}, errs.ErrTransferLimit
+		}
+	}
+	if Round(available, 0.01) < t.Amount {
+		return types.Transfer{}, errs.ErrInsufficientFunds
+	}
+
+	taken, _, err := d.drainLots(tx, lots, t.Amount)
+	if err != nil {
+		return types.Transfer{}, err
+	}
+	if err = tx.QueryRowContext(d.ctx, insertTransferStmt, t.FromID, t.ToID, t.Amount, now).Scan(&t.ID); err != nil {
+		return types.Transfer{}, fmt.Errorf("Transfer: error while inserting transfer: %w", err)
+	}
+	source := lotSource{transferID: sql.NullInt64{Int64: t.ID, Valid: true}}
+	for _, l := range taken {
+		if err = d.insertLot(tx, t.ToID, source, l.remaining, now, l.expiresAt); err != nil {
+			return types.Transfer{}, fmt.Errorf("Transfer: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return types.Transfer{}, err
+	}
+
+	t.CreatedAt = now
+	return t, nil
+}
+
+func (d *DataBase) GetTransactions(authUserID int) ([]types.Transaction, error) {
+	rows, err := d.db.QueryContext(d.ctx, selectTransactionsStmt, authUserID)
+	if err != nil {
+		return nil, fmt.Errorf("GetTransactions: error while selecting data from database: %w", err)
+	}
+	defer rows.Close()
+
+	var transactions []types.Transaction
+	for rows.Next() {
+		var t types.Transaction
+		if err = rows.Scan(&t.Type, &t.Amount, &t.Order, &t.Counterparty, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("GetTransactions: error while scanning rows: %w", err)
+		}
+		transactions = append(transactions, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetTransactions: rows.Err: %w", err)
+	}
+
+	return transactions, nil
+}
+
+// StreamStatement calls fn for every statement entry while reading them
+// from the database cursor. The running balance is computed over the whole
+// history, so entries before from still count towards it.
+func (d *DataBase) StreamStatement(authUserID int, from, to time.Time, fn func(types.StatementEntry) error) error {
+	from, to = from.UTC(), to.UTC()
+	rows, err := d.db.QueryContext(d.ctx, selectStatementStmt, authUserID, from, to)
+	if err != nil {
+		return fmt.Errorf("StreamStatement: error while selecting data from database: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e types.StatementEntry
+		if err = rows.Scan(&e.Type, &e.Amount, &e.Order, &e.Status, &e.Counterparty, &e.CreatedAt, &e.Balance); err != nil {
+			return fmt.Errorf("StreamStatement: error while scanning rows: %w", err)
+		}
+		e.Balance = Round(e.Balance, 0.01)
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("StreamStatement: rows.Err: %w", err)
+	}
+	return nil
+}
+
+func (d *DataBase) GetWithdrawalsByUser(authUserID int) ([]types.Withdrawal, bool, error) {
 	var w []types.Withdrawal
 
 	tx, err := d.db.BeginTx(d.ctx, nil)
@@ -237,14 +1102,14 @@ func (d *DataBase) GetWithdrawalsByUser(authUserLogin string) ([]types.Withdrawa
 
 	defer selectWithdrawalsByUserStmt.Close()
 
-	rows, err := selectWithdrawalsByUserStmt.QueryContext(d.ctx, authUserLogin)
+	rows, err := selectWithdrawalsByUserStmt.QueryContext(d.ctx, authUserID)
 	if err != nil {
 		log.Println("error while selecting withdrawals from database:", err)
 		return nil, false, fmt.Errorf("error while selecting withdrawals from database: %w", err)
 	}
 	for rows.Next() {
-		var withdrawal types.Withdrawal
-		err = rows.Scan(&withdrawal.OrderNum, &withdrawal.Accrual, &withdrawal.ProcessedAt)
+		withdrawal := types.Withdrawal{UserID: authUserID}
+		err = scanWithdrawal(rows, &withdrawal)
 		if err != nil {
 			log.Println("error while scanning data:", err)
 			return nil, false, fmt.Errorf("error while scanning data: %w", err)
@@ -261,55 +1126,176 @@ func (d *DataBase) GetWithdrawalsByUser(authUserLogin string) ([]types.Withdrawa
 	return w, true, nil
 }
 
-func (d *DataBase) CheckOrders(accrualSysClient types.Client) {
-	ticker := time.NewTicker(checkOrderInterval)
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWithdrawal(row scanner, w *types.Withdrawal, dest ...any) error {
+	var reversedAt sql.NullTime
+	dest = append(dest, &w.ID, &w.OrderNum, &w.Accrual, &w.Status, &w.ProcessedAt, &reversedAt, &w.Reason)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	w.ReversedAt = nil
+	if reversedAt.Valid {
+		w.ReversedAt = &reversedAt.Time
+	}
+	return nil
+}
+
+func (d *DataBase) GetWithdrawalByOrder(orderNum string) (types.Withdrawal, bool, error) {
+	var w types.Withdrawal
+	err := scanWithdrawal(d.db.QueryRowContext(d.ctx, selectWithdrawalByOrderStmt, orderNum), &w)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Withdrawal{}, false, nil
+	}
+	if err != nil {
+		return types.Withdrawal{}, false, fmt.Errorf("GetWithdrawalByOrder: error while selecting data from database: %w", err)
+	}
+	return w, true, nil
+}
+
+// ReverseWithdrawal marks the withdrawal reversed, records who reversed it
+// and credits its sum back with the expiry of the lots it was paid from.
+// Whatever no recorded lot covers, as for withdrawals made before lots were
+// recorded, gets the expiry of newly accrued points. Reversing an already
+// reversed withdrawal changes nothing.
+func (d *DataBase) ReverseWithdrawal(id int64, reason string, actor string) (types.Withdrawal, error) {
+	var w types.Withdrawal
 
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		log.Printf("error in checkorder func: %s", err)
+		return w, err
 	}
 
 	defer tx.Rollback()
 
-	selectNotProcessedOrdersStmt, err := tx.PrepareContext(d.ctx, selectNotProcessedOrdersStmt) // ОШИБКА ЗДЕСЬ
+	err = scanWithdrawal(tx.QueryRowContext(d.ctx, selectWithdrawalForUpdateStmt, id), &w, &w.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return w, errs.ErrWithdrawalNotFound
+	}
 	if err != nil {
-		log.Printf("error in checkorder func2: %s", err)
+		return w, fmt.Errorf("ReverseWithdrawal: error while selecting withdrawal: %w", err)
+	}
+	if w.Status == types.WithdrawalReversed {
+		return w, nil
 	}
 
-	defer selectNotProcessedOrdersStmt.Close()
+	now := time.Now().UTC()
+	if _, err = tx.ExecContext(d.ctx, updateWithdrawalReversedStmt, now, reason, id); err != nil {
+		return w, fmt.Errorf("ReverseWithdrawal: error while updating withdrawal: %w", err)
+	}
+	if _, err = tx.ExecContext(d.ctx, insertWithdrawalReversalStmt, id, w.UserID, w.Accrual, reason, actor, now); err != nil {
+		return w, fmt.Errorf("ReverseWithdrawal: error while inserting reversal: %w", err)
+	}
+	spent, err := d.withdrawalLots(tx, id)
+	if err != nil {
+		return w, fmt.Errorf("ReverseWithdrawal: %w", err)
+	}
+	source := lotSource{withdrawalID: sql.NullInt64{Int64: id, Valid: true}}
+	uncovered := w.Accrual
+	for _, l := range spent {
+		if err = d.insertLot(tx, w.UserID, source, l.remaining, now, l.expiresAt); err != nil {
+			return w, fmt.Errorf("ReverseWithdrawal: %w", err)
+		}
+		uncovered -= l.remaining
+	}
+	if uncovered = Round(uncovered, 0.01); uncovered > 0 {
+		if err = d.insertLot(tx, w.UserID, source, uncovered, now, d.lotExpiry(now)); err != nil {
+			return w, fmt.Errorf("ReverseWithdrawal: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return w, err
+	}
 
-	for {
-		<-ticker.C
-		rows, err := selectNotProcessedOrdersStmt.Query()
-		if errors.Is(err, sql.ErrNoRows) {
-			return
+	w.Status = types.WithdrawalReversed
+	w.ReversedAt = &now
+	w.Reason = reason
+	return w, nil
+}
+
+// withdrawalLots returns what the withdrawal took from each lot.
+func (d *DataBase) withdrawalLots(tx *sql.Tx, withdrawalID int64) ([]pointLot, error) {
+	rows, err := tx.QueryContext(d.ctx, selectWithdrawalLotsStmt, withdrawalID)
+	if err != nil {
+		return nil, fmt.Errorf("error while selecting withdrawal lots: %w", err)
+	}
+	defer rows.Close()
+
+	var lots []pointLot
+	for rows.Next() {
+		var l pointLot
+		if err = rows.Scan(&l.id, &l.remaining, &l.expiresAt); err != nil {
+			return nil, fmt.Errorf("error while scanning withdrawal lots: %w", err)
 		}
-		if err != nil {
-			log.Println("CheckOrders: error while selecting data from Database")
-			return
-		}
-		for rows.Next() {
-			var orderNum string
-			rows.Scan(&orderNum)
-			url := accrualSysClient.URL
-			url.Path = path.Join(accrualSysClient.URL.Path, orderNum)
-			resp, err := accrualSysClient.Client.Get(url.String())
-			if err != nil {
-				log.Println("can't get response from accrual system:", err)
-				return
-			}
-			defer resp.Body.Close()
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Println("can't read body of reponsefrom accrual system:", err)
-				return
-			}
-			d.UpgradeOrderStatus(body, orderNum)
+		lots = append(lots, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error while selecting withdrawal lots: %w", err)
+	}
+	return lots, nil
+}
+
+func (d *DataBase) ClaimPendingOrders(worker string, limit int, lease time.Duration) ([]types.PendingOrder, error) {
+	now := time.Now().UTC()
+	rows, err := d.db.QueryContext(d.ctx, claimPendingOrdersStmt, worker, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ClaimPendingOrders: error while claiming orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []types.PendingOrder
+	for rows.Next() {
+		var order types.PendingOrder
+		if err = rows.Scan(&order.Number, &order.Attempts, &order.Processed); err != nil {
+			return nil, fmt.Errorf("ClaimPendingOrders: error while scanning rows: %w", err)
 		}
-		if rows.Err() != nil {
-			log.Println("CheckOrders: error while reading rows")
+		orders = append(orders, order)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("ClaimPendingOrders: rows.Err: %w", err)
+	}
+
+	return orders, nil
+}
+
+func (d *DataBase) GetOrderEvents(authUserID int, afterID int64, limit int) ([]types.OrderEvent, error) {
+	rows, err := d.db.QueryContext(d.ctx, selectOrderEventsStmt, authUserID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("GetOrderEvents: error while selecting data from database: %w", err)
+	}
+	defer rows.Close()
+
+	var events []types.OrderEvent
+	for rows.Next() {
+		event := types.OrderEvent{UserID: authUserID}
+		if err = rows.Scan(&event.ID, &event.Number, &event.PreviousStatus, &event.Status, &event.Accrual, &event.ChangedAt); err != nil {
+			return nil, fmt.Errorf("GetOrderEvents: error while scanning rows: %w", err)
 		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetOrderEvents: rows.Err: %w", err)
+	}
+
+	return events, nil
+}
+
+func (d *DataBase) GetLastOrderEventID(authUserID int) (int64, error) {
+	var id int64
+	if err := d.db.QueryRowContext(d.ctx, selectLastOrderEventStmt, authUserID).Scan(&id); err != nil {
+		return 0, fmt.Errorf("GetLastOrderEventID: error while selecting data from database: %w", err)
+	}
+	return id, nil
+}
+
+func (d *DataBase) RescheduleOrder(orderNum string, delay time.Duration) error {
+	_, err := d.db.ExecContext(d.ctx, rescheduleOutboxStmt, time.Now().UTC().Add(delay), orderNum)
+	if err != nil {
+		return fmt.Errorf("RescheduleOrder: error while updating outbox: %w", err)
 	}
+	return nil
 }
 
 func Round(x, unit float64) float64 {
@@ -317,67 +1303,147 @@ func Round(x, unit float64) float64 {
 }
 
 func (d *DataBase) SaveOrder(order *types.Order) error {
-	_, err := d.db.ExecContext(d.ctx, `INSERT INTO orders (order_num, login, order_status, accrual, date_time) VALUES ($1, $2, $3, $4, $5)`,
-		order.Number, order.User, order.Status, order.Accrual, time.Now())
+	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(d.ctx, `INSERT INTO orders (order_num, user_id, order_status, accrual, date_time) VALUES ($1, $2, $3, $4, $5)`,
+		order.Number, order.UserID, order.Status, order.Accrual, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(d.ctx, insertOutboxStmt, order.Number, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SaveOrders saves the user's orders in one transaction. A number repeated in
+// numbers keeps the result of its first occurrence.
+func (d *DataBase) SaveOrders(userID int, numbers []string) (map[string]types.OrderUploadResult, error) {
+	results := make(map[string]types.OrderUploadResult, len(numbers))
+
+	tx, err := d.db.BeginTx(d.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SaveOrders: error while BeginTx: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	insertOrderIfNotExistsStmt, err := tx.PrepareContext(d.ctx, insertOrderIfNotExistsStmt)
+	if err != nil {
+		return nil, fmt.Errorf("SaveOrders: error while preparing insert statement: %w", err)
+	}
+
+	defer insertOrderIfNotExistsStmt.Close()
+
+	selectUserIDStmt, err := tx.PrepareContext(d.ctx, selectUserIDStmt)
+	if err != nil {
+		return nil, fmt.Errorf("SaveOrders: error while preparing select statement: %w", err)
+	}
+
+	defer selectUserIDStmt.Close()
+
+	insertOutboxStmt, err := tx.PrepareContext(d.ctx, insertOutboxStmt)
+	if err != nil {
+		return nil, fmt.Errorf("SaveOrders: error while preparing outbox statement: %w", err)
+	}
+
+	defer insertOutboxStmt.Close()
+
+	now := time.Now().UTC()
+	for _, number := range numbers {
+		if _, ok := results[number]; ok {
+			continue
+		}
+		res, err := insertOrderIfNotExistsStmt.ExecContext(d.ctx, number, userID, orderstate.New, now)
+		if err != nil {
+			return nil, fmt.Errorf("SaveOrders: error while inserting order %s: %w", number, err)
+		}
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("SaveOrders: error while reading affected rows: %w", err)
+		}
+		if inserted > 0 {
+			if _, err = insertOutboxStmt.ExecContext(d.ctx, number, now); err != nil {
+				return nil, fmt.Errorf("SaveOrders: error while enqueueing order %s: %w", number, err)
+			}
+			results[number] = types.OrderAccepted
+			continue
+		}
+		var orderUser int
+		if err = selectUserIDStmt.QueryRowContext(d.ctx, number).Scan(&orderUser); err != nil {
+			return nil, fmt.Errorf("SaveOrders: error while selecting order owner: %w", err)
+		}
+		if orderUser == userID {
+			results[number] = types.OrderAlreadyUploaded
+		} else {
+			results[number] = types.OrderConflict
+		}
+	}
+
+	return results, tx.Commit()
 }
 
-func (d *DataBase) GetOrderUserByNum(orderNum string) (user string, exists bool, err error) {
+func (d *DataBase) GetOrderUserByNum(orderNum string) (userID int, exists bool, err error) {
 	exists = false
 
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		return user, exists, err
+		return userID, exists, err
 	}
 
 	defer tx.Rollback()
 
 	selectUserIDByOrderNumStmt, err := tx.PrepareContext(d.ctx, selectUserIDByOrderNumStmt)
 	if err != nil {
-		return user, exists, err
+		return userID, exists, err
 	}
 
 	defer selectUserIDByOrderNumStmt.Close()
 
 	row := selectUserIDByOrderNumStmt.QueryRowContext(d.ctx, orderNum)
 
-	err = row.Scan(&user)
+	err = row.Scan(&userID)
 	if !errors.Is(err, sql.ErrNoRows) {
 		exists = true
 	}
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return user, exists, err
+		return userID, exists, err
 	}
 
-	return user, exists, nil
+	return userID, exists, nil
 }
 
-func (d *DataBase) GetOrderUser(orderNum string) (userID string, err error) {
+func (d *DataBase) GetOrderUser(orderNum string) (userID int, err error) {
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
-		return "", ErrInvalidData
+		return 0, err
 	}
 	defer tx.Rollback()
 
 	selectUserIDStmt, err := tx.PrepareContext(d.ctx, selectUserIDStmt)
 	if err != nil {
-		return "", ErrInvalidData
+		return 0, err
 	}
 	defer selectUserIDStmt.Close()
 
 	row := selectUserIDStmt.QueryRowContext(d.ctx, orderNum)
 	err = row.Scan(&userID)
 	if err != nil {
-		return "", ErrInvalidData
+		return 0, err
 	}
 	return userID, nil
 }
 
-func (d *DataBase) GetOrdersByUser(authUserLogin string) ([]types.Order, bool, error) {
+func (d *DataBase) GetOrdersByUser(authUserID int) ([]types.Order, bool, error) {
 	tx, err := d.db.BeginTx(d.ctx, nil)
 	if err != nil {
 		return nil, false, fmt.Errorf("GetOrdersByUser: error while BeginTx: %w", err)
@@ -391,7 +1457,7 @@ func (d *DataBase) GetOrdersByUser(authUserLogin string) ([]types.Order, bool, e
 	}
 
 	defer selectOrdersByUserStmt.Close()
-	rows, err := selectOrdersByUserStmt.Query(authUserLogin)
+	rows, err := selectOrdersByUserStmt.Query(authUserID)
 	if err != nil {
 		return nil, false, fmt.Errorf("GetOrdersByUser: error while selectOrdersByUserStmt.Query: %w", err)
 	}
@@ -399,15 +1465,14 @@ func (d *DataBase) GetOrdersByUser(authUserLogin string) ([]types.Order, bool, e
 	for rows.Next() {
 		var order types.Order
 		var accrual float64
-		err = rows.Scan(&order.Number, &order.User, &order.Status, &accrual, &order.UploadedAt)
+		err = rows.Scan(&order.Number, &order.UserID, &order.Status, &accrual, &order.UploadedAt)
 		if err != nil {
 			return nil, false, fmt.Errorf("GetOrdersByUser: error while scanning rows from database: %w", err)
 		}
 		order.Accrual = Round(accrual, 0.01)
 		orders = append(orders, order)
 	}
-	log.Printf("GetOrdersByUser: ORDERS: %v", orders)
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		return nil, false, fmt.Errorf("GetOrdersByUser: rows.Err() error database: %w", err)
 	}
 	if len(orders) == 0 {
@@ -461,15 +1526,15 @@ func (d *DataBase) RegisterNewUser(login string, password string) (types.User, e
 	row := d.db.QueryRowContext(context.Background(), query, login, password)
 	if err := row.Scan(&user.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return types.User{}, ErrKeyNotFound
+			return types.User{}, errs.ErrKeyNotFound
 		}
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
 			if pgErr.Code == pgerrcode.UniqueViolation {
-				return types.User{}, ErrUserExists
+				return types.User{}, errs.ErrUserExists
 			}
 		}
-		return types.User{}, ErrScanData
+		return types.User{}, errs.Wrap(errs.Internal, errs.ErrScanData.Message, err)
 	}
 
 	return user, nil
@@ -492,7 +1557,7 @@ func (d *DataBase) GetUserData(login string) (types.User, error) {
 
 	row := selectUserStmt.QueryRow(login)
 	err = row.Scan(&user.ID, &user.Login, &user.HashPassword)
-	if errors.Is(err, pgx.ErrNoRows) {
+	if errors.Is(err, sql.ErrNoRows) {
 		return types.User{}, nil
 	}
 
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage/storagetest"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+const testTables = "users, orders, withdrawals, order_outbox, order_events, point_lots, point_expirations, withdrawal_reversals, withdrawal_lots, withdrawal_duplicates, point_debts, transfers"
+
+func TestDataBase(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) types.Storage {
+		return newTestDataBase(t)
+	})
+}
+
+func TestDedupeWithdrawals(t *testing.T) {
+	d := newTestDataBase(t)
+	user, err := d.RegisterNewUser("alice", "hash")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+
+	// Recreate the state of a database that got the same withdrawal twice
+	// before order numbers were unique: 100 points, 40 charged twice.
+	if _, err = d.db.Exec(`DROP INDEX withdrawals_order_num_key`); err != nil {
+		t.Fatalf("drop index: %v", err)
+	}
+	now := time.Now()
+	for _, stmt := range []string{
+		`INSERT INTO point_lots (user_id, amount, remaining, created_at) VALUES ($1, 100, 20, $2)`,
+		`INSERT INTO withdrawals (user_id, order_num, accrual, created_at) VALUES ($1, '2377225624', 40, $2)`,
+		`INSERT INTO withdrawals (user_id, order_num, accrual, created_at) VALUES ($1, '2377225624', 40, $2)`,
+	} {
+		if _, err = d.db.Exec(stmt, user.ID, now); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	if err = d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	withdrawals, _, err := d.GetWithdrawalsByUser(user.ID)
+	if err != nil || len(withdrawals) != 1 || withdrawals[0].ID != 1 {
+		t.Fatalf("GetWithdrawalsByUser: %+v, %v, want only the earliest withdrawal", withdrawals, err)
+	}
+	balance, withdrawn, err := d.GetBalance(user.ID)
+	if err != nil || balance != 60 || withdrawn != 40 {
+		t.Fatalf("GetBalance: balance=%v, withdrawn=%v, err=%v, want the duplicate refunded", balance, withdrawn, err)
+	}
+	var recorded int
+	if err = d.db.QueryRow(`SELECT COUNT(*) FROM withdrawal_duplicates WHERE id = 2`).Scan(&recorded); err != nil || recorded != 1 {
+		t.Fatalf("withdrawal_duplicates: %d, %v, want the removed duplicate recorded", recorded, err)
+	}
+	if err = d.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 40}, user.ID); err != nil {
+		t.Fatalf("SaveWithdrawal replay after dedupe: %v", err)
+	}
+	if balance, _, err = d.GetBalance(user.ID); err != nil || balance != 60 {
+		t.Fatalf("GetBalance after replay: %v, %v, want 60", balance, err)
+	}
+}
+
+func newTestDataBase(t *testing.T) *DataBase {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	d, err := NewDataBase(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("NewDataBase: %v", err)
+	}
+	if err = d.Migrate(); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if _, err = d.db.Exec("TRUNCATE " + testTables + " RESTART IDENTITY"); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	t.Cleanup(d.Close)
+	return d
+}
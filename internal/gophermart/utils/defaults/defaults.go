@@ -0,0 +1,23 @@
+package defaults
+
+import "time"
+
+// Defaults of the gophermart settings. The packages fall back to them and
+// config offers them as flag defaults, so both always agree.
+const (
+	AccrualTimeout          = 5 * time.Second
+	AccrualFailureThreshold = 5
+	AccrualCoolDown         = 30 * time.Second
+
+	ReconcileInterval         = 5 * time.Second
+	ReconcileMaxBackoff       = time.Minute
+	CancellationCheckInterval = time.Hour
+
+	ExpiryInterval     = time.Hour
+	ExpiringSoonWindow = 30 * 24 * time.Hour
+
+	TransferMinAmount  = 1
+	TransferDailyLimit = 10000
+
+	ReportRefreshInterval = 15 * time.Minute
+)
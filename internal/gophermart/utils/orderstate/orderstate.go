@@ -0,0 +1,92 @@
+package orderstate
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+)
+
+type Status string
+
+const (
+	New        Status = "NEW"
+	Processing Status = "PROCESSING"
+	Processed  Status = "PROCESSED"
+	Invalid    Status = "INVALID"
+	Cancelled  Status = "CANCELLED"
+)
+
+var (
+	ErrUnknownStatus     = errors.New("unknown order status")
+	ErrIllegalTransition = errors.New("illegal order status transition")
+)
+
+// transitions lists the legal moves between different statuses. NEW may
+// skip PROCESSING because the accrual system is only sampled, and an order
+// can already be finished when it is first polled. A processed order can
+// still be cancelled when the purchase is returned; its points are then
+// clawed back.
+var transitions = map[Status][]Status{
+	New:        {Processing, Processed, Invalid, Cancelled},
+	Processing: {Processed, Invalid, Cancelled},
+	Processed:  {Cancelled},
+}
+
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s: %s -> %s", ErrIllegalTransition, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+func Parse(s string) (Status, error) {
+	switch status := Status(s); status {
+	case New, Processing, Processed, Invalid, Cancelled:
+		return status, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnknownStatus, s)
+}
+
+// FromAccrual maps a status reported by the accrual system to the order
+// status it moves the order to.
+func FromAccrual(s accrualclient.Status) (Status, error) {
+	switch s {
+	case accrualclient.StatusRegistered, accrualclient.StatusProcessing:
+		return Processing, nil
+	case accrualclient.StatusProcessed:
+		return Processed, nil
+	case accrualclient.StatusInvalid:
+		return Invalid, nil
+	case accrualclient.StatusCancelled:
+		return Cancelled, nil
+	}
+	return "", fmt.Errorf("%w %q from accrual system", ErrUnknownStatus, s)
+}
+
+// Terminal reports whether the accrual system no longer has to be polled for
+// the order to settle. A processed order may still be polled, less often,
+// until its cancellation window ends.
+func (s Status) Terminal() bool {
+	return s == Processed || s == Invalid || s == Cancelled
+}
+
+// Transition reports whether an order may move from one status to another.
+// Staying in the same status is always allowed and means nothing changes.
+func Transition(from, to Status) error {
+	if from == to {
+		return nil
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to}
+}
@@ -0,0 +1,76 @@
+package orderstate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+)
+
+func TestTransition(t *testing.T) {
+	statuses := []Status{New, Processing, Processed, Invalid, Cancelled}
+	legal := map[[2]Status]bool{
+		{New, Processing}:        true,
+		{New, Processed}:         true,
+		{New, Invalid}:           true,
+		{Processing, Processed}:  true,
+		{Processing, Invalid}:    true,
+		{New, Cancelled}:         true,
+		{Processing, Cancelled}:  true,
+		{Processed, Cancelled}:   true,
+		{New, New}:               true,
+		{Processing, Processing}: true,
+		{Processed, Processed}:   true,
+		{Invalid, Invalid}:       true,
+		{Cancelled, Cancelled}:   true,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			err := Transition(from, to)
+			if legal[[2]Status{from, to}] {
+				if err != nil {
+					t.Errorf("Transition(%s, %s) = %v, want nil", from, to, err)
+				}
+				continue
+			}
+			var transitionErr *TransitionError
+			if !errors.Is(err, ErrIllegalTransition) || !errors.As(err, &transitionErr) || transitionErr.From != from || transitionErr.To != to {
+				t.Errorf("Transition(%s, %s) = %v, want TransitionError", from, to, err)
+			}
+		}
+	}
+}
+
+func TestFromAccrual(t *testing.T) {
+	tests := []struct {
+		accrual accrualclient.Status
+		want    Status
+	}{
+		{accrualclient.StatusRegistered, Processing},
+		{accrualclient.StatusProcessing, Processing},
+		{accrualclient.StatusProcessed, Processed},
+		{accrualclient.StatusInvalid, Invalid},
+		{accrualclient.StatusCancelled, Cancelled},
+	}
+	for _, tt := range tests {
+		if got, err := FromAccrual(tt.accrual); err != nil || got != tt.want {
+			t.Errorf("FromAccrual(%s) = %s, %v; want %s", tt.accrual, got, err, tt.want)
+		}
+	}
+	if _, err := FromAccrual("CANCELLED_BY_ALIENS"); !errors.Is(err, ErrUnknownStatus) {
+		t.Errorf("FromAccrual(unknown) = %v, want ErrUnknownStatus", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if s, err := Parse("PROCESSED"); err != nil || s != Processed {
+		t.Fatalf("Parse(PROCESSED) = %s, %v", s, err)
+	}
+	if _, err := Parse("processed"); !errors.Is(err, ErrUnknownStatus) {
+		t.Fatalf("Parse(processed) = %v, want ErrUnknownStatus", err)
+	}
+	if !Processed.Terminal() || !Invalid.Terminal() || !Cancelled.Terminal() || New.Terminal() || Processing.Terminal() {
+		t.Fatal("Terminal reports wrong statuses")
+	}
+}
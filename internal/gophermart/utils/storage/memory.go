@@ -0,0 +1,785 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/orderstate"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+type outboxEntry struct {
+	attempts      int
+	nextAttemptAt time.Time
+	lockedBy      string
+	lockedUntil   time.Time
+	watchUntil    time.Time
+}
+
+type pointLot struct {
+	orderNum  string
+	remaining float64
+	expiresAt time.Time
+}
+
+func (l *pointLot) expired(now time.Time) bool {
+	return !l.expiresAt.IsZero() && !l.expiresAt.After(now)
+}
+
+type reversal struct {
+	withdrawalID int64
+	actor        string
+	createdAt    time.Time
+}
+
+type Memory struct {
+	mu               sync.RWMutex
+	ctx              context.Context
+	users            map[string]types.User
+	logins           map[int]string
+	lastUserID       int
+	orders           map[string]*types.Order
+	userOrders       map[int][]string
+	withdrawals      map[int][]types.Withdrawal
+	outbox           map[string]*outboxEntry
+	events           []types.OrderEvent
+	lots             map[int][]*pointLot
+	debts            map[int]float64
+	expirations      []types.PointExpiration
+	lastWithdrawalID int64
+	reversals        []reversal
+	withdrawalLots   map[int64][]pointLot
+	transfers        []types.Transfer
+	expiryMonths     int
+	cancelWindow     time.Duration
+}
+
+func NewMemory(ctx context.Context) *Memory {
+	return &Memory{
+		ctx:            ctx,
+		users:          make(map[string]types.User),
+		logins:         make(map[int]string),
+		orders:         make(map[string]*types.Order),
+		userOrders:     make(map[int][]string),
+		withdrawals:    make(map[int][]types.Withdrawal),
+		outbox:         make(map[string]*outboxEntry),
+		lots:           make(map[int][]*pointLot),
+		debts:          make(map[int]float64),
+		withdrawalLots: make(map[int64][]pointLot),
+	}
+}
+
+// SetPointsExpiry makes points accrued from now on expire the given number
+// of months after the order is processed. Zero keeps them forever.
+func (m *Memory) SetPointsExpiry(months int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expiryMonths = months
+}
+
+// SetCancellationWindow keeps orders processed from now on pending for the
+// given time, so that a cancellation is picked up by polling even without
+// accrual system events. Zero stops polling an order once it is processed.
+func (m *Memory) SetCancellationWindow(window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cancelWindow = window
+}
+
+func (m *Memory) SaveOrder(order *types.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[order.Number]; ok {
+		return fmt.Errorf("order %s already exists", order.Number)
+	}
+	if _, ok := m.logins[order.UserID]; !ok {
+		return fmt.Errorf("user %d not found", order.UserID)
+	}
+	m.insertOrder(*order, time.Now())
+	return nil
+}
+
+func (m *Memory) SaveOrders(userID int, numbers []string) (map[string]types.OrderUploadResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.logins[userID]; !ok {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	results := make(map[string]types.OrderUploadResult, len(numbers))
+	now := time.Now()
+	for _, number := range numbers {
+		if _, ok := results[number]; ok {
+			continue
+		}
+		existing, ok := m.orders[number]
+		switch {
+		case !ok:
+			m.insertOrder(types.Order{UserID: userID, Number: number, Status: string(orderstate.New)}, now)
+			results[number] = types.OrderAccepted
+		case existing.UserID == userID:
+			results[number] = types.OrderAlreadyUploaded
+		default:
+			results[number] = types.OrderConflict
+		}
+	}
+	return results, nil
+}
+
+func (m *Memory) insertOrder(order types.Order, now time.Time) {
+	order.UploadedAt = now
+	m.orders[order.Number] = &order
+	m.userOrders[order.UserID] = append(m.userOrders[order.UserID], order.Number)
+	m.outbox[order.Number] = &outboxEntry{nextAttemptAt: now}
+}
+
+// SaveWithdrawal charges the user once per order number. Replaying the same
+// withdrawal succeeds without charging again, even after it was reversed.
+func (m *Memory) SaveWithdrawal(w types.Withdrawal, authUserID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID, withdrawals := range m.withdrawals {
+		for _, prev := range withdrawals {
+			if prev.OrderNum != w.OrderNum {
+				continue
+			}
+			if userID != authUserID || round(prev.Accrual, 0.01) != round(w.Accrual, 0.01) {
+				return errs.ErrWithdrawalConflict
+			}
+			return nil
+		}
+	}
+
+	now := time.Now()
+	taken, err := m.spend(authUserID, w.Accrual, now)
+	if err != nil {
+		return err
+	}
+
+	m.lastWithdrawalID++
+	w.ID = m.lastWithdrawalID
+	m.withdrawalLots[w.ID] = taken
+	w.Status = types.WithdrawalCompleted
+	w.ProcessedAt = now
+	w.UserID = authUserID
+	w.ReversedAt = nil
+	m.withdrawals[authUserID] = append(m.withdrawals[authUserID], w)
+	return nil
+}
+
+// spend takes amount from the user's unexpired lots, oldest first, and
+// returns what was taken from each lot.
+func (m *Memory) spend(userID int, amount float64, now time.Time) ([]pointLot, error) {
+	var available float64
+	for _, lot := range m.lots[userID] {
+		if !lot.expired(now) {
+			available += lot.remaining
+		}
+	}
+	if round(available, 0.01) < amount {
+		return nil, errs.ErrInsufficientFunds
+	}
+
+	var taken []pointLot
+	for _, lot := range m.lots[userID] {
+		if amount <= 0 {
+			break
+		}
+		if lot.expired(now) || lot.remaining <= 0 {
+			continue
+		}
+		take := math.Min(lot.remaining, amount)
+		lot.remaining = round(lot.remaining-take, 0.01)
+		amount -= take
+		taken = append(taken, pointLot{remaining: take, expiresAt: lot.expiresAt})
+	}
+	return taken, nil
+}
+
+// Transfer moves points between users. The recipient's lots keep the expiry
+// of the sender's lots they were taken from, so passing points back and
+// forth does not extend their life.
+func (m *Memory) Transfer(t types.Transfer, dailyLimit float64) (types.Transfer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	to, ok := m.logins[t.ToID]
+	if !ok {
+		return types.Transfer{}, errs.ErrRecipientNotFound
+	}
+	t.From, t.To = m.logins[t.FromID], to
+	now := time.Now()
+	if dailyLimit > 0 {
+		sent := t.Amount
+		for _, prev := range m.transfers {
+			if prev.FromID == t.FromID && prev.CreatedAt.After(now.Add(-24*time.Hour)) {
+				sent += prev.Amount
+			}
+		}
+		if round(sent, 0.01) > dailyLimit {
+			return types.Transfer{}, errs.ErrTransferLimit
+		}
+	}
+
+	taken, err := m.spend(t.FromID, t.Amount, now)
+	if err != nil {
+		return types.Transfer{}, err
+	}
+	for _, lot := range taken {
+		m.addLot(t.ToID, "", lot.remaining, lot.expiresAt)
+	}
+
+	t.ID = int64(len(m.transfers) + 1)
+	t.CreatedAt = now
+	m.transfers = append(m.transfers, t)
+	return t, nil
+}
+
+func (m *Memory) GetTransactions(authUserID int) ([]types.Transaction, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.transactions(authUserID), nil
+}
+
+// StreamStatement copies the statement out under the lock and calls fn
+// after releasing it, so a slow reader does not block writers.
+func (m *Memory) StreamStatement(authUserID int, from, to time.Time, fn func(types.StatementEntry) error) error {
+	m.mu.RLock()
+	var entries []types.StatementEntry
+	for _, t := range m.transactions(authUserID) {
+		entries = append(entries, types.StatementEntry{Transaction: t})
+	}
+	for _, number := range m.userOrders[authUserID] {
+		order := m.orders[number]
+		entries = append(entries, types.StatementEntry{
+			Transaction: types.Transaction{Type: types.TransactionOrder, Order: order.Number, CreatedAt: order.UploadedAt},
+			Status:      order.Status,
+		})
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	var balance float64
+	for _, e := range entries {
+		balance = round(balance+e.Amount, 0.01)
+		if e.CreatedAt.Before(from) || !e.CreatedAt.Before(to) {
+			continue
+		}
+		e.Balance = balance
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) transactions(authUserID int) []types.Transaction {
+	var transactions []types.Transaction
+	for _, e := range m.events {
+		if e.UserID != authUserID {
+			continue
+		}
+		switch {
+		case e.Status == string(orderstate.Processed) && e.Accrual > 0:
+			transactions = append(transactions, types.Transaction{Type: types.TransactionAccrual, Amount: e.Accrual, Order: e.Number, CreatedAt: e.ChangedAt})
+		case e.PreviousStatus == string(orderstate.Processed) && e.Status == string(orderstate.Cancelled):
+			transactions = append(transactions, types.Transaction{Type: types.TransactionClawback, Amount: -e.Accrual, Order: e.Number, CreatedAt: e.ChangedAt})
+		}
+	}
+	for _, w := range m.withdrawals[authUserID] {
+		transactions = append(transactions, types.Transaction{Type: types.TransactionWithdrawal, Amount: -w.Accrual, Order: w.OrderNum, CreatedAt: w.ProcessedAt})
+		if w.ReversedAt != nil {
+			transactions = append(transactions, types.Transaction{Type: types.TransactionReversal, Amount: w.Accrual, Order: w.OrderNum, CreatedAt: *w.ReversedAt})
+		}
+	}
+	for _, t := range m.transfers {
+		if t.FromID == authUserID {
+			transactions = append(transactions, types.Transaction{Type: types.TransactionTransferOut, Amount: -t.Amount, Counterparty: t.To, CreatedAt: t.CreatedAt})
+		}
+		if t.ToID == authUserID {
+			transactions = append(transactions, types.Transaction{Type: types.TransactionTransferIn, Amount: t.Amount, Counterparty: t.From, CreatedAt: t.CreatedAt})
+		}
+	}
+	for _, e := range m.expirations {
+		if e.UserID == authUserID {
+			transactions = append(transactions, types.Transaction{Type: types.TransactionExpiration, Amount: -e.Amount, Order: e.OrderNum, CreatedAt: e.ExpiredAt})
+		}
+	}
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].CreatedAt.Before(transactions[j].CreatedAt)
+	})
+	return transactions
+}
+
+func (m *Memory) GetWithdrawalByOrder(orderNum string) (types.Withdrawal, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, withdrawals := range m.withdrawals {
+		for _, w := range withdrawals {
+			if w.OrderNum == orderNum {
+				return w, true, nil
+			}
+		}
+	}
+	return types.Withdrawal{}, false, nil
+}
+
+// ReverseWithdrawal marks the withdrawal reversed and credits its sum back
+// with the expiry of the lots it was paid from. Reversing an already
+// reversed withdrawal changes nothing.
+func (m *Memory) ReverseWithdrawal(id int64, reason string, actor string) (types.Withdrawal, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID, withdrawals := range m.withdrawals {
+		for i := range withdrawals {
+			w := &withdrawals[i]
+			if w.ID != id {
+				continue
+			}
+			if w.Status == types.WithdrawalReversed {
+				return *w, nil
+			}
+			now := time.Now()
+			w.Status = types.WithdrawalReversed
+			w.ReversedAt = &now
+			w.Reason = reason
+			m.reversals = append(m.reversals, reversal{withdrawalID: id, actor: actor, createdAt: now})
+			for _, lot := range m.withdrawalLots[id] {
+				m.addLot(userID, "", lot.remaining, lot.expiresAt)
+			}
+			return *w, nil
+		}
+	}
+	return types.Withdrawal{}, errs.ErrWithdrawalNotFound
+}
+
+func (m *Memory) GetOrderUserByNum(orderNum string) (int, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	order, ok := m.orders[orderNum]
+	if !ok {
+		return 0, false, nil
+	}
+	return order.UserID, true, nil
+}
+
+func (m *Memory) GetOrderUser(orderNum string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	order, ok := m.orders[orderNum]
+	if !ok {
+		return 0, fmt.Errorf("order %s not found", orderNum)
+	}
+	return order.UserID, nil
+}
+
+func (m *Memory) GetOrdersByUser(authUserID int) ([]types.Order, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	numbers := m.userOrders[authUserID]
+	if len(numbers) == 0 {
+		return nil, false, nil
+	}
+	orders := make([]types.Order, 0, len(numbers))
+	for _, number := range numbers {
+		order := *m.orders[number]
+		order.Accrual = round(order.Accrual, 0.01)
+		orders = append(orders, order)
+	}
+	return orders, true, nil
+}
+
+func (m *Memory) GetBalance(authUserID int) (float64, float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var balance, withdrawn float64
+	for _, lot := range m.lots[authUserID] {
+		if !lot.expired(now) {
+			balance += lot.remaining
+		}
+	}
+	for _, w := range m.withdrawals[authUserID] {
+		if w.Status != types.WithdrawalReversed {
+			withdrawn += w.Accrual
+		}
+	}
+	return round(balance-m.debts[authUserID], 0.01), withdrawn, nil
+}
+
+func (m *Memory) GetExpiringPoints(authUserID int, before time.Time) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var expiring float64
+	for _, lot := range m.lots[authUserID] {
+		if !lot.expired(now) && lot.expired(before) {
+			expiring += lot.remaining
+		}
+	}
+	return round(expiring, 0.01), nil
+}
+
+// GetDailyReport aggregates the report on every call; the memory storage
+// has nothing to refresh.
+func (m *Memory) GetDailyReport(from, to time.Time) ([]types.DailyReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	days := make(map[string]*types.DailyReport)
+	active := make(map[string]map[int]bool)
+	day := func(t time.Time, userID int) *types.DailyReport {
+		t = t.UTC()
+		if t.Before(from) || !t.Before(to) {
+			return nil
+		}
+		key := t.Format(types.DayLayout)
+		r, ok := days[key]
+		if !ok {
+			r = &types.DailyReport{Day: key}
+			days[key] = r
+			active[key] = make(map[int]bool)
+		}
+		if userID != 0 && !active[key][userID] {
+			active[key][userID] = true
+			r.ActiveUsers++
+		}
+		return r
+	}
+
+	for _, order := range m.orders {
+		if r := day(order.UploadedAt, order.UserID); r != nil {
+			r.OrdersUploaded++
+			if order.Status == string(orderstate.Invalid) {
+				r.OrdersInvalid++
+			}
+		}
+	}
+	for _, e := range m.events {
+		if e.Status != string(orderstate.Processed) {
+			continue
+		}
+		if r := day(e.ChangedAt, 0); r != nil {
+			r.OrdersProcessed++
+			r.PointsIssued += e.Accrual
+		}
+	}
+	for userID, withdrawals := range m.withdrawals {
+		for _, w := range withdrawals {
+			r := day(w.ProcessedAt, userID)
+			if r != nil && w.Status != types.WithdrawalReversed {
+				r.PointsRedeemed += w.Accrual
+			}
+		}
+	}
+
+	report := make([]types.DailyReport, 0, len(days))
+	for _, r := range days {
+		r.PointsIssued = round(r.PointsIssued, 0.01)
+		r.PointsRedeemed = round(r.PointsRedeemed, 0.01)
+		report = append(report, *r)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Day < report[j].Day })
+	return report, nil
+}
+
+func (m *Memory) RefreshReports() error {
+	return nil
+}
+
+func (m *Memory) ExpirePoints(now time.Time, limit int) ([]types.PointExpiration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []types.PointExpiration
+	for userID, lots := range m.lots {
+		for _, lot := range lots {
+			if len(expired) == limit {
+				return expired, nil
+			}
+			if lot.remaining <= 0 || !lot.expired(now) {
+				continue
+			}
+			expiration := types.PointExpiration{
+				ID:        int64(len(m.expirations) + 1),
+				UserID:    userID,
+				OrderNum:  lot.orderNum,
+				Amount:    lot.remaining,
+				ExpiresAt: lot.expiresAt,
+				ExpiredAt: now,
+			}
+			lot.remaining = 0
+			m.expirations = append(m.expirations, expiration)
+			expired = append(expired, expiration)
+		}
+	}
+	return expired, nil
+}
+
+func (m *Memory) GetPointExpirations(authUserID int) ([]types.PointExpiration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var expirations []types.PointExpiration
+	for _, e := range m.expirations {
+		if e.UserID == authUserID {
+			expirations = append(expirations, e)
+		}
+	}
+	return expirations, nil
+}
+
+func (m *Memory) UpgradeOrderStatus(o accrualclient.Order) error {
+	to, err := orderstate.FromAccrual(o.Status)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[o.Number]
+	if !ok {
+		return nil
+	}
+	from, err := orderstate.Parse(order.Status)
+	if err != nil {
+		return err
+	}
+	if err = orderstate.Transition(from, to); err != nil {
+		return err
+	}
+
+	if from != to {
+		now := time.Now()
+		order.Status = string(to)
+		if to == orderstate.Processed {
+			order.Accrual = o.Accrual
+			m.addLot(order.UserID, order.Number, order.Accrual, m.lotExpiry(now))
+		}
+		if from == orderstate.Processed && to == orderstate.Cancelled {
+			m.clawBack(order.UserID, order.Number, order.Accrual, now)
+		}
+		m.events = append(m.events, types.OrderEvent{
+			ID:             int64(len(m.events) + 1),
+			UserID:         order.UserID,
+			Number:         order.Number,
+			PreviousStatus: string(from),
+			Status:         order.Status,
+			Accrual:        order.Accrual,
+			ChangedAt:      now,
+		})
+	}
+	entry, pending := m.outbox[o.Number]
+	switch {
+	case !pending:
+	case to == orderstate.Processed && from != to && m.cancelWindow > 0:
+		entry.watchUntil = time.Now().Add(m.cancelWindow)
+	case to == orderstate.Processed:
+		if !entry.watchUntil.After(time.Now()) {
+			delete(m.outbox, o.Number)
+		}
+	case to.Terminal():
+		delete(m.outbox, o.Number)
+	}
+	return nil
+}
+
+func (m *Memory) lotExpiry(now time.Time) time.Time {
+	if m.expiryMonths <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, m.expiryMonths, 0)
+}
+
+// addLot credits points to the user, paying off any clawback debt first.
+func (m *Memory) addLot(userID int, orderNum string, amount float64, expiresAt time.Time) {
+	if amount <= 0 {
+		return
+	}
+	if debt := m.debts[userID]; debt > 0 {
+		paid := math.Min(debt, amount)
+		m.debts[userID] = round(debt-paid, 0.01)
+		amount = round(amount-paid, 0.01)
+	}
+	lot := &pointLot{orderNum: orderNum, remaining: amount, expiresAt: expiresAt}
+	m.lots[userID] = append(m.lots[userID], lot)
+}
+
+// clawBack takes back the points of a cancelled order: from the order's own
+// lot first, then from the oldest lots. Whatever the user has already spent
+// becomes a debt that later accruals pay off.
+func (m *Memory) clawBack(userID int, orderNum string, amount float64, now time.Time) {
+	lots := m.lots[userID]
+	sorted := make([]*pointLot, 0, len(lots))
+	for _, lot := range lots {
+		if lot.orderNum == orderNum {
+			sorted = append(sorted, lot)
+		}
+	}
+	for _, lot := range lots {
+		if lot.orderNum != orderNum {
+			sorted = append(sorted, lot)
+		}
+	}
+
+	for _, lot := range sorted {
+		if amount <= 0 {
+			break
+		}
+		if lot.expired(now) || lot.remaining <= 0 {
+			continue
+		}
+		take := math.Min(lot.remaining, amount)
+		lot.remaining = round(lot.remaining-take, 0.01)
+		amount -= take
+	}
+	if amount > 0 {
+		m.debts[userID] = round(m.debts[userID]+amount, 0.01)
+	}
+}
+
+func (m *Memory) GetOrderEvents(authUserID int, afterID int64, limit int) ([]types.OrderEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var events []types.OrderEvent
+	for _, event := range m.events {
+		if event.UserID == authUserID && event.ID > afterID {
+			events = append(events, event)
+			if len(events) == limit {
+				break
+			}
+		}
+	}
+	return events, nil
+}
+
+func (m *Memory) GetLastOrderEventID(authUserID int) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var id int64
+	for _, event := range m.events {
+		if event.UserID == authUserID && event.ID > id {
+			id = event.ID
+		}
+	}
+	return id, nil
+}
+
+func (m *Memory) GetWithdrawalsByUser(authUserID int) ([]types.Withdrawal, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	w := m.withdrawals[authUserID]
+	if len(w) == 0 {
+		return nil, false, nil
+	}
+	withdrawals := make([]types.Withdrawal, len(w))
+	for i, withdrawal := range w {
+		if withdrawal.ReversedAt != nil {
+			reversedAt := *withdrawal.ReversedAt
+			withdrawal.ReversedAt = &reversedAt
+		}
+		withdrawals[i] = withdrawal
+	}
+	return withdrawals, true, nil
+}
+
+func (m *Memory) ClaimPendingOrders(worker string, limit int, lease time.Duration) ([]types.PendingOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	orders := make([]types.PendingOrder, 0, len(m.outbox))
+	for number, entry := range m.outbox {
+		if !entry.nextAttemptAt.After(now) && !entry.lockedUntil.After(now) {
+			orders = append(orders, types.PendingOrder{Number: number, Attempts: entry.attempts, Processed: !entry.watchUntil.IsZero()})
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return m.outbox[orders[i].Number].nextAttemptAt.Before(m.outbox[orders[j].Number].nextAttemptAt)
+	})
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+	for _, order := range orders {
+		entry := m.outbox[order.Number]
+		entry.lockedBy = worker
+		entry.lockedUntil = now.Add(lease)
+	}
+	return orders, nil
+}
+
+func (m *Memory) RescheduleOrder(orderNum string, delay time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.outbox[orderNum]; ok {
+		entry.attempts++
+		entry.nextAttemptAt = time.Now().Add(delay)
+		entry.lockedBy = ""
+		entry.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (m *Memory) CheckUserData(login, hash string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[login]
+	return ok && user.HashPassword == hash
+}
+
+func (m *Memory) RegisterNewUser(login string, password string) (types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[login]; ok {
+		return types.User{}, errs.ErrUserExists
+	}
+	m.lastUserID++
+	user := types.User{
+		Login:        login,
+		HashPassword: password,
+		ID:           m.lastUserID,
+	}
+	m.users[login] = user
+	m.logins[user.ID] = login
+	return user, nil
+}
+
+func (m *Memory) GetUserData(login string) (types.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.users[login], nil
+}
+
+func (m *Memory) Close() {}
+
+func round(x, unit float64) float64 {
+	return math.Round(x/unit) * unit
+}
@@ -0,0 +1,16 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage/storagetest"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) types.Storage {
+		return storage.NewMemory(context.Background())
+	})
+}
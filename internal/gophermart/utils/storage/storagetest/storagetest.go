@@ -0,0 +1,839 @@
+package storagetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/errs"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/orderstate"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+)
+
+type Factory func(t *testing.T) types.Storage
+
+func Run(t *testing.T, newStorage Factory) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, newStorage(t)) })
+	t.Run("OrderOwnership", func(t *testing.T) { testOrderOwnership(t, newStorage(t)) })
+	t.Run("SaveOrders", func(t *testing.T) { testSaveOrders(t, newStorage(t)) })
+	t.Run("OrderStatus", func(t *testing.T) { testOrderStatus(t, newStorage(t)) })
+	t.Run("Balance", func(t *testing.T) { testBalance(t, newStorage(t)) })
+	t.Run("PendingOrders", func(t *testing.T) { testPendingOrders(t, newStorage(t)) })
+	t.Run("ClaimPendingOrders", func(t *testing.T) { testClaimPendingOrders(t, newStorage(t)) })
+	t.Run("CancellationWindow", func(t *testing.T) { testCancellationWindow(t, newStorage(t)) })
+	t.Run("OrderEvents", func(t *testing.T) { testOrderEvents(t, newStorage(t)) })
+	t.Run("OrderTransitions", func(t *testing.T) { testOrderTransitions(t, newStorage(t)) })
+	t.Run("PointExpiry", func(t *testing.T) { testPointExpiry(t, newStorage(t)) })
+	t.Run("WithdrawalReversal", func(t *testing.T) { testWithdrawalReversal(t, newStorage(t)) })
+	t.Run("WithdrawalIdempotency", func(t *testing.T) { testWithdrawalIdempotency(t, newStorage(t)) })
+	t.Run("Clawback", func(t *testing.T) { testClawback(t, newStorage(t)) })
+	t.Run("Transfers", func(t *testing.T) { testTransfers(t, newStorage(t)) })
+	t.Run("Statement", func(t *testing.T) { testStatement(t, newStorage(t)) })
+	t.Run("DailyReport", func(t *testing.T) { testDailyReport(t, newStorage(t)) })
+}
+
+func testUsers(t *testing.T, s types.Storage) {
+	user, err := s.RegisterNewUser("alice", "hash")
+	if err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	}
+	if user.ID == 0 || user.Login != "alice" {
+		t.Fatalf("RegisterNewUser returned %+v", user)
+	}
+	if _, err = s.RegisterNewUser("alice", "other"); !errors.Is(err, errs.ErrUserExists) {
+		t.Fatalf("RegisterNewUser duplicate: got %v, want %v", err, errs.ErrUserExists)
+	}
+
+	got, err := s.GetUserData("alice")
+	if err != nil {
+		t.Fatalf("GetUserData: %v", err)
+	}
+	if got.ID != user.ID || got.HashPassword != "hash" {
+		t.Fatalf("GetUserData returned %+v, want %+v", got, user)
+	}
+	missing, err := s.GetUserData("bob")
+	if err != nil || missing.ID != 0 {
+		t.Fatalf("GetUserData for unknown user: %+v, %v", missing, err)
+	}
+
+	if !s.CheckUserData("alice", "hash") || s.CheckUserData("alice", "wrong") {
+		t.Fatal("CheckUserData does not match stored credentials")
+	}
+}
+
+func testOrderOwnership(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	if _, exists, err := s.GetOrderUserByNum("12345678903"); err != nil || exists {
+		t.Fatalf("GetOrderUserByNum for unknown order: exists=%t, err=%v", exists, err)
+	}
+
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+
+	user, exists, err := s.GetOrderUserByNum("12345678903")
+	if err != nil || !exists || user != alice {
+		t.Fatalf("GetOrderUserByNum: user=%d, exists=%t, err=%v", user, exists, err)
+	}
+	if user, err = s.GetOrderUser("9278923470"); err != nil || user != alice {
+		t.Fatalf("GetOrderUser: user=%d, err=%v", user, err)
+	}
+	if _, err = s.GetOrderUser("346436439"); err == nil {
+		t.Fatal("GetOrderUser for unknown order: want error")
+	}
+	if err = s.SaveOrder(&types.Order{UserID: bob, Number: "12345678903", Status: "NEW"}); err == nil {
+		t.Fatal("SaveOrder duplicate number: want error")
+	}
+	if err = s.SaveOrder(&types.Order{UserID: bob + 100, Number: "79927398713", Status: "NEW"}); err == nil {
+		t.Fatal("SaveOrder for unknown user: want error")
+	}
+	if _, exists, err = s.GetOrderUserByNum("79927398713"); err != nil || exists {
+		t.Fatalf("order of unknown user must not be saved: exists=%t, err=%v", exists, err)
+	}
+
+	orders, exist, err := s.GetOrdersByUser(alice)
+	if err != nil || !exist {
+		t.Fatalf("GetOrdersByUser: exist=%t, err=%v", exist, err)
+	}
+	if len(orders) != 2 || orders[0].Number != "12345678903" || orders[1].Number != "9278923470" {
+		t.Fatalf("GetOrdersByUser must return orders by upload time, got %+v", orders)
+	}
+	if orders[0].Status != "NEW" || orders[0].UploadedAt.IsZero() {
+		t.Fatalf("GetOrdersByUser returned %+v", orders[0])
+	}
+	if _, exist, err = s.GetOrdersByUser(bob); err != nil || exist {
+		t.Fatalf("GetOrdersByUser for user without orders: exist=%t, err=%v", exist, err)
+	}
+}
+
+func testSaveOrders(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, bob, "346436439")
+
+	results, err := s.SaveOrders(alice, []string{"12345678903", "346436439", "12345678903"})
+	if err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+	if results["12345678903"] != types.OrderAccepted {
+		t.Fatalf("SaveOrders result for new order repeated in the batch: %q, want the result of its first occurrence", results["12345678903"])
+	}
+	if results["346436439"] != types.OrderConflict {
+		t.Fatalf("SaveOrders result for foreign order: %q", results["346436439"])
+	}
+
+	results, err = s.SaveOrders(alice, []string{"9278923470", "12345678903", "346436439", "9278923470"})
+	if err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+	want := map[string]types.OrderUploadResult{
+		"9278923470":  types.OrderAccepted,
+		"12345678903": types.OrderAlreadyUploaded,
+		"346436439":   types.OrderConflict,
+	}
+	if len(results) != len(want) {
+		t.Fatalf("SaveOrders returned %+v, want %+v", results, want)
+	}
+	for number, result := range want {
+		if results[number] != result {
+			t.Fatalf("SaveOrders result for %s: %q, want %q", number, results[number], result)
+		}
+	}
+	if orders, _, err := s.GetOrdersByUser(alice); err != nil || len(orders) != 2 {
+		t.Fatalf("GetOrdersByUser after batches: %+v, %v, want each order saved once", orders, err)
+	}
+
+	user, exists, err := s.GetOrderUserByNum("12345678903")
+	if err != nil || !exists || user != alice {
+		t.Fatalf("order saved by SaveOrders: user=%d, exists=%t, err=%v", user, exists, err)
+	}
+}
+
+func testOrderStatus(t *testing.T, s types.Storage) {
+	alice, _ := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusRegistered})
+	assertStatus(t, s, alice, "12345678903", "PROCESSING", 0)
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 500.5})
+	assertStatus(t, s, alice, "12345678903", "PROCESSED", 500.5)
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusInvalid})
+	assertStatus(t, s, alice, "9278923470", "INVALID", 0)
+
+	if err := s.UpgradeOrderStatus(accrualclient.Order{Number: "79927398713", Status: accrualclient.StatusProcessed, Accrual: 1}); err != nil {
+		t.Fatalf("UpgradeOrderStatus for unknown order: %v", err)
+	}
+}
+
+func testBalance(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	balance, withdrawn, err := s.GetBalance(alice)
+	if err != nil || balance != 0 || withdrawn != 0 {
+		t.Fatalf("GetBalance for new user: %v, %v, %v", balance, withdrawn, err)
+	}
+
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+	mustSaveOrder(t, s, bob, "346436439")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 729.98})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessing})
+	mustUpgrade(t, s, accrualclient.Order{Number: "346436439", Status: accrualclient.StatusProcessed, Accrual: 100})
+
+	if err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 229.98}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+
+	balance, withdrawn, err = s.GetBalance(alice)
+	if err != nil {
+		t.Fatalf("GetBalance: %v", err)
+	}
+	if !almostEqual(balance, 500) || !almostEqual(withdrawn, 229.98) {
+		t.Fatalf("GetBalance: balance=%v, withdrawn=%v", balance, withdrawn)
+	}
+
+	withdrawals, exist, err := s.GetWithdrawalsByUser(alice)
+	if err != nil || !exist || len(withdrawals) != 1 {
+		t.Fatalf("GetWithdrawalsByUser: %+v, %t, %v", withdrawals, exist, err)
+	}
+	if withdrawals[0].OrderNum != "2377225624" || !almostEqual(withdrawals[0].Accrual, 229.98) || withdrawals[0].ProcessedAt.IsZero() {
+		t.Fatalf("GetWithdrawalsByUser returned %+v", withdrawals[0])
+	}
+	if _, exist, err = s.GetWithdrawalsByUser(bob); err != nil || exist {
+		t.Fatalf("GetWithdrawalsByUser for user without withdrawals: exist=%t, err=%v", exist, err)
+	}
+}
+
+func testPendingOrders(t *testing.T, s types.Storage) {
+	alice, _ := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	if _, err := s.SaveOrders(alice, []string{"9278923470"}); err != nil {
+		t.Fatalf("SaveOrders: %v", err)
+	}
+
+	pending := mustPending(t, s)
+	if len(pending) != 2 {
+		t.Fatalf("ClaimPendingOrders: got %+v, want both uploaded orders", pending)
+	}
+
+	if err := s.RescheduleOrder("12345678903", time.Hour); err != nil {
+		t.Fatalf("RescheduleOrder: %v", err)
+	}
+	pending = mustPending(t, s)
+	if len(pending) != 1 || pending[0].Number != "9278923470" {
+		t.Fatalf("ClaimPendingOrders after reschedule: %+v", pending)
+	}
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessing})
+	if pending = mustPending(t, s); len(pending) != 1 {
+		t.Fatalf("order in PROCESSING must stay pending, got %+v", pending)
+	}
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 10})
+	if pending = mustPending(t, s); len(pending) != 0 {
+		t.Fatalf("processed order must leave the queue, got %+v", pending)
+	}
+}
+
+func testCancellationWindow(t *testing.T, s types.Storage) {
+	watching, ok := s.(interface{ SetCancellationWindow(window time.Duration) })
+	if !ok {
+		t.Skip("storage has no cancellation window")
+	}
+	watching.SetCancellationWindow(50 * time.Millisecond)
+	alice, _ := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 10})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 20})
+	pending := mustPending(t, s)
+	if len(pending) != 2 || !pending[0].Processed || !pending[1].Processed {
+		t.Fatalf("ClaimPendingOrders within the cancellation window: %+v, want both processed orders", pending)
+	}
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusCancelled})
+	assertStatus(t, s, alice, "9278923470", "CANCELLED", 20)
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 10})
+	if pending = mustPending(t, s); len(pending) != 1 || pending[0].Number != "12345678903" {
+		t.Fatalf("ClaimPendingOrders after cancellation: %+v, want only the order still in its window", pending)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 10})
+	if pending = mustPending(t, s); len(pending) != 0 {
+		t.Fatalf("ClaimPendingOrders after the cancellation window: %+v", pending)
+	}
+	if balance, _, err := s.GetBalance(alice); err != nil || !almostEqual(balance, 10) {
+		t.Fatalf("GetBalance: %v, %v, want 10 left after the cancellation", balance, err)
+	}
+}
+
+func testClaimPendingOrders(t *testing.T, s types.Storage) {
+	alice, _ := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+
+	first, err := s.ClaimPendingOrders("worker-a", 1, time.Hour)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("ClaimPendingOrders(worker-a): %+v, %v", first, err)
+	}
+	second, err := s.ClaimPendingOrders("worker-b", 10, time.Hour)
+	if err != nil || len(second) != 1 || second[0].Number == first[0].Number {
+		t.Fatalf("ClaimPendingOrders(worker-b): %+v, %v; want the order not claimed by worker-a", second, err)
+	}
+	if again, err := s.ClaimPendingOrders("worker-a", 10, time.Hour); err != nil || len(again) != 0 {
+		t.Fatalf("ClaimPendingOrders with everything leased: %+v, %v", again, err)
+	}
+
+	if err = s.RescheduleOrder(first[0].Number, 0); err != nil {
+		t.Fatalf("RescheduleOrder: %v", err)
+	}
+	released, err := s.ClaimPendingOrders("worker-b", 10, 10*time.Millisecond)
+	if err != nil || len(released) != 1 || released[0].Number != first[0].Number || released[0].Attempts != 1 {
+		t.Fatalf("ClaimPendingOrders after reschedule: %+v, %v", released, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	expired, err := s.ClaimPendingOrders("worker-c", 10, time.Hour)
+	if err != nil || len(expired) != 1 || expired[0].Number != first[0].Number {
+		t.Fatalf("ClaimPendingOrders after lease expiry: %+v, %v", expired, err)
+	}
+}
+
+func testOrderEvents(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, bob, "9278923470")
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusRegistered})
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessing})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusInvalid})
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 42})
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 42})
+
+	events, err := s.GetOrderEvents(alice, 0, 10)
+	if err != nil {
+		t.Fatalf("GetOrderEvents: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("GetOrderEvents: %+v, want one event per actual change", events)
+	}
+	if events[0].Number != "12345678903" || events[0].PreviousStatus != "NEW" || events[0].Status != "PROCESSING" || events[0].ChangedAt.IsZero() {
+		t.Fatalf("first event: %+v", events[0])
+	}
+	if events[1].PreviousStatus != "PROCESSING" || events[1].Status != "PROCESSED" || events[1].Accrual != 42 || events[1].ID <= events[0].ID {
+		t.Fatalf("second event: %+v", events[1])
+	}
+
+	resumed, err := s.GetOrderEvents(alice, events[0].ID, 10)
+	if err != nil || len(resumed) != 1 || resumed[0].ID != events[1].ID {
+		t.Fatalf("GetOrderEvents after id %d: %+v, %v", events[0].ID, resumed, err)
+	}
+	if limited, err := s.GetOrderEvents(alice, 0, 1); err != nil || len(limited) != 1 || limited[0].ID != events[0].ID {
+		t.Fatalf("GetOrderEvents with limit: %+v, %v", limited, err)
+	}
+
+	bobEvents, err := s.GetOrderEvents(bob, 0, 10)
+	if err != nil || len(bobEvents) != 1 || bobEvents[0].Status != "INVALID" {
+		t.Fatalf("GetOrderEvents for bob: %+v, %v", bobEvents, err)
+	}
+
+	if last, err := s.GetLastOrderEventID(alice); err != nil || last != events[1].ID {
+		t.Fatalf("GetLastOrderEventID = %d, %v, want %d", last, err, events[1].ID)
+	}
+	if last, err := s.GetLastOrderEventID(bob); err != nil || last != bobEvents[0].ID {
+		t.Fatalf("GetLastOrderEventID for bob = %d, %v, want %d", last, err, bobEvents[0].ID)
+	}
+	if carol, err := s.RegisterNewUser("carol", "hash"); err != nil {
+		t.Fatalf("RegisterNewUser: %v", err)
+	} else if last, err := s.GetLastOrderEventID(carol.ID); err != nil || last != 0 {
+		t.Fatalf("GetLastOrderEventID without events = %d, %v, want 0", last, err)
+	}
+}
+
+func testOrderTransitions(t *testing.T, s types.Storage) {
+	alice, _ := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+
+	err := s.UpgradeOrderStatus(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessing})
+	if !errors.Is(err, orderstate.ErrIllegalTransition) {
+		t.Fatalf("PROCESSED -> PROCESSING: err=%v, want ErrIllegalTransition", err)
+	}
+	err = s.UpgradeOrderStatus(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusInvalid})
+	if !errors.Is(err, orderstate.ErrIllegalTransition) {
+		t.Fatalf("PROCESSED -> INVALID: err=%v, want ErrIllegalTransition", err)
+	}
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 999})
+	assertStatus(t, s, alice, "12345678903", "PROCESSED", 100)
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusInvalid})
+	err = s.UpgradeOrderStatus(accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 5})
+	if !errors.Is(err, orderstate.ErrIllegalTransition) {
+		t.Fatalf("INVALID -> PROCESSED: err=%v, want ErrIllegalTransition", err)
+	}
+	assertStatus(t, s, alice, "9278923470", "INVALID", 0)
+
+	mustSaveOrder(t, s, alice, "79927398713")
+	err = s.UpgradeOrderStatus(accrualclient.Order{Number: "79927398713", Status: "REFUNDED"})
+	if !errors.Is(err, orderstate.ErrUnknownStatus) {
+		t.Fatalf("unknown status: err=%v, want ErrUnknownStatus", err)
+	}
+	assertStatus(t, s, alice, "79927398713", "NEW", 0)
+	if pending := mustPending(t, s); len(pending) != 1 || pending[0].Number != "79927398713" {
+		t.Fatalf("pending after unknown status: %+v", pending)
+	}
+
+	events, err := s.GetOrderEvents(alice, 0, 10)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("GetOrderEvents: %+v, %v, want only legal transitions recorded", events, err)
+	}
+}
+
+func testPointExpiry(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	expiring, ok := s.(interface{ SetPointsExpiry(months int) })
+	if !ok {
+		t.Skip("storage has no points expiry policy")
+	}
+	expiring.SetPointsExpiry(12)
+
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	time.Sleep(time.Millisecond)
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 50})
+
+	if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 120}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+
+	soon, err := s.GetExpiringPoints(alice, time.Now().Add(24*time.Hour))
+	if err != nil || soon != 0 {
+		t.Fatalf("GetExpiringPoints within a day: %v, %v", soon, err)
+	}
+	later := time.Now().AddDate(0, 13, 0)
+	soon, err = s.GetExpiringPoints(alice, later)
+	if err != nil || !almostEqual(soon, 30) {
+		t.Fatalf("GetExpiringPoints within 13 months: %v, %v, want 30 left of the newest lot", soon, err)
+	}
+
+	expired, err := s.ExpirePoints(time.Now(), 10)
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("ExpirePoints before expiry: %+v, %v", expired, err)
+	}
+	expired, err = s.ExpirePoints(later, 10)
+	if err != nil || len(expired) != 1 {
+		t.Fatalf("ExpirePoints: %+v, %v, want only the partly spent lot", expired, err)
+	}
+	if expired[0].UserID != alice || expired[0].OrderNum != "9278923470" || !almostEqual(expired[0].Amount, 30) {
+		t.Fatalf("ExpirePoints returned %+v", expired[0])
+	}
+	if expired, err = s.ExpirePoints(later, 10); err != nil || len(expired) != 0 {
+		t.Fatalf("ExpirePoints twice: %+v, %v", expired, err)
+	}
+
+	balance, withdrawn, err := s.GetBalance(alice)
+	if err != nil || balance != 0 || !almostEqual(withdrawn, 120) {
+		t.Fatalf("GetBalance after expiry: balance=%v, withdrawn=%v, err=%v", balance, withdrawn, err)
+	}
+	err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "346436439", Accrual: 1}, alice)
+	if !errors.Is(err, errs.ErrInsufficientFunds) {
+		t.Fatalf("SaveWithdrawal of expired points: err=%v, want ErrInsufficientFunds", err)
+	}
+
+	audit, err := s.GetPointExpirations(alice)
+	if err != nil || len(audit) != 1 || audit[0].OrderNum != "9278923470" || !almostEqual(audit[0].Amount, 30) || audit[0].ExpiredAt.IsZero() {
+		t.Fatalf("GetPointExpirations: %+v, %v", audit, err)
+	}
+	if audit, err = s.GetPointExpirations(bob); err != nil || len(audit) != 0 {
+		t.Fatalf("GetPointExpirations for bob: %+v, %v", audit, err)
+	}
+}
+
+func testWithdrawalReversal(t *testing.T, s types.Storage) {
+	alice, _ := mustUsers(t, s)
+	expiring, hasExpiry := s.(interface{ SetPointsExpiry(months int) })
+	if hasExpiry {
+		expiring.SetPointsExpiry(12)
+	}
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 60}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+
+	w, exists, err := s.GetWithdrawalByOrder("2377225624")
+	if err != nil || !exists || w.ID == 0 || w.Status != types.WithdrawalCompleted || w.ReversedAt != nil {
+		t.Fatalf("GetWithdrawalByOrder: %+v, %t, %v", w, exists, err)
+	}
+	if _, exists, err = s.GetWithdrawalByOrder("346436439"); err != nil || exists {
+		t.Fatalf("GetWithdrawalByOrder for unknown order: exists=%t, err=%v", exists, err)
+	}
+
+	// Points accrued from now on never expire, so only the original lot's
+	// expiry puts the refunded points among the expiring ones.
+	if hasExpiry {
+		expiring.SetPointsExpiry(0)
+	}
+	reversed, err := s.ReverseWithdrawal(w.ID, "order cancelled", "admin")
+	if err != nil || reversed.Status != types.WithdrawalReversed || reversed.ReversedAt == nil || reversed.Reason != "order cancelled" {
+		t.Fatalf("ReverseWithdrawal: %+v, %v", reversed, err)
+	}
+	balance, withdrawn, err := s.GetBalance(alice)
+	if err != nil || !almostEqual(balance, 100) || withdrawn != 0 {
+		t.Fatalf("GetBalance after reversal: balance=%v, withdrawn=%v, err=%v", balance, withdrawn, err)
+	}
+	if hasExpiry {
+		soon, err := s.GetExpiringPoints(alice, time.Now().AddDate(0, 13, 0))
+		if err != nil || !almostEqual(soon, 100) {
+			t.Fatalf("GetExpiringPoints after reversal: %v, %v, want 100 keeping the spent lot's expiry", soon, err)
+		}
+	}
+
+	again, err := s.ReverseWithdrawal(w.ID, "retry", "merchant")
+	if err != nil || again.Status != types.WithdrawalReversed || again.Reason != "order cancelled" {
+		t.Fatalf("ReverseWithdrawal twice: %+v, %v", again, err)
+	}
+	if balance, _, err = s.GetBalance(alice); err != nil || !almostEqual(balance, 100) {
+		t.Fatalf("GetBalance after repeated reversal: %v, %v, want the sum credited once", balance, err)
+	}
+
+	// A replay of a reversed withdrawal is still a replay: it charges nothing
+	// and does not bring the withdrawal back.
+	if err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 60}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal replay after reversal: %v", err)
+	}
+	if balance, withdrawn, err = s.GetBalance(alice); err != nil || !almostEqual(balance, 100) || withdrawn != 0 {
+		t.Fatalf("GetBalance after replaying a reversed withdrawal: balance=%v, withdrawn=%v, err=%v", balance, withdrawn, err)
+	}
+	if err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 10}, alice); !errors.Is(err, errs.ErrWithdrawalConflict) {
+		t.Fatalf("SaveWithdrawal of a reversed order number with another sum: err=%v, want ErrWithdrawalConflict", err)
+	}
+
+	withdrawals, _, err := s.GetWithdrawalsByUser(alice)
+	if err != nil || len(withdrawals) != 1 || withdrawals[0].Status != types.WithdrawalReversed || withdrawals[0].ReversedAt == nil {
+		t.Fatalf("GetWithdrawalsByUser after reversal: %+v, %v", withdrawals, err)
+	}
+
+	if _, err = s.ReverseWithdrawal(w.ID+100, "", "admin"); !errors.Is(err, errs.ErrWithdrawalNotFound) {
+		t.Fatalf("ReverseWithdrawal of unknown id: err=%v, want ErrWithdrawalNotFound", err)
+	}
+}
+
+func testWithdrawalIdempotency(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, bob, "9278923470")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 100})
+
+	for i := 0; i < 2; i++ {
+		if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 40}, alice); err != nil {
+			t.Fatalf("SaveWithdrawal attempt %d: %v", i+1, err)
+		}
+	}
+	balance, withdrawn, err := s.GetBalance(alice)
+	if err != nil || !almostEqual(balance, 60) || !almostEqual(withdrawn, 40) {
+		t.Fatalf("GetBalance after replay: balance=%v, withdrawn=%v, err=%v", balance, withdrawn, err)
+	}
+
+	err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 50}, alice)
+	if !errors.Is(err, errs.ErrWithdrawalConflict) {
+		t.Fatalf("SaveWithdrawal with another sum: err=%v, want ErrWithdrawalConflict", err)
+	}
+	err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 40}, bob)
+	if !errors.Is(err, errs.ErrWithdrawalConflict) {
+		t.Fatalf("SaveWithdrawal by another user: err=%v, want ErrWithdrawalConflict", err)
+	}
+	if balance, _, err = s.GetBalance(bob); err != nil || !almostEqual(balance, 100) {
+		t.Fatalf("GetBalance after conflicting withdrawal: %v, %v, want 100", balance, err)
+	}
+
+	err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "346436439", Accrual: 500}, alice)
+	if !errors.Is(err, errs.ErrInsufficientFunds) {
+		t.Fatalf("SaveWithdrawal over balance: err=%v, want ErrInsufficientFunds", err)
+	}
+	if err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "346436439", Accrual: 10}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal after a declined attempt: %v", err)
+	}
+
+	withdrawals, _, err := s.GetWithdrawalsByUser(alice)
+	if err != nil || len(withdrawals) != 2 {
+		t.Fatalf("GetWithdrawalsByUser: %+v, %v, want one withdrawal per order", withdrawals, err)
+	}
+}
+
+func testClawback(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+	mustSaveOrder(t, s, alice, "346436439")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusProcessed, Accrual: 20})
+	if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 70}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusCancelled, Accrual: 100})
+	assertStatus(t, s, alice, "12345678903", "CANCELLED", 100)
+	balance, _, err := s.GetBalance(alice)
+	if err != nil || !almostEqual(balance, -50) {
+		t.Fatalf("GetBalance after clawback: %v, %v, want -50", balance, err)
+	}
+	err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "5105105105105100", Accrual: 1}, alice)
+	if !errors.Is(err, errs.ErrInsufficientFunds) {
+		t.Fatalf("SaveWithdrawal with debt: err=%v, want ErrInsufficientFunds", err)
+	}
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusCancelled, Accrual: 100})
+	err = s.UpgradeOrderStatus(accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	if !errors.Is(err, orderstate.ErrIllegalTransition) {
+		t.Fatalf("CANCELLED -> PROCESSED: err=%v, want ErrIllegalTransition", err)
+	}
+	if balance, _, err = s.GetBalance(alice); err != nil || !almostEqual(balance, -50) {
+		t.Fatalf("GetBalance after repeated cancel: %v, %v, want -50", balance, err)
+	}
+
+	mustUpgrade(t, s, accrualclient.Order{Number: "346436439", Status: accrualclient.StatusProcessed, Accrual: 80})
+	if balance, _, err = s.GetBalance(alice); err != nil || !almostEqual(balance, 30) {
+		t.Fatalf("GetBalance after debt recovery: %v, %v, want 30", balance, err)
+	}
+	if err = s.SaveWithdrawal(types.Withdrawal{OrderNum: "4561261212345467", Accrual: 30}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal after debt recovery: %v", err)
+	}
+
+	mustSaveOrder(t, s, bob, "79927398713")
+	mustUpgrade(t, s, accrualclient.Order{Number: "79927398713", Status: accrualclient.StatusCancelled})
+	assertStatus(t, s, bob, "79927398713", "CANCELLED", 0)
+	if balance, _, err = s.GetBalance(bob); err != nil || balance != 0 {
+		t.Fatalf("GetBalance after cancelling unprocessed order: %v, %v", balance, err)
+	}
+}
+
+func testTransfers(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	if expiring, ok := s.(interface{ SetPointsExpiry(months int) }); ok {
+		expiring.SetPointsExpiry(12)
+	}
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+
+	sent, err := s.Transfer(types.Transfer{FromID: alice, ToID: bob, Amount: 40}, 50)
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if sent.ID == 0 || sent.From != "alice" || sent.To != "bob" || !almostEqual(sent.Amount, 40) || sent.CreatedAt.IsZero() {
+		t.Fatalf("Transfer returned %+v", sent)
+	}
+	if _, err = s.Transfer(types.Transfer{FromID: alice, ToID: bob, Amount: 20}, 50); !errors.Is(err, errs.ErrTransferLimit) {
+		t.Fatalf("Transfer over daily limit: err=%v, want ErrTransferLimit", err)
+	}
+	if _, err = s.Transfer(types.Transfer{FromID: alice, ToID: bob, Amount: 70}, 0); !errors.Is(err, errs.ErrInsufficientFunds) {
+		t.Fatalf("Transfer over balance: err=%v, want ErrInsufficientFunds", err)
+	}
+	if _, err = s.Transfer(types.Transfer{FromID: alice, ToID: bob + 100, Amount: 1}, 0); !errors.Is(err, errs.ErrRecipientNotFound) {
+		t.Fatalf("Transfer to unknown user: err=%v, want ErrRecipientNotFound", err)
+	}
+
+	balance, _, err := s.GetBalance(alice)
+	if err != nil || !almostEqual(balance, 60) {
+		t.Fatalf("GetBalance for sender: %v, %v, want 60", balance, err)
+	}
+	if balance, _, err = s.GetBalance(bob); err != nil || !almostEqual(balance, 40) {
+		t.Fatalf("GetBalance for recipient: %v, %v, want 40", balance, err)
+	}
+	if _, ok := s.(interface{ SetPointsExpiry(months int) }); ok {
+		soon, err := s.GetExpiringPoints(bob, time.Now().AddDate(0, 13, 0))
+		if err != nil || !almostEqual(soon, 40) {
+			t.Fatalf("GetExpiringPoints for recipient: %v, %v, want 40 keeping the sender's expiry", soon, err)
+		}
+	}
+
+	history, err := s.GetTransactions(alice)
+	if err != nil || len(history) != 2 {
+		t.Fatalf("GetTransactions for sender: %+v, %v", history, err)
+	}
+	if history[0].Type != types.TransactionAccrual || history[0].Order != "12345678903" ||
+		history[1].Type != types.TransactionTransferOut || history[1].Counterparty != "bob" ||
+		!almostEqual(history[0].Amount+history[1].Amount, 60) {
+		t.Fatalf("GetTransactions for sender returned %+v", history)
+	}
+	history, err = s.GetTransactions(bob)
+	if err != nil || len(history) != 1 || history[0].Type != types.TransactionTransferIn ||
+		history[0].Counterparty != "alice" || !almostEqual(history[0].Amount, 40) {
+		t.Fatalf("GetTransactions for recipient: %+v, %v", history, err)
+	}
+}
+
+func testStatement(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	time.Sleep(time.Millisecond)
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	time.Sleep(time.Millisecond)
+	mustSaveOrder(t, s, alice, "9278923470")
+	time.Sleep(time.Millisecond)
+	split := time.Now()
+	time.Sleep(time.Millisecond)
+	if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 30}, alice); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+	mustSaveOrder(t, s, bob, "346436439")
+	end := time.Now().Add(time.Second)
+
+	stream := func(from, to time.Time) []types.StatementEntry {
+		t.Helper()
+		var entries []types.StatementEntry
+		err := s.StreamStatement(alice, from, to, func(e types.StatementEntry) error {
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("StreamStatement: %v", err)
+		}
+		return entries
+	}
+
+	entries := stream(time.Time{}, end)
+	want := []struct {
+		kind    types.TransactionType
+		order   string
+		balance float64
+	}{
+		{types.TransactionOrder, "12345678903", 0},
+		{types.TransactionAccrual, "12345678903", 100},
+		{types.TransactionOrder, "9278923470", 100},
+		{types.TransactionWithdrawal, "2377225624", 70},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("StreamStatement returned %+v", entries)
+	}
+	for i, w := range want {
+		if entries[i].Type != w.kind || entries[i].Order != w.order || !almostEqual(entries[i].Balance, w.balance) {
+			t.Fatalf("entry %d: %+v, want %+v", i, entries[i], w)
+		}
+	}
+	if entries[0].Status != "PROCESSED" || entries[2].Status != "NEW" || !almostEqual(entries[3].Amount, -30) {
+		t.Fatalf("StreamStatement entries: %+v", entries)
+	}
+
+	entries = stream(split, end)
+	if len(entries) != 1 || entries[0].Type != types.TransactionWithdrawal || !almostEqual(entries[0].Balance, 70) {
+		t.Fatalf("StreamStatement from %v: %+v, want the withdrawal with the running balance", split, entries)
+	}
+	if entries = stream(time.Time{}, split); len(entries) != 3 {
+		t.Fatalf("StreamStatement to %v: %+v", split, entries)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := s.StreamStatement(alice, time.Time{}, end, func(types.StatementEntry) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("StreamStatement with failing callback: err=%v, calls=%d", err, calls)
+	}
+}
+
+func testDailyReport(t *testing.T, s types.Storage) {
+	alice, bob := mustUsers(t, s)
+	mustSaveOrder(t, s, alice, "12345678903")
+	mustSaveOrder(t, s, alice, "9278923470")
+	mustSaveOrder(t, s, bob, "346436439")
+	mustUpgrade(t, s, accrualclient.Order{Number: "12345678903", Status: accrualclient.StatusProcessed, Accrual: 100})
+	mustUpgrade(t, s, accrualclient.Order{Number: "9278923470", Status: accrualclient.StatusInvalid})
+	mustUpgrade(t, s, accrualclient.Order{Number: "346436439", Status: accrualclient.StatusProcessed, Accrual: 50.5})
+	if err := s.SaveWithdrawal(types.Withdrawal{OrderNum: "2377225624", Accrual: 20}, bob); err != nil {
+		t.Fatalf("SaveWithdrawal: %v", err)
+	}
+	if err := s.RefreshReports(); err != nil {
+		t.Fatalf("RefreshReports: %v", err)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	report, err := s.GetDailyReport(today, today.AddDate(0, 0, 1))
+	if err != nil || len(report) != 1 {
+		t.Fatalf("GetDailyReport: %+v, %v", report, err)
+	}
+	want := types.DailyReport{
+		Day:             today.Format(types.DayLayout),
+		PointsIssued:    150.5,
+		PointsRedeemed:  20,
+		ActiveUsers:     2,
+		OrdersUploaded:  3,
+		OrdersProcessed: 2,
+		OrdersInvalid:   1,
+	}
+	if report[0] != want {
+		t.Fatalf("GetDailyReport: %+v, want %+v", report[0], want)
+	}
+	if report, err = s.GetDailyReport(today.AddDate(0, 0, -7), today); err != nil || len(report) != 0 {
+		t.Fatalf("GetDailyReport for last week: %+v, %v", report, err)
+	}
+}
+
+// mustUsers registers alice and bob and returns their ids.
+func mustUsers(t *testing.T, s types.Storage) (alice, bob int) {
+	t.Helper()
+	ids := make([]int, 0, 2)
+	for _, login := range []string{"alice", "bob"} {
+		user, err := s.RegisterNewUser(login, "hash")
+		if err != nil {
+			t.Fatalf("RegisterNewUser(%s): %v", login, err)
+		}
+		ids = append(ids, user.ID)
+	}
+	return ids[0], ids[1]
+}
+
+func mustSaveOrder(t *testing.T, s types.Storage, userID int, number string) {
+	t.Helper()
+	if err := s.SaveOrder(&types.Order{UserID: userID, Number: number, Status: "NEW"}); err != nil {
+		t.Fatalf("SaveOrder(%s): %v", number, err)
+	}
+	time.Sleep(time.Millisecond)
+}
+
+func mustUpgrade(t *testing.T, s types.Storage, order accrualclient.Order) {
+	t.Helper()
+	if err := s.UpgradeOrderStatus(order); err != nil {
+		t.Fatalf("UpgradeOrderStatus(%s): %v", order.Number, err)
+	}
+}
+
+func mustPending(t *testing.T, s types.Storage) []types.PendingOrder {
+	t.Helper()
+	pending, err := s.ClaimPendingOrders("test", 10, 0)
+	if err != nil {
+		t.Fatalf("ClaimPendingOrders: %v", err)
+	}
+	return pending
+}
+
+func assertStatus(t *testing.T, s types.Storage, userID int, number, status string, accrual float64) {
+	t.Helper()
+	orders, _, err := s.GetOrdersByUser(userID)
+	if err != nil {
+		t.Fatalf("GetOrdersByUser: %v", err)
+	}
+	for _, o := range orders {
+		if o.Number != number {
+			continue
+		}
+		if o.Status != status || !almostEqual(o.Accrual, accrual) {
+			t.Fatalf("order %s: status=%s accrual=%v, want %s %v", number, o.Status, o.Accrual, status, accrual)
+		}
+		return
+	}
+	t.Fatalf("order %s not found", number)
+}
+
+func almostEqual(a, b float64) bool {
+	const eps = 1e-6
+	return a-b < eps && b-a < eps
+}
@@ -1,10 +1,10 @@
 package types
 
 import (
-	"errors"
 	"net/http"
-	"net/url"
 	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
 )
 
 type Authorization interface {
@@ -18,20 +18,49 @@ type Authorization interface {
 
 type Storage interface {
 	SaveOrder(order *Order) error
-	SaveWithdrawal(withdrawal Withdrawal, authUserLogin string) error
-	GetOrderUserByNum(orderNum string) (user string, exists bool, err error)
-	GetOrderUser(orderNum string) (userID string, err error)
-	GetOrdersByUser(authUserID string) (orders []Order, exist bool, err error)
-	GetBalance(authUserLogin string) (balance float64, withdrawn float64, err error)
-	UpgradeOrderStatus(body []byte, orderNum string) error
-	GetWithdrawalsByUser(authUserLogin string) (withdrawals []Withdrawal, exists bool, err error)
-	CheckOrders(accrualSysClient Client)
+	SaveOrders(userID int, numbers []string) (map[string]OrderUploadResult, error)
+	SaveWithdrawal(withdrawal Withdrawal, authUserID int) error
+	GetOrderUserByNum(orderNum string) (userID int, exists bool, err error)
+	GetOrderUser(orderNum string) (userID int, err error)
+	GetOrdersByUser(authUserID int) (orders []Order, exist bool, err error)
+	GetBalance(authUserID int) (balance float64, withdrawn float64, err error)
+	GetWithdrawalsByUser(authUserID int) (withdrawals []Withdrawal, exists bool, err error)
+	GetWithdrawalByOrder(orderNum string) (withdrawal Withdrawal, exists bool, err error)
+	ReverseWithdrawal(id int64, reason string, actor string) (Withdrawal, error)
+	GetOrderEvents(authUserID int, afterID int64, limit int) ([]OrderEvent, error)
+	GetLastOrderEventID(authUserID int) (int64, error)
+	GetExpiringPoints(authUserID int, before time.Time) (float64, error)
+	GetPointExpirations(authUserID int) ([]PointExpiration, error)
+	Transfer(transfer Transfer, dailyLimit float64) (Transfer, error)
+	GetTransactions(authUserID int) ([]Transaction, error)
+	StreamStatement(authUserID int, from, to time.Time, fn func(StatementEntry) error) error
+	PointsExpirer
+	Reporter
+	PendingOrders
 	CheckUserData(login, hash string) bool
 	RegisterNewUser(login string, password string) (User, error)
 	GetUserData(login string) (User, error)
 	Close()
 }
 
+type PendingOrders interface {
+	ClaimPendingOrders(worker string, limit int, lease time.Duration) ([]PendingOrder, error)
+	RescheduleOrder(orderNum string, delay time.Duration) error
+	UpgradeOrderStatus(order accrualclient.Order) error
+}
+
+type PointsExpirer interface {
+	ExpirePoints(now time.Time, limit int) ([]PointExpiration, error)
+}
+
+// Reporter serves aggregates for the admin reports. Storages that keep them
+// precomputed update them on RefreshReports, so reports may lag behind by up
+// to the refresh interval.
+type Reporter interface {
+	GetDailyReport(from, to time.Time) ([]DailyReport, error)
+	RefreshReports() error
+}
+
 type UserDB interface {
 	RegisterNewUser(login string, password string) (User, error)
 	GetUserData(login string) (User, error)
@@ -48,35 +77,136 @@ type UserData struct {
 }
 
 type Withdrawal struct {
-	UserID      int
-	OrderNum    string    `json:"order"`
-	Accrual     float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	ID          int64      `json:"id"`
+	UserID      int        `json:"-"`
+	OrderNum    string     `json:"order"`
+	Accrual     float64    `json:"sum"`
+	Status      string     `json:"status"`
+	ProcessedAt time.Time  `json:"processed_at"`
+	ReversedAt  *time.Time `json:"reversed_at,omitempty"`
+	Reason      string     `json:"reversal_reason,omitempty"`
 }
 
-type Client struct {
-	URL    url.URL
-	Client http.Client
+const (
+	WithdrawalCompleted = "COMPLETED"
+	WithdrawalReversed  = "REVERSED"
+)
+
+type WithdrawalReversal struct {
+	Order  string `json:"order"`
+	Reason string `json:"reason"`
+}
+
+type PendingOrder struct {
+	Number   string
+	Attempts int
+	// Processed orders stay pending only to pick up a cancellation.
+	Processed bool
 }
 
 type Balance struct {
-	Balance   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Balance      float64 `json:"current"`
+	Withdrawn    float64 `json:"withdrawn"`
+	ExpiringSoon float64 `json:"expiring_soon"`
+}
+
+// Transfer is keyed by FromID and ToID; From and To carry the logins shown
+// to users.
+type Transfer struct {
+	ID        int64     `json:"id"`
+	FromID    int       `json:"-"`
+	ToID      int       `json:"-"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Amount    float64   `json:"sum"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TransactionType string
+
+const (
+	TransactionAccrual     TransactionType = "accrual"
+	TransactionWithdrawal  TransactionType = "withdrawal"
+	TransactionReversal    TransactionType = "reversal"
+	TransactionTransferIn  TransactionType = "transfer_in"
+	TransactionTransferOut TransactionType = "transfer_out"
+	TransactionExpiration  TransactionType = "expiration"
+	TransactionClawback    TransactionType = "clawback"
+	TransactionOrder       TransactionType = "order"
+)
+
+// Transaction is one entry of a user's point history. Amount is positive
+// for credits and negative for debits.
+type Transaction struct {
+	Type         TransactionType `json:"type"`
+	Amount       float64         `json:"amount"`
+	Order        string          `json:"order,omitempty"`
+	Counterparty string          `json:"counterparty,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// StatementEntry is one line of a user's statement. Orders appear as
+// TransactionOrder entries with zero amount; Balance is the running balance
+// after the entry, counted from the very first entry of the user's history.
+type StatementEntry struct {
+	Transaction
+	Status  string  `json:"status,omitempty"`
+	Balance float64 `json:"balance"`
+}
+
+const DayLayout = "2006-01-02"
+
+// DailyReport holds the program totals of one UTC day. Orders are counted
+// as uploaded and invalid on the day of upload and as processed on the day
+// their accrual was credited.
+type DailyReport struct {
+	Day             string  `json:"day"`
+	PointsIssued    float64 `json:"points_issued"`
+	PointsRedeemed  float64 `json:"points_redeemed"`
+	ActiveUsers     int     `json:"active_users"`
+	OrdersUploaded  int     `json:"orders_uploaded"`
+	OrdersProcessed int     `json:"orders_processed"`
+	OrdersInvalid   int     `json:"orders_invalid"`
+	AverageAccrual  float64 `json:"average_accrual"`
+	InvalidRate     float64 `json:"invalid_rate"`
+}
+
+type PointExpiration struct {
+	ID        int64     `json:"-"`
+	UserID    int       `json:"-"`
+	OrderNum  string    `json:"order,omitempty"`
+	Amount    float64   `json:"sum"`
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiredAt time.Time `json:"expired_at"`
 }
 type Order struct {
-	User       string
+	UserID     int       `json:"-"`
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
 	Accrual    float64   `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
-var (
-	ErrUserExists   = errors.New("such user already exist in DB")
-	ErrScanData     = errors.New("error while scan user ID")
-	ErrInvalidData  = errors.New("error user data is invalid")
-	ErrHashGenerate = errors.New("error can't generate hash")
-	ErrKeyNotFound  = errors.New("error user ID not found")
-	ErrAlarm        = errors.New("error tx.BeginTx alarm")
-	ErrAlarm2       = errors.New("error tx.PrepareContext alarm")
+type OrderEvent struct {
+	ID             int64     `json:"id"`
+	UserID         int       `json:"-"`
+	Number         string    `json:"number"`
+	PreviousStatus string    `json:"previous_status"`
+	Status         string    `json:"status"`
+	Accrual        float64   `json:"accrual,omitempty"`
+	ChangedAt      time.Time `json:"changed_at"`
+}
+
+type OrderUploadResult string
+
+const (
+	OrderAccepted        OrderUploadResult = "accepted"
+	OrderAlreadyUploaded OrderUploadResult = "already_uploaded"
+	OrderConflict        OrderUploadResult = "uploaded_by_another_user"
+	OrderInvalid         OrderUploadResult = "invalid"
 )
+
+type BatchOrderResult struct {
+	Number string            `json:"number"`
+	Result OrderUploadResult `json:"result"`
+}
@@ -0,0 +1,787 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AbramovArseniy/Gofermart/internal/accrual/dispatcher"
+	accrualhandlers "github.com/AbramovArseniy/Gofermart/internal/accrual/handlers"
+	accrualstorage "github.com/AbramovArseniy/Gofermart/internal/accrual/utils/storage"
+	accrualtypes "github.com/AbramovArseniy/Gofermart/internal/accrual/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/handlers"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/reconciler"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/accrualclient"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/storage"
+	"github.com/AbramovArseniy/Gofermart/internal/gophermart/utils/types"
+	"github.com/AbramovArseniy/Gofermart/internal/webhook"
+)
+
+const (
+	jwtSecret     = "integration-secret"
+	adminToken    = "integration-admin"
+	merchantToken = "integration-merchant"
+	transferLimit = 50
+	pollInterval  = 20 * time.Millisecond
+	waitTimeout   = 5 * time.Second
+)
+
+type harness struct {
+	t          *testing.T
+	accrual    *httptest.Server
+	gophermart *httptest.Server
+	breaker    *accrualclient.Breaker
+}
+
+type harnessConfig struct {
+	pollInterval  time.Duration
+	webhookSecret string
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	return newHarnessWith(t, harnessConfig{pollInterval: pollInterval})
+}
+
+func newHarnessWith(t *testing.T, cfg harnessConfig) *harness {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	keeper := accrualstorage.NewMemory()
+	accrualHandler := accrualhandlers.New(keeper)
+	accrualHandler.AdminToken = adminToken
+	accrualHandler.MerchantToken = merchantToken
+	accrualHandler.CallbackHosts = []string{"127.0.0.1"}
+	accrual := httptest.NewServer(accrualHandler.Route())
+	go dispatcher.New(keeper, dispatcher.WithInterval(pollInterval), dispatcher.WithAllowedHosts(accrualHandler.CallbackHosts)).Run(ctx)
+
+	store := storage.NewMemory(ctx)
+	store.SetCancellationWindow(time.Hour)
+	auth := handlers.NewAuth(ctx, store, jwtSecret)
+	breaker := accrualclient.NewBreaker(accrualclient.BreakerConfig{FailureThreshold: 2, CoolDown: time.Minute})
+	client, err := accrualclient.New(accrual.URL,
+		accrualclient.WithTimeout(time.Second),
+		accrualclient.WithRetries(0, 0),
+		accrualclient.WithBreaker(breaker),
+		accrualclient.WithToken(adminToken),
+	)
+	if err != nil {
+		t.Fatalf("accrualclient.New: %v", err)
+	}
+	g := handlers.NewGophermart(client, jwtSecret, store, auth)
+	g.WebhookSecret = cfg.webhookSecret
+	g.AdminToken = adminToken
+	g.MerchantToken = merchantToken
+	g.TransferDailyLimit = transferLimit
+	gophermart := httptest.NewServer(g.Router())
+	r := reconciler.New(g.Storage, client, reconciler.FixedInterval(cfg.pollInterval))
+	r.SetCancellationCheckInterval(cfg.pollInterval)
+	go r.Run(ctx)
+
+	if cfg.webhookSecret != "" {
+		if _, err = client.Subscribe(ctx, gophermart.URL+"/api/accrual/events", cfg.webhookSecret); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		gophermart.Close()
+		accrual.Close()
+	})
+	return &harness{t: t, accrual: accrual, gophermart: gophermart, breaker: breaker}
+}
+
+func (h *harness) do(method, url, token, contentType, body string) (int, http.Header, []byte) {
+	h.t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		h.t.Fatalf("NewRequest: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("reading response of %s %s: %v", method, url, err)
+	}
+	return resp.StatusCode, resp.Header, respBody
+}
+
+func (h *harness) expect(want int, method, path, token, contentType, body string) []byte {
+	h.t.Helper()
+	base := h.gophermart.URL
+	if strings.HasPrefix(path, "/api/orders") || strings.HasPrefix(path, "/api/goods") || strings.HasPrefix(path, "/api/subscriptions") {
+		base = h.accrual.URL
+	}
+	status, _, respBody := h.do(method, base+path, token, contentType, body)
+	if status != want {
+		h.t.Fatalf("%s %s: status %d, want %d, body %s", method, path, status, want, respBody)
+	}
+	return respBody
+}
+
+func (h *harness) register(login, password string) string {
+	h.t.Helper()
+	body := `{"login":"` + login + `","password":"` + password + `"}`
+	status, header, respBody := h.do(http.MethodPost, h.gophermart.URL+"/api/user/register", "", "application/json", body)
+	if status != http.StatusOK {
+		h.t.Fatalf("register %s: status %d, body %s", login, status, respBody)
+	}
+	token := header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		h.t.Fatalf("register %s: no bearer token in response", login)
+	}
+	return token
+}
+
+func (h *harness) login(login, password string) string {
+	h.t.Helper()
+	body := `{"login":"` + login + `","password":"` + password + `"}`
+	status, header, respBody := h.do(http.MethodPost, h.gophermart.URL+"/api/user/login", "", "application/json", body)
+	if status != http.StatusOK {
+		h.t.Fatalf("login %s: status %d, body %s", login, status, respBody)
+	}
+	return header.Get("Authorization")
+}
+
+func (h *harness) waitOrder(token, number, status string) types.Order {
+	h.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		code, _, body := h.do(http.MethodGet, h.gophermart.URL+"/api/user/orders", token, "", "")
+		if code == http.StatusOK {
+			var orders []types.Order
+			if err := json.Unmarshal(body, &orders); err != nil {
+				h.t.Fatalf("decoding orders: %v", err)
+			}
+			for _, o := range orders {
+				if o.Number == number && o.Status == status {
+					return o
+				}
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+	h.t.Fatalf("order %s did not reach status %s in %s", number, status, waitTimeout)
+	return types.Order{}
+}
+
+func (h *harness) balance(token string) types.Balance {
+	h.t.Helper()
+	var b types.Balance
+	body := h.expect(http.StatusOK, http.MethodGet, "/api/user/balance", token, "", "")
+	if err := json.Unmarshal(body, &b); err != nil {
+		h.t.Fatalf("decoding balance: %v", err)
+	}
+	return b
+}
+
+func TestLoyaltyFlow(t *testing.T) {
+	h := newHarness(t)
+
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Чайник","reward":15,"reward_type":"pt"}`)
+	h.expect(http.StatusConflict, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":5,"reward_type":"%"}`)
+
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Чайник Bork","price":7000}]}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"9278923470","goods":[{"description":"Samsung TV","price":50000}]}`)
+
+	alice := h.register("alice", "secret")
+	h.expect(http.StatusConflict, http.MethodPost, "/api/user/register", "", "application/json", `{"login":"alice","password":"other"}`)
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/user/login", "", "application/json", `{"login":"alice","password":"wrong"}`)
+	alice = h.login("alice", "secret")
+	bob := h.register("bob", "secret")
+
+	h.expect(http.StatusUnauthorized, http.MethodGet, "/api/user/orders", "", "", "")
+	h.expect(http.StatusNoContent, http.MethodGet, "/api/user/orders", alice, "", "")
+	h.expect(http.StatusNoContent, http.MethodGet, "/api/user/withdrawals", alice, "", "")
+
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", alice, "text/plain", "12345678903")
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/orders", alice, "text/plain", "12345678903")
+	h.expect(http.StatusConflict, http.MethodPost, "/api/user/orders", bob, "text/plain", "12345678903")
+	h.expect(http.StatusUnprocessableEntity, http.MethodPost, "/api/user/orders", alice, "text/plain", "12345678904")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", alice, "text/plain", "9278923470")
+
+	processed := h.waitOrder(alice, "12345678903", "PROCESSED")
+	if processed.Accrual != 715 {
+		t.Fatalf("accrual for order 12345678903: got %v, want 715", processed.Accrual)
+	}
+	h.waitOrder(alice, "9278923470", "PROCESSED")
+
+	if b := h.balance(alice); b.Balance != 715 || b.Withdrawn != 0 {
+		t.Fatalf("balance before withdrawal: %+v", b)
+	}
+	if b := h.balance(bob); b.Balance != 0 || b.Withdrawn != 0 {
+		t.Fatalf("bob's balance: %+v", b)
+	}
+
+	h.expect(http.StatusPaymentRequired, http.MethodPost, "/api/user/balance/withdraw", alice, "application/json", `{"order":"2377225624","sum":1000}`)
+	h.expect(http.StatusUnprocessableEntity, http.MethodPost, "/api/user/balance/withdraw", alice, "application/json", `{"order":"2377225625","sum":10}`)
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", alice, "application/json", `{"order":"2377225624","sum":215.5}`)
+
+	if b := h.balance(alice); b.Balance != 499.5 || b.Withdrawn != 215.5 {
+		t.Fatalf("balance after withdrawal: %+v", b)
+	}
+
+	var withdrawals []types.Withdrawal
+	body := h.expect(http.StatusOK, http.MethodGet, "/api/user/withdrawals", alice, "", "")
+	if err := json.Unmarshal(body, &withdrawals); err != nil {
+		t.Fatalf("decoding withdrawals: %v", err)
+	}
+	if len(withdrawals) != 1 || withdrawals[0].OrderNum != "2377225624" || withdrawals[0].Accrual != 215.5 {
+		t.Fatalf("withdrawals: %+v", withdrawals)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	h := newHarness(t)
+	alice := h.register("alice", "secret")
+
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/register", "", "application/json", `{"login":""}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/login", "", "text/plain", `{"login":"alice","password":"secret"}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/orders", alice, "application/json", "12345678903")
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/balance/withdraw", alice, "application/json", `{"order":`)
+	h.expect(http.StatusUnprocessableEntity, http.MethodPost, "/api/user/orders", alice, "text/plain", "1234abc")
+
+	status, header, body := h.do(http.MethodPost, h.gophermart.URL+"/api/user/orders", alice, "text/plain", "")
+	if status != http.StatusBadRequest || header.Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("empty order number: status %d, content type %q", status, header.Get("Content-Type"))
+	}
+	var problem struct {
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &problem); err != nil || problem.Status != http.StatusBadRequest || problem.Detail == "" {
+		t.Fatalf("problem body %s: %+v, %v", body, problem, err)
+	}
+
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678904","goods":[{"description":"Bork","price":1}]}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":150,"reward_type":"%"}`)
+}
+
+func TestConcurrentOrderUpload(t *testing.T) {
+	h := newHarness(t)
+	alice := h.register("alice", "secret")
+	bob := h.register("bob", "secret")
+
+	const uploads = 10
+	statuses := make(chan int, 2*uploads)
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		for _, token := range []string{alice, bob} {
+			wg.Add(1)
+			go func(token string) {
+				defer wg.Done()
+				status, _, _ := h.do(http.MethodPost, h.gophermart.URL+"/api/user/orders", token, "text/plain", "12345678903")
+				statuses <- status
+			}(token)
+		}
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusAccepted] != 1 || counts[http.StatusOK] != uploads-1 || counts[http.StatusConflict] != uploads {
+		t.Fatalf("concurrent uploads of one number: %v, want one 202, %d 200 and %d 409", counts, uploads-1, uploads)
+	}
+}
+
+func TestBatchUpload(t *testing.T) {
+	h := newHarness(t)
+	alice := h.register("alice", "secret")
+	bob := h.register("bob", "secret")
+
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", bob, "text/plain", "346436439")
+
+	body := h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders/batch", alice, "text/plain", "12345678903\n346436439\n\n12345678904\n12345678903\n")
+	var results []types.BatchOrderResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("decoding batch results: %v", err)
+	}
+	want := []types.BatchOrderResult{
+		{Number: "12345678903", Result: types.OrderAccepted},
+		{Number: "346436439", Result: types.OrderConflict},
+		{Number: "12345678904", Result: types.OrderInvalid},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("batch results: %+v", results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Fatalf("batch result %d: got %+v, want %+v", i, results[i], want[i])
+		}
+	}
+
+	body = h.expect(http.StatusOK, http.MethodPost, "/api/user/orders/batch", alice, "application/json", `["12345678903"]`)
+	if err := json.Unmarshal(body, &results); err != nil || results[0].Result != types.OrderAlreadyUploaded {
+		t.Fatalf("repeated batch: %s, %v", body, err)
+	}
+
+	body = h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders/batch", alice, "application/json",
+		`["9278923470", "12345678903", "346436439", "79927398710", "9278923470"]`)
+	results = nil
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("decoding mixed batch results: %v", err)
+	}
+	want = []types.BatchOrderResult{
+		{Number: "9278923470", Result: types.OrderAccepted},
+		{Number: "12345678903", Result: types.OrderAlreadyUploaded},
+		{Number: "346436439", Result: types.OrderConflict},
+		{Number: "79927398710", Result: types.OrderInvalid},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("mixed batch results: %+v, want each number once", results)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Fatalf("mixed batch result %d: got %+v, want %+v", i, results[i], want[i])
+		}
+	}
+}
+
+func TestAccrualOutage(t *testing.T) {
+	h := newHarness(t)
+	token := h.register("dave", "password")
+
+	h.expect(http.StatusOK, http.MethodGet, "/ready", "", "", "")
+	h.accrual.Close()
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", token, "text/plain", "12345678903")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", token, "text/plain", "9278923470")
+
+	deadline := time.Now().Add(waitTimeout)
+	for h.breaker.State() != accrualclient.StateOpen {
+		if time.Now().After(deadline) {
+			t.Fatalf("circuit breaker state = %s, want open", h.breaker.State())
+		}
+		time.Sleep(pollInterval)
+	}
+
+	h.expect(http.StatusServiceUnavailable, http.MethodGet, "/ready", "", "", "")
+	metrics := string(h.expect(http.StatusOK, http.MethodGet, "/metrics", "", "", ""))
+	if !strings.Contains(metrics, "accrual_circuit_state 1") || !strings.Contains(metrics, "accrual_circuit_opened_total 1") {
+		t.Fatalf("metrics do not report the open circuit:\n%s", metrics)
+	}
+	h.expect(http.StatusOK, http.MethodGet, "/api/user/balance", token, "", "")
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	const secret = "integration-webhook-secret"
+	h := newHarnessWith(t, harnessConfig{pollInterval: time.Hour, webhookSecret: secret})
+	token := h.register("erin", "password")
+
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/subscriptions", "", "application/json",
+		`{"url":"`+h.gophermart.URL+`/api/accrual/events","secret":"`+secret+`"}`)
+	h.expect(http.StatusCreated, http.MethodPost, "/api/subscriptions", "Bearer "+adminToken, "application/json",
+		`{"url":"`+h.gophermart.URL+`/api/accrual/events","secret":"`+secret+`"}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/subscriptions", "Bearer "+adminToken, "application/json", `{"url":"ftp://x","secret":"short"}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/subscriptions", "Bearer "+adminToken, "application/json",
+		`{"url":"http://10.0.0.1/hook","secret":"`+secret+`"}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/subscriptions", "Bearer "+adminToken, "application/json",
+		`{"url":"http://localhost:1/hook","secret":"`+secret+`"}`)
+	h.expect(http.StatusUnauthorized, http.MethodDelete, "/api/subscriptions/1", "", "", "")
+
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", token, "text/plain", "12345678903")
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+
+	if order := h.waitOrder(token, "12345678903", "PROCESSED"); order.Accrual != 100 {
+		t.Fatalf("accrual pushed by webhook: got %v, want 100", order.Accrual)
+	}
+
+	forged := `{"id":"x","type":"order.status_changed","order":"12345678903","status":"PROCESSED","accrual":1000000}`
+	req, err := http.NewRequest(http.MethodPost, h.gophermart.URL+"/api/accrual/events", strings.NewReader(forged))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	webhook.SetHeaders(req.Header, "wrong-secret", "x", time.Now(), []byte(forged))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST forged event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged event: status %d, want 401", resp.StatusCode)
+	}
+	if b := h.balance(token); b.Balance != 100 {
+		t.Fatalf("balance after forged event: %+v", b)
+	}
+}
+
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+func (h *harness) openEvents(token, lastEventID string) (<-chan sseEvent, func()) {
+	h.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.gophermart.URL+"/api/user/orders/events", nil)
+	if err != nil {
+		h.t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Authorization", token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("GET /api/user/orders/events: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		h.t.Fatalf("GET /api/user/orders/events: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.id != "" {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events, cancel
+}
+
+func (h *harness) nextEvent(events <-chan sseEvent) types.OrderEvent {
+	h.t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			h.t.Fatal("event stream closed")
+		}
+		var orderEvent types.OrderEvent
+		if err := json.Unmarshal([]byte(event.data), &orderEvent); err != nil {
+			h.t.Fatalf("decoding event %+v: %v", event, err)
+		}
+		if event.name != "order" || event.id != strconv.FormatInt(orderEvent.ID, 10) {
+			h.t.Fatalf("malformed event %+v", event)
+		}
+		return orderEvent
+	case <-time.After(waitTimeout):
+		h.t.Fatal("no event received")
+	}
+	return types.OrderEvent{}
+}
+
+func TestOrderEventsStream(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"9278923470","goods":[{"description":"Bork","price":500}]}`)
+	frank := h.register("frank", "password")
+	grace := h.register("grace", "password")
+
+	h.expect(http.StatusUnauthorized, http.MethodGet, "/api/user/orders/events", "", "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/user/orders/events?last_event_id=abc", frank, "", "")
+
+	events, closeStream := h.openEvents(frank, "")
+	graceEvents, closeGrace := h.openEvents(grace, "")
+	defer closeGrace()
+
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", frank, "text/plain", "12345678903")
+	first := h.nextEvent(events)
+	if first.Number != "12345678903" || first.Status != "PROCESSED" || first.Accrual != 100 {
+		t.Fatalf("first event: %+v", first)
+	}
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", frank, "text/plain", "9278923470")
+	second := h.nextEvent(events)
+	if second.Number != "9278923470" || second.Accrual != 50 || second.ID <= first.ID {
+		t.Fatalf("second event: %+v", second)
+	}
+	closeStream()
+
+	resumed, closeResumed := h.openEvents(frank, strconv.FormatInt(first.ID, 10))
+	defer closeResumed()
+	if event := h.nextEvent(resumed); event.ID != second.ID {
+		t.Fatalf("resumed stream started with %+v, want event %d", event, second.ID)
+	}
+
+	fresh, closeFresh := h.openEvents(frank, "")
+	defer closeFresh()
+	select {
+	case event := <-fresh:
+		t.Fatalf("stream without Last-Event-ID replayed %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	replayed, closeReplayed := h.openEvents(frank, "0")
+	defer closeReplayed()
+	if event := h.nextEvent(replayed); event.ID != first.ID {
+		t.Fatalf("stream with Last-Event-ID 0 started with %+v, want event %d", event, first.ID)
+	}
+
+	select {
+	case event := <-graceEvents:
+		t.Fatalf("grace received frank's event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWithdrawalReversal(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	heidi := h.register("heidi", "password")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", heidi, "text/plain", "12345678903")
+	h.waitOrder(heidi, "12345678903", "PROCESSED")
+
+	for i := 0; i < 2; i++ {
+		h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", heidi, "application/json", `{"order":"2377225624","sum":40}`)
+	}
+	h.expect(http.StatusConflict, http.MethodPost, "/api/user/balance/withdraw", heidi, "application/json", `{"order":"2377225624","sum":41}`)
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", heidi, "application/json", `{"order":"346436439","sum":30}`)
+
+	var withdrawals []types.Withdrawal
+	if err := json.Unmarshal(h.expect(http.StatusOK, http.MethodGet, "/api/user/withdrawals", heidi, "", ""), &withdrawals); err != nil {
+		t.Fatalf("decoding withdrawals: %v", err)
+	}
+	if len(withdrawals) != 2 || withdrawals[0].Status != types.WithdrawalCompleted {
+		t.Fatalf("withdrawals: %+v", withdrawals)
+	}
+	reversePath := "/api/admin/withdrawals/" + strconv.FormatInt(withdrawals[0].ID, 10) + "/reverse"
+
+	h.expect(http.StatusUnauthorized, http.MethodPost, reversePath, heidi, "", "")
+	h.expect(http.StatusUnauthorized, http.MethodPost, reversePath, "Bearer "+merchantToken, "", "")
+	h.expect(http.StatusNotFound, http.MethodPost, "/api/admin/withdrawals/999/reverse", "Bearer "+adminToken, "", "")
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/admin/withdrawals/abc/reverse", "Bearer "+adminToken, "", "")
+	for i := 0; i < 2; i++ {
+		h.expect(http.StatusOK, http.MethodPost, reversePath, "Bearer "+adminToken, "application/json", `{"reason":"order cancelled"}`)
+	}
+	if b := h.balance(heidi); b.Balance != 70 || b.Withdrawn != 30 {
+		t.Fatalf("balance after admin reversal: %+v", b)
+	}
+
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/merchant/withdrawals/reverse", "Bearer "+adminToken, "application/json", `{"order":"346436439"}`)
+	h.expect(http.StatusNotFound, http.MethodPost, "/api/merchant/withdrawals/reverse", "Bearer "+merchantToken, "application/json", `{"order":"12345678903"}`)
+	body := h.expect(http.StatusOK, http.MethodPost, "/api/merchant/withdrawals/reverse", "Bearer "+merchantToken, "application/json", `{"order":"346436439","reason":"refund"}`)
+	var reversed types.Withdrawal
+	if err := json.Unmarshal(body, &reversed); err != nil {
+		t.Fatalf("decoding reversed withdrawal: %v", err)
+	}
+	if reversed.Status != types.WithdrawalReversed || reversed.Reason != "refund" || reversed.ReversedAt == nil {
+		t.Fatalf("merchant reversal: %+v", reversed)
+	}
+	if b := h.balance(heidi); b.Balance != 100 || b.Withdrawn != 0 {
+		t.Fatalf("balance after merchant reversal: %+v", b)
+	}
+
+	withdrawals = nil
+	if err := json.Unmarshal(h.expect(http.StatusOK, http.MethodGet, "/api/user/withdrawals", heidi, "", ""), &withdrawals); err != nil {
+		t.Fatalf("decoding withdrawals: %v", err)
+	}
+	for _, w := range withdrawals {
+		if w.Status != types.WithdrawalReversed {
+			t.Fatalf("withdrawal %+v not reported as reversed", w)
+		}
+	}
+}
+
+func TestOrderCancellation(t *testing.T) {
+	t.Run("Webhook", func(t *testing.T) {
+		testOrderCancellation(t, newHarnessWith(t, harnessConfig{pollInterval: pollInterval, webhookSecret: "integration-webhook-secret"}))
+	})
+	t.Run("Polling", func(t *testing.T) {
+		testOrderCancellation(t, newHarness(t))
+	})
+}
+
+func testOrderCancellation(t *testing.T, h *harness) {
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	ivan := h.register("ivan", "password")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", ivan, "text/plain", "12345678903")
+	h.waitOrder(ivan, "12345678903", "PROCESSED")
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", ivan, "application/json", `{"order":"2377225624","sum":60}`)
+
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/orders/12345678903/cancel", "", "", "")
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/orders/12345678903/cancel", "Bearer "+adminToken, "", "")
+	h.expect(http.StatusNotFound, http.MethodPost, "/api/orders/9278923470/cancel", "Bearer "+merchantToken, "", "")
+	h.expect(http.StatusUnprocessableEntity, http.MethodPost, "/api/orders/12345678904/cancel", "Bearer "+merchantToken, "", "")
+	for i := 0; i < 2; i++ {
+		h.expect(http.StatusOK, http.MethodPost, "/api/orders/12345678903/cancel", "Bearer "+merchantToken, "", "")
+	}
+
+	if order := h.waitOrder(ivan, "12345678903", "CANCELLED"); order.Accrual != 100 {
+		t.Fatalf("cancelled order: %+v", order)
+	}
+	if b := h.balance(ivan); b.Balance != -60 || b.Withdrawn != 60 {
+		t.Fatalf("balance after clawback: %+v", b)
+	}
+	h.expect(http.StatusPaymentRequired, http.MethodPost, "/api/user/balance/withdraw", ivan, "application/json", `{"order":"346436439","sum":1}`)
+}
+
+func TestPointTransfer(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	judy := h.register("judy", "password")
+	karl := h.register("karl", "password")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", judy, "text/plain", "12345678903")
+	h.waitOrder(judy, "12345678903", "PROCESSED")
+
+	h.expect(http.StatusNoContent, http.MethodGet, "/api/user/transactions", karl, "", "")
+	h.expect(http.StatusUnauthorized, http.MethodPost, "/api/user/balance/transfer", "", "application/json", `{"to":"karl","sum":10}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/balance/transfer", judy, "application/json", `{"to":"judy","sum":10}`)
+	h.expect(http.StatusBadRequest, http.MethodPost, "/api/user/balance/transfer", judy, "application/json", `{"to":"karl","sum":0.5}`)
+	h.expect(http.StatusUnprocessableEntity, http.MethodPost, "/api/user/balance/transfer", judy, "application/json", `{"to":"nobody","sum":10}`)
+	h.expect(http.StatusPaymentRequired, http.MethodPost, "/api/user/balance/transfer", karl, "application/json", `{"to":"judy","sum":10}`)
+
+	body := h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/transfer", judy, "application/json", `{"to":"karl","sum":30}`)
+	var transfer types.Transfer
+	if err := json.Unmarshal(body, &transfer); err != nil {
+		t.Fatalf("decoding transfer: %v", err)
+	}
+	if transfer.From != "judy" || transfer.To != "karl" || transfer.Amount != 30 {
+		t.Fatalf("transfer: %+v", transfer)
+	}
+	h.expect(http.StatusForbidden, http.MethodPost, "/api/user/balance/transfer", judy, "application/json", `{"to":"karl","sum":30}`)
+
+	if b := h.balance(judy); b.Balance != 70 || b.Withdrawn != 0 {
+		t.Fatalf("sender balance: %+v", b)
+	}
+	if b := h.balance(karl); b.Balance != 30 {
+		t.Fatalf("recipient balance: %+v", b)
+	}
+
+	var history []types.Transaction
+	if err := json.Unmarshal(h.expect(http.StatusOK, http.MethodGet, "/api/user/transactions", karl, "", ""), &history); err != nil {
+		t.Fatalf("decoding transactions: %v", err)
+	}
+	if len(history) != 1 || history[0].Type != types.TransactionTransferIn || history[0].Counterparty != "judy" || history[0].Amount != 30 {
+		t.Fatalf("recipient transactions: %+v", history)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	leo := h.register("leo", "password")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", leo, "text/plain", "12345678903")
+	h.waitOrder(leo, "12345678903", "PROCESSED")
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", leo, "application/json", `{"order":"2377225624","sum":25.5}`)
+
+	h.expect(http.StatusUnauthorized, http.MethodGet, "/api/user/statement", "", "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/user/statement?format=xml", leo, "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/user/statement?from=yesterday", leo, "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/user/statement?from=2024-02-01&to=2024-01-01", leo, "", "")
+
+	var entries []types.StatementEntry
+	if err := json.Unmarshal(h.expect(http.StatusOK, http.MethodGet, "/api/user/statement", leo, "", ""), &entries); err != nil {
+		t.Fatalf("decoding statement: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Type != types.TransactionOrder || entries[1].Balance != 100 || entries[2].Balance != 74.5 {
+		t.Fatalf("statement: %+v", entries)
+	}
+	if body := h.expect(http.StatusOK, http.MethodGet, "/api/user/statement?to=2000-01-01", leo, "", ""); string(body) != "[]" {
+		t.Fatalf("empty statement: %s", body)
+	}
+
+	status, header, body := h.do(http.MethodGet, h.gophermart.URL+"/api/user/statement?format=csv", leo, "", "")
+	if status != http.StatusOK || header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("csv statement: %d %v", status, header)
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("decoding csv statement: %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "created_at" || records[3][1] != "withdrawal" || records[3][5] != "-25.5" || records[3][6] != "74.5" {
+		t.Fatalf("csv statement: %q", records)
+	}
+}
+
+func TestDailyReport(t *testing.T) {
+	h := newHarness(t)
+	h.expect(http.StatusOK, http.MethodPost, "/api/goods", "", "application/json", `{"match":"Bork","reward":10,"reward_type":"%"}`)
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/orders", "", "application/json",
+		`{"order":"12345678903","goods":[{"description":"Bork","price":1000}]}`)
+	mia := h.register("mia", "password")
+	h.expect(http.StatusAccepted, http.MethodPost, "/api/user/orders", mia, "text/plain", "12345678903")
+	h.waitOrder(mia, "12345678903", "PROCESSED")
+	h.expect(http.StatusOK, http.MethodPost, "/api/user/balance/withdraw", mia, "application/json", `{"order":"2377225624","sum":40}`)
+
+	h.expect(http.StatusUnauthorized, http.MethodGet, "/api/admin/reports/daily", mia, "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/admin/reports/daily?from=2024-02-01&to=2024-01-01", "Bearer "+adminToken, "", "")
+	h.expect(http.StatusBadRequest, http.MethodGet, "/api/admin/reports/daily?from=2020-01-01&to=2024-01-01", "Bearer "+adminToken, "", "")
+
+	var report []types.DailyReport
+	if err := json.Unmarshal(h.expect(http.StatusOK, http.MethodGet, "/api/admin/reports/daily", "Bearer "+adminToken, "", ""), &report); err != nil {
+		t.Fatalf("decoding report: %v", err)
+	}
+	if len(report) != 1 || report[0].PointsIssued != 100 || report[0].PointsRedeemed != 40 || report[0].ActiveUsers != 1 ||
+		report[0].AverageAccrual != 100 || report[0].InvalidRate != 0 {
+		t.Fatalf("daily report: %+v", report)
+	}
+
+	rulesURL := h.gophermart.URL + "/api/admin/reports/rules"
+	if status, _, _ := h.do(http.MethodGet, rulesURL, "", "", ""); status != http.StatusUnauthorized {
+		t.Fatalf("rules report without token: status %d", status)
+	}
+	if status, _, _ := h.do(http.MethodGet, rulesURL+"?limit=0", "Bearer "+adminToken, "", ""); status != http.StatusBadRequest {
+		t.Fatalf("rules report with limit=0: status %d", status)
+	}
+	status, _, body := h.do(http.MethodGet, rulesURL, "Bearer "+adminToken, "", "")
+	var rules []accrualtypes.RuleStats
+	if err := json.Unmarshal(body, &rules); status != http.StatusOK || err != nil {
+		t.Fatalf("rules report: %d %s %v", status, body, err)
+	}
+	if len(rules) != 1 || rules[0].Match != "Bork" || rules[0].Orders != 1 || rules[0].Points != 100 {
+		t.Fatalf("rules report: %+v", rules)
+	}
+	status, _, body = h.do(http.MethodGet, h.accrual.URL+"/api/admin/reports/rules", "Bearer "+adminToken, "", "")
+	if status != http.StatusOK || !bytes.Contains(body, []byte(`"Bork"`)) {
+		t.Fatalf("accrual rules report: %d %s", status, body)
+	}
+}
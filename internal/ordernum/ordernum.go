@@ -0,0 +1,70 @@
+package ordernum
+
+import "errors"
+
+var (
+	ErrEmpty     = errors.New("order number is empty")
+	ErrNotDigits = errors.New("order number must contain only digits")
+	ErrChecksum  = errors.New("order number failed luhn check")
+)
+
+func Validate(number string) error {
+	if err := checkDigits(number); err != nil {
+		return err
+	}
+	if luhnSum(number, false) != 0 {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func Valid(number string) bool {
+	return Validate(number) == nil
+}
+
+func CheckDigit(payload string) (byte, error) {
+	if err := checkDigits(payload); err != nil {
+		return 0, err
+	}
+	return byte('0' + (10-luhnSum(payload, true))%10), nil
+}
+
+func Complete(payload string) (string, error) {
+	digit, err := CheckDigit(payload)
+	if err != nil {
+		return "", err
+	}
+	return payload + string(digit), nil
+}
+
+func checkDigits(number string) error {
+	if number == "" {
+		return ErrEmpty
+	}
+	for i := 0; i < len(number); i++ {
+		if number[i] < '0' || number[i] > '9' {
+			return ErrNotDigits
+		}
+	}
+	return nil
+}
+
+// luhnSum returns the Luhn sum modulo 10. When withCheckDigit is true the
+// number is treated as a payload whose check digit is still to be appended,
+// so doubling starts from the rightmost digit.
+func luhnSum(number string, withCheckDigit bool) int {
+	var sum int
+	double := withCheckDigit
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum % 10
+}
@@ -0,0 +1,127 @@
+package ordernum
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		number string
+		want   error
+	}{
+		{"12345678903", nil},
+		{"9278923470", nil},
+		{"346436439", nil},
+		{"2377225624", nil},
+		{"0", nil},
+		{"12345678904", ErrChecksum},
+		{"", ErrEmpty},
+		{" 12345678903", ErrNotDigits},
+		{"12345678903\n", ErrNotDigits},
+		{"1234567890a", ErrNotDigits},
+		{"-12345678903", ErrNotDigits},
+		{"１２３", ErrNotDigits},
+	}
+	for _, tt := range tests {
+		if got := Validate(tt.number); !errors.Is(got, tt.want) {
+			t.Errorf("Validate(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+		if got := Valid(tt.number); got != (tt.want == nil) {
+			t.Errorf("Valid(%q) = %t", tt.number, got)
+		}
+	}
+}
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    byte
+	}{
+		{"1234567890", '3'},
+		{"927892347", '0'},
+		{"34643643", '9'},
+		{"7992739871", '3'},
+	}
+	for _, tt := range tests {
+		got, err := CheckDigit(tt.payload)
+		if err != nil || got != tt.want {
+			t.Errorf("CheckDigit(%q) = %q, %v, want %q", tt.payload, got, err, tt.want)
+		}
+	}
+	if _, err := CheckDigit(""); !errors.Is(err, ErrEmpty) {
+		t.Errorf("CheckDigit(\"\") error = %v, want %v", err, ErrEmpty)
+	}
+	if _, err := CheckDigit("12a"); !errors.Is(err, ErrNotDigits) {
+		t.Errorf("CheckDigit(\"12a\") error = %v, want %v", err, ErrNotDigits)
+	}
+}
+
+func TestCompletedNumbersAreValid(t *testing.T) {
+	property := func(n uint64) bool {
+		number, err := Complete(strconv.FormatUint(n, 10))
+		return err == nil && Valid(number)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSingleDigitChangeIsDetected(t *testing.T) {
+	property := func(n uint64, pos uint8, delta uint8) bool {
+		number, err := Complete(strconv.FormatUint(n, 10))
+		if err != nil {
+			return false
+		}
+		i := int(pos) % len(number)
+		d := (number[i]-'0'+delta%9+1)%10 + '0'
+		changed := number[:i] + string(d) + number[i+1:]
+		return !Valid(changed)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	for _, seed := range []string{"", "0", "12345678903", "12345678904", "1234 5678903", "abc", "٣"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, number string) {
+		err := Validate(number)
+		if err != nil {
+			return
+		}
+		if number == "" {
+			t.Fatal("empty number accepted")
+		}
+		for i := 0; i < len(number); i++ {
+			if number[i] < '0' || number[i] > '9' {
+				t.Fatalf("number %q with non-digit accepted", number)
+			}
+		}
+	})
+}
+
+func FuzzComplete(f *testing.F) {
+	for _, seed := range []string{"", "0", "1234567890", "99999999999999999999", "12a"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, payload string) {
+		number, err := Complete(payload)
+		if err != nil {
+			if checkDigits(payload) == nil {
+				t.Fatalf("Complete(%q) failed for numeric payload: %v", payload, err)
+			}
+			return
+		}
+		if !Valid(number) {
+			t.Fatalf("Complete(%q) = %q is not valid", payload, number)
+		}
+		if number[:len(payload)] != payload {
+			t.Fatalf("Complete(%q) = %q changed the payload", payload, number)
+		}
+	})
+}
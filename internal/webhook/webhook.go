@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "X-Accrual-Timestamp"
+	HeaderSignature = "X-Accrual-Signature"
+	HeaderEventID   = "X-Accrual-Event-Id"
+
+	EventOrderStatusChanged = "order.status_changed"
+
+	DefaultTolerance = 5 * time.Minute
+	signaturePrefix  = "sha256="
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook signature is missing")
+	ErrInvalidSignature = errors.New("webhook signature does not match")
+	ErrExpired          = errors.New("webhook timestamp is outside of the tolerance window")
+)
+
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Order     string    `json:"order"`
+	Status    string    `json:"status"`
+	Accrual   float64   `json:"accrual,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Sign returns the signature of body sent at timestamp. The timestamp is
+// part of the signed message so a captured request can't be replayed later.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func SetHeaders(h http.Header, secret, eventID string, timestamp time.Time, body []byte) {
+	h.Set(HeaderTimestamp, strconv.FormatInt(timestamp.Unix(), 10))
+	h.Set(HeaderSignature, Sign(secret, timestamp, body))
+	h.Set(HeaderEventID, eventID)
+}
+
+func Verify(secret string, h http.Header, body []byte, tolerance time.Duration) error {
+	signature := h.Get(HeaderSignature)
+	if signature == "" || !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrMissingSignature
+	}
+	seconds, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return ErrMissingSignature
+	}
+	timestamp := time.Unix(seconds, 0)
+	if age := time.Since(timestamp); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
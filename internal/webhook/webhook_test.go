@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"order":"12345678903","status":"PROCESSED","accrual":500}`)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		secret  string
+		sent    time.Time
+		body    []byte
+		mutate  func(h http.Header)
+		wantErr error
+	}{
+		{name: "valid", secret: "secret", sent: now, body: body},
+		{name: "wrong secret", secret: "other", sent: now, body: body, wantErr: ErrInvalidSignature},
+		{name: "tampered body", secret: "secret", sent: now, body: []byte(`{"order":"12345678903","status":"PROCESSED","accrual":5000}`), wantErr: ErrInvalidSignature},
+		{name: "expired", secret: "secret", sent: now.Add(-time.Hour), body: body, wantErr: ErrExpired},
+		{name: "from the future", secret: "secret", sent: now.Add(time.Hour), body: body, wantErr: ErrExpired},
+		{name: "no signature", secret: "secret", sent: now, body: body, mutate: func(h http.Header) { h.Del(HeaderSignature) }, wantErr: ErrMissingSignature},
+		{name: "bad timestamp", secret: "secret", sent: now, body: body, mutate: func(h http.Header) { h.Set(HeaderTimestamp, "yesterday") }, wantErr: ErrMissingSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			SetHeaders(h, tt.secret, "1", tt.sent, body)
+			if tt.mutate != nil {
+				tt.mutate(h)
+			}
+			if err := Verify("secret", h, tt.body, DefaultTolerance); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
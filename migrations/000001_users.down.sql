@@ -1 +0,0 @@
-DROP TABLE users
\ No newline at end of file
@@ -1 +0,0 @@
-DROP TABLE orders
\ No newline at end of file
@@ -1 +0,0 @@
-DROP TABLE withdrawals
\ No newline at end of file